@@ -1,44 +1,105 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"path"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/jinzhu/gorm/dialects/postgres"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
-	minio "github.com/minio/minio-go"
+	"github.com/labstack/gommon/bytes"
 	"github.com/myzie/base"
 	"github.com/myzie/blobs/db"
 	"github.com/myzie/blobs/store"
 	log "github.com/sirupsen/logrus"
 )
 
-// MaxUploadSize defines the max file size in bytes for uploads
+// MaxUploadSize is the upload size limit in bytes used when the configured
+// limit is invalid
 const MaxUploadSize = 100 * 1024 * 1024
 
 type blobsServiceOpts struct {
-	Base      *base.Base
-	Store     store.ObjectStore
-	Database  db.Database
-	SizeLimit string
+	Base        *base.Base
+	Store       store.ObjectStore
+	Database    db.Database
+	SizeLimit   string
+	InlineTypes string
+
+	// UploadExpiry is how long resumable uploads are kept without progress
+	UploadExpiry time.Duration
+
+	// PresignExpiry is how long presigned URLs remain valid
+	PresignExpiry time.Duration
+
+	// Tiering moves blobs between storage tiers, if configured
+	Tiering *tiering
+
+	// Compression is the encoding content of the CompressTypes is stored
+	// with, or empty to store all content as is
+	Compression   string
+	CompressTypes string
+
+	// Chunking splits uploads into deduplicated chunks, if set, and
+	// ChunkGrace is how long unreferenced chunks are kept before they are
+	// removed
+	Chunking   *store.ChunkerOpts
+	ChunkGrace time.Duration
 }
 
 type blobsService struct {
 	*base.Base
-	Store    store.ObjectStore
-	Database db.Database
+	Store       store.ObjectStore
+	Database    db.Database
+	SizeLimit   int64
+	InlineTypes typeList
+
+	UploadExpiry  time.Duration
+	PresignExpiry time.Duration
+	Tiering       *tiering
+
+	Compression   string
+	CompressTypes typeList
+
+	Chunking   *store.ChunkerOpts
+	ChunkGrace time.Duration
 }
 
 // newBlobsService returns an HTTP interface for blobs
 func newBlobsService(opts blobsServiceOpts) *blobsService {
 
+	sizeLimit, err := bytes.Parse(opts.SizeLimit)
+	if err != nil || sizeLimit <= 0 {
+		log.Warnf("Invalid size limit '%s', using %d", opts.SizeLimit, MaxUploadSize)
+		sizeLimit = MaxUploadSize
+	}
+	compression := opts.Compression
+	if compression != "" && !store.ValidEncoding(compression) {
+		log.Warnf("Unknown compression '%s', storing content uncompressed", compression)
+		compression = ""
+	}
+
 	svc := &blobsService{
-		Base:     opts.Base,
-		Store:    opts.Store,
-		Database: opts.Database,
+		Base:        opts.Base,
+		Store:       opts.Store,
+		Database:    opts.Database,
+		SizeLimit:   sizeLimit,
+		InlineTypes: parseTypeList(opts.InlineTypes),
+
+		UploadExpiry:  opts.UploadExpiry,
+		PresignExpiry: opts.PresignExpiry,
+		Tiering:       opts.Tiering,
+
+		Compression:   compression,
+		CompressTypes: parseTypeList(opts.CompressTypes),
+
+		Chunking:   opts.Chunking,
+		ChunkGrace: opts.ChunkGrace,
 	}
 
 	group := svc.Echo.Group("/blobs")
@@ -46,58 +107,170 @@ func newBlobsService(opts blobsServiceOpts) *blobsService {
 	group.Use(middleware.BodyLimit(opts.SizeLimit))
 	group.GET("", svc.List)
 	group.GET("/*", svc.Get)
+	group.HEAD("/*", svc.Head)
 	group.PUT("/*", svc.Put)
 	group.POST("", svc.Post)
+	group.POST("/_move", svc.Move)
+	group.POST("/_copy", svc.Copy)
+	group.POST("/_presign", svc.Presign)
+	group.POST("/_commit", svc.Commit)
 	group.DELETE("/*", svc.Delete)
 
+	// Resumable uploads are sent in chunks, so the body limit of a single
+	// request does not apply. OPTIONS is open for protocol discovery.
+	uploads := svc.Echo.Group("/uploads")
+	uploads.Use(svc.JWTMiddleware())
+	uploads.Use(tusResumable)
+	uploads.POST("", svc.CreateUpload)
+	uploads.HEAD("/:id", svc.UploadStatus)
+	uploads.PATCH("/:id", svc.AppendUpload)
+	uploads.DELETE("/:id", svc.TerminateUpload)
+	svc.Echo.OPTIONS("/uploads", svc.UploadOptions)
+
 	return svc
 }
 
 func (svc *blobsService) Get(c echo.Context) error {
 
-	// Look up blob at the specified path
+	metadata, deprecated := wantsMetadata(c.Request())
+
+	// Look up blob at the specified path, falling back to treating the path
+	// as the metadata sub-resource of a blob
 	path := "/" + c.ParamValues()[0]
 	blob, err := svc.Database.Get(path)
+	if err == db.ErrNotFound && strings.HasSuffix(path, metaSuffix) && path != metaSuffix {
+		blob, err = svc.Database.Get(strings.TrimSuffix(path, metaSuffix))
+		metadata = true
+	}
 	if err != nil {
-		if err.Error() == "record not found" {
-			return c.JSON(NotFound, errorView{"Blob not found"})
-		}
-		log.WithError(err).Error("Get failed")
-		return c.JSON(InternalServerError, errorView{"Failed to look up Blob"})
+		return databaseError(c, err, "Failed to look up Blob")
+	}
+
+	header := c.Response().Header()
+	setBlobHeaders(header, blob)
+	header.Add("Vary", "Accept")
+	if newPreconditions(c.Request().Header).notModified(blob) {
+		return c.NoContent(NotModified)
 	}
 
 	// Return the blob metadata if JSON content was requested
-	contentType := c.Request().Header.Get("Content-Type")
-	if contentType == "application/json" {
+	if metadata {
+		if deprecated {
+			header.Set("Warning", `299 - "Content-Type on GET is deprecated, use Accept: application/json"`)
+		}
 		return c.JSON(OK, newBlobView(blob))
 	}
 
-	// Otherwise return the object itself
-	getOpts := minio.GetObjectOptions{}
-	obj, err := svc.Store.Get(blob.Key(), getOpts)
+	// Otherwise return the object itself, provided it has been uploaded
+	if !blob.Committed() {
+		return c.JSON(Conflict, errorView{"Blob upload incomplete"})
+	}
+	svc.recordAccess(blob)
+	if svc.restoring(blob) {
+		header.Set("Retry-After", strconv.Itoa(restoreRetryAfter))
+		return c.JSON(ServiceUnavailable, errorView{"Blob restoring"})
+	}
+	contentType := svc.setContentHeaders(header, blob)
+
+	// Serve partial content if a range was requested
+	rangeHeader := c.Request().Header.Get("Range")
+	if rangeHeader != "" && ifRangeMatches(c.Request().Header.Get("If-Range"), blob) {
+		ranges, err := parseRange(rangeHeader, blob.Size)
+		if err == errUnsatisfiableRange {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", blob.Size))
+			return c.JSON(RangeNotSatisfiable, errorView{err.Error()})
+		}
+		if err == nil {
+			return svc.streamRanges(c, blob, contentType, ranges)
+		}
+		// Invalid range headers are ignored, per RFC 7233
+	}
+
+	// Compressed content is sent as stored to clients accepting its encoding
+	encoded := setEncodingHeaders(header, c.Request(), blob)
+	obj, err := svc.readContent(c.Request().Context(), blob, encoded)
 	if err != nil {
 		return c.JSON(InternalServerError, errorView{"Failed to get object"})
 	}
-	return c.Stream(OK, "application/octet-stream", obj)
+	defer obj.Close()
+	header.Set("Content-Length", strconv.FormatInt(contentLength(blob, encoded), 10))
+	return c.Stream(OK, contentType, obj)
 }
 
+// Head describes a blob with headers alone
+func (svc *blobsService) Head(c echo.Context) error {
+
+	path := "/" + c.ParamValues()[0]
+	blob, err := svc.Database.Get(path)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return c.NoContent(NotFound)
+		}
+		log.WithError(err).Error("Get failed")
+		return c.NoContent(InternalServerError)
+	}
+
+	header := c.Response().Header()
+	setBlobHeaders(header, blob)
+	if newPreconditions(c.Request().Header).notModified(blob) {
+		return c.NoContent(NotModified)
+	}
+	if !blob.Committed() {
+		return c.NoContent(Conflict)
+	}
+
+	// Content in a slow tier is unavailable until restored, as for a GET
+	svc.recordAccess(blob)
+	if svc.restoring(blob) {
+		header.Set("Retry-After", strconv.Itoa(restoreRetryAfter))
+		return c.NoContent(ServiceUnavailable)
+	}
+	header.Set("Content-Type", svc.setContentHeaders(header, blob))
+	encoded := setEncodingHeaders(header, c.Request(), blob)
+	header.Set("Content-Length", strconv.FormatInt(contentLength(blob, encoded), 10))
+	return c.NoContent(OK)
+}
+
+// setContentHeaders sets the headers describing blob content and returns
+// its content type. Only allowlisted types may be displayed inline; other
+// content is downloaded as an attachment, and browsers are told not to
+// second guess the type in either case.
+func (svc *blobsService) setContentHeaders(header http.Header, blob *db.Blob) string {
+	contentType := blobContentType(blob)
+	header.Set("Content-Disposition", contentDisposition(blob, svc.InlineTypes.Allows(contentType)))
+	header.Set("X-Content-Type-Options", "nosniff")
+	return contentType
+}
+
+// setBlobHeaders sets the headers describing a blob that are common to GET
+// and HEAD responses
+func setBlobHeaders(header http.Header, blob *db.Blob) {
+	header.Set("ETag", etag(blob))
+	header.Set("Last-Modified", lastModified(blob).Format(http.TimeFormat))
+	header.Set("X-Blob-Created-At", blob.CreatedAt.UTC().Format(time.RFC3339))
+	header.Set("Accept-Ranges", "bytes")
+	if blob.SHA256 != "" {
+		header.Set("Digest", digestHeader(blob.SHA256))
+	}
+}
+
+// Put updates blob properties given as JSON. Any other content is uploaded
+// as the content of the blob.
 func (svc *blobsService) Put(c echo.Context) error {
 
-	// Require application/json
 	contentType := c.Request().Header.Get("Content-Type")
-	if contentType != "application/json" {
-		return c.JSON(BadRequest, errorView{"Only JSON is accepted"})
+	if !isJSON(contentType) {
+		return svc.PutContent(c)
 	}
 
 	// Reject request if item does not exist
 	path := "/" + c.ParamValues()[0]
 	blob, err := svc.Database.Get(path)
 	if err != nil {
-		if err.Error() == "record not found" {
-			return c.JSON(NotFound, errorView{"Blob not found"})
-		}
-		log.WithError(err).Error("Get failed")
-		return c.JSON(InternalServerError, errorView{"Failed to look up Blob"})
+		return databaseError(c, err, "Failed to look up Blob")
+	}
+	if !newPreconditions(c.Request().Header).allowWrite(blob) {
+		return c.JSON(PreconditionFailed, errorView{"Precondition failed"})
 	}
 
 	var props BlobProperties
@@ -115,9 +288,76 @@ func (svc *blobsService) Put(c echo.Context) error {
 
 	fields := []string{"properties"}
 	if err := svc.Database.Update(blob, fields); err != nil {
-		log.WithError(err).Error("Failed to update blob")
-		return c.JSON(InternalServerError, errorView{"Failed to update blob"})
+		return databaseError(c, err, "Failed to update blob")
 	}
+	c.Response().Header().Set("ETag", etag(blob))
+	return c.JSON(OK, newBlobView(blob))
+}
+
+// PutContent streams the request body into the blob at the request path,
+// creating the blob if necessary. Upload attributes are given in headers.
+func (svc *blobsService) PutContent(c echo.Context) error {
+
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(*base.JWTClaims)
+	userID := claims.Subject
+
+	req := c.Request()
+	attrs := BlobUploadAttributes{
+		Path:        "/" + c.ParamValues()[0],
+		Hash:        req.Header.Get("X-Blob-Hash"),
+		ContentType: req.Header.Get("Content-Type"),
+	}
+	// Clients such as curl label raw data as form data by default. JSON
+	// content is labelled with a separate header since JSON bodies update
+	// properties.
+	if attrs.ContentType == "application/x-www-form-urlencoded" {
+		attrs.ContentType = ""
+	}
+	if value := req.Header.Get("X-Blob-Content-Type"); value != "" {
+		attrs.ContentType = value
+	}
+	props, err := headerProperties(req.Header)
+	if err != nil {
+		return c.JSON(BadRequest, errorView{err.Error()})
+	}
+	attrs.Properties = props
+	attrs.Normalize()
+	if err := attrs.Validate(svc.SizeLimit); err != nil {
+		return c.JSON(BadRequest, errorView{err.Error()})
+	}
+	propJSON, err := attrs.MarshalProperties()
+	if err != nil {
+		return c.JSON(BadRequest, errorView{"JSON error"})
+	}
+	if len(propJSON) > db.MaxPropertiesSize {
+		return c.JSON(BadRequest, errorView{"Properties too large"})
+	}
+
+	var sum *checksum
+	if attrs.Hash != "" {
+		if sum, err = parseChecksum(attrs.Hash); err != nil {
+			return c.JSON(BadRequest, errorView{err.Error()})
+		}
+	}
+
+	// The content length is unknown for chunked requests, in which case the
+	// size is measured as the body streams in
+	blob, err := svc.upload(c.Request().Context(), &upload{
+		UserID:      userID,
+		Path:        attrs.Path,
+		Size:        req.ContentLength,
+		Properties:  postgres.Jsonb{RawMessage: json.RawMessage(propJSON)},
+		Reader:      req.Body,
+		Checksum:    sum,
+		ContentType: attrs.ContentType,
+
+		Preconditions: newPreconditions(req.Header),
+	})
+	if err != nil {
+		return serviceError(c, err, "Upload failed")
+	}
+	c.Response().Header().Set("ETag", etag(blob))
 	return c.JSON(OK, newBlobView(blob))
 }
 
@@ -132,7 +372,7 @@ func (svc *blobsService) Post(c echo.Context) error {
 		return c.JSON(BadRequest, errorView{"Failed to bind attributes"})
 	}
 	attrs.Normalize()
-	if err := attrs.Validate(); err != nil {
+	if err := attrs.Validate(svc.SizeLimit); err != nil {
 		return c.JSON(BadRequest, errorView{err.Error()})
 	}
 	propJSON, err := attrs.MarshalProperties()
@@ -141,52 +381,10 @@ func (svc *blobsService) Post(c echo.Context) error {
 	}
 	pgrsJSON := postgres.Jsonb{RawMessage: json.RawMessage(propJSON)}
 
-	// Determine if a blob already exists at that path
-	blob, err := svc.Database.Get(attrs.Path)
-	if err != nil {
-		if err.Error() != "record not found" {
-			log.WithError(err).Error("Get failed")
-			return c.JSON(InternalServerError, errorView{"Blob lookup failed"})
-		}
-
-		blob = &db.Blob{
-			ID:         uid(),
-			CreatedBy:  userID,
-			UpdatedBy:  userID,
-			Path:       attrs.Path,
-			Size:       attrs.Size,
-			Properties: pgrsJSON,
-		}
-
-		log.WithFields(log.Fields{
-			"id":         blob.ID,
-			"created_by": blob.CreatedBy,
-			"updated_by": blob.UpdatedBy,
-			"path":       blob.Path,
-			"size":       attrs.Size,
-		}).Info("Creating blob")
-
-		if err := svc.Database.Save(blob); err != nil {
-			log.WithError(err).Error("Save failed")
-			return c.JSON(InternalServerError, errorView{"Save failed"})
-		}
-	} else {
-		blob.Size = attrs.Size
-		blob.Properties = pgrsJSON
-		blob.UpdatedBy = userID
-
-		log.WithFields(log.Fields{
-			"id":         blob.ID,
-			"created_by": blob.CreatedBy,
-			"updated_by": blob.UpdatedBy,
-			"path":       blob.Path,
-			"size":       attrs.Size,
-		}).Info("Updating blob")
-
-		fields := []string{"properties", "size", "updated_by"}
-		if err := svc.Database.Update(blob, fields); err != nil {
-			log.WithError(err).Error("Update failed")
-			return c.JSON(InternalServerError, errorView{"Update failed"})
+	var sum *checksum
+	if attrs.Hash != "" {
+		if sum, err = parseChecksum(attrs.Hash); err != nil {
+			return c.JSON(BadRequest, errorView{err.Error()})
 		}
 	}
 
@@ -194,44 +392,31 @@ func (svc *blobsService) Post(c echo.Context) error {
 	if err != nil {
 		return c.JSON(BadRequest, errorView{"Form file missing"})
 	}
+	if attrs.Size > 0 && attrs.Size != file.Size {
+		return c.JSON(BadRequest, errorView{"File size does not match size attribute"})
+	}
 	src, err := file.Open()
 	if err != nil {
 		return c.JSON(BadRequest, errorView{"Form file error"})
 	}
 	defer src.Close()
 
-	log.WithFields(log.Fields{
-		"id":   blob.ID,
-		"key":  blob.Key(),
-		"size": attrs.Size,
-	}).Info("Upload starting")
+	blob, err := svc.upload(c.Request().Context(), &upload{
+		UserID:     userID,
+		Path:       attrs.Path,
+		Size:       file.Size,
+		Properties: pgrsJSON,
+		Reader:     src,
+		Checksum:   sum,
 
-	fileName := path.Base(attrs.Path)
+		ContentType: declaredContentType(attrs.ContentType, file.Header.Get("Content-Type")),
 
-	opts := minio.PutObjectOptions{
-		ContentType:        "application/octet-stream",
-		ContentDisposition: fmt.Sprintf(`attachment; filename="%s"`, fileName),
-		UserMetadata: map[string]string{
-			"id":   blob.ID,
-			"path": blob.Path,
-		},
-	}
-	n, err := svc.Store.Put(blob.Key(), src, attrs.Size, opts)
+		Preconditions: newPreconditions(c.Request().Header),
+	})
 	if err != nil {
-		log.WithError(err).Error("Error saving file to bucket")
-		return c.JSON(InternalServerError, errorView{"Error saving file"})
+		return serviceError(c, err, "Upload failed")
 	}
-	if n != attrs.Size {
-		log.Error("Uploaded file size incorrect")
-		return c.JSON(InternalServerError, errorView{"Error saving file"})
-	}
-
-	log.WithFields(log.Fields{
-		"id":   blob.ID,
-		"key":  attrs.Key(),
-		"size": attrs.Size,
-	}).Info("Upload complete")
-
+	c.Response().Header().Set("ETag", etag(blob))
 	return c.JSON(OK, newBlobView(blob))
 }
 
@@ -241,19 +426,27 @@ func (svc *blobsService) Delete(c echo.Context) error {
 	path := "/" + c.ParamValues()[0]
 	blob, err := svc.Database.Get(path)
 	if err != nil {
-		return c.JSON(NotFound, errorView{"Blob not found"})
+		return databaseError(c, err, "Failed to look up Blob")
 	}
-
-	// Remove object from S3
-	if err := svc.Store.Remove(blob.Key()); err != nil {
-		log.WithError(err).Error("Failed to delete object")
-		return c.JSON(InternalServerError, errorView{"Failed to delete object"})
+	if !newPreconditions(c.Request().Header).allowWrite(blob) {
+		return c.JSON(PreconditionFailed, errorView{"Precondition failed"})
 	}
 
-	// Remove database entry
+	// Remove database entry first. This fails if the blob was modified
+	// after it was read, in which case its objects must be left alone.
 	if err := svc.Database.Delete(blob); err != nil {
-		log.WithError(err).Error("Failed to delete blob")
-		return c.JSON(InternalServerError, errorView{"Failed to delete blob"})
+		return databaseError(c, err, "Failed to delete blob")
+	}
+
+	// Remove object from S3, unless copies still share it, along with any
+	// upload in progress
+	if blob.Committed() {
+		svc.releaseObject(blob.Backend, blob.Key(), blob.Chunked)
+	}
+	if key := pendingObjectKey(blob); key != "" {
+		if err := svc.Store.Remove(context.Background(), key); err != nil {
+			log.WithError(err).WithField("key", key).Error("Failed to delete staged object")
+		}
 	}
 
 	log.WithFields(log.Fields{"id": blob.ID, "path": path}).
@@ -295,8 +488,7 @@ func (svc *blobsService) List(c echo.Context) error {
 
 	blobs, err := svc.Database.List(query)
 	if err != nil {
-		log.WithError(err).Error("Blob query failed")
-		return c.JSON(InternalServerError, errorView{"Blob query failed"})
+		return databaseError(c, err, "Blob query failed")
 	}
 	return c.JSON(OK, blobs)
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/labstack/gommon/bytes"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// newCache returns a store.CachingStore keeping objects read from the given
+// store in a directory. It sits beneath any encryption, so that only
+// encrypted content is written to local disk.
+func newCache(objStore store.ObjectStore, dir, size string) (*store.CachingStore, error) {
+	maxSize, err := bytes.Parse(size)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cache size: '%s'", size)
+	}
+	log.WithFields(log.Fields{"dir": dir, "size": size}).Info("Caching objects")
+	return store.NewCachingStore(objStore, store.CacheOpts{Dir: dir, MaxSize: maxSize})
+}
+
+// logCacheStats periodically logs the use of the object cache, so that it
+// can be sized
+func logCacheStats(cache *store.CachingStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		stats := cache.Stats()
+		var ratio float64
+		if reads := stats.Hits + stats.Misses; reads > 0 {
+			ratio = float64(stats.Hits) / float64(reads)
+		}
+		log.WithFields(log.Fields{
+			"hits":      stats.Hits,
+			"misses":    stats.Misses,
+			"hit_ratio": ratio,
+			"bypassed":  stats.Bypassed,
+			"evictions": stats.Evictions,
+			"objects":   stats.Objects,
+			"size":      stats.Size,
+		}).Info("Object cache statistics")
+	}
+}
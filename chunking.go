@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	gbytes "github.com/labstack/gommon/bytes"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// manifestContentType is the content type of objects holding a chunk
+// manifest
+const manifestContentType = "application/vnd.blobs.manifest+json"
+
+// chunkSuffix ends the keys of chunk objects, which are named by the
+// SHA-256 of their content
+const chunkSuffix = ".chunk"
+
+// chunkRetryDelay is the wait before a chunk being garbage collected is
+// acquired again
+const chunkRetryDelay = 100 * time.Millisecond
+
+// chunkManifest lists the chunks holding the content of a chunked blob, in
+// order
+type chunkManifest struct {
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+// chunkRef is a chunk of a manifest, given by its key including the backend
+// holding it
+type chunkRef struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// newChunking returns the options of the chunker splitting uploads into
+// chunks of around the given average size
+func newChunking(size string) (*store.ChunkerOpts, error) {
+	avgSize, err := gbytes.Parse(size)
+	if err != nil || avgSize < 1024 || avgSize > 64<<20 {
+		return nil, fmt.Errorf("Invalid chunk size: '%s'", size)
+	}
+	opts := store.DefaultChunkerOpts(int(avgSize))
+	log.WithFields(log.Fields{
+		"min": opts.MinSize,
+		"avg": opts.AvgSize,
+		"max": opts.MaxSize,
+	}).Info("Storing uploads as chunks")
+	return &opts, nil
+}
+
+// chunks returns true if an upload of the given size, or -1 if unknown, is
+// stored as chunks. Content smaller than a chunk gains nothing from it.
+func (svc *blobsService) chunks(size int64) bool {
+	return svc.Chunking != nil && (size < 0 || size > int64(svc.Chunking.MinSize))
+}
+
+// storeChunks splits content into chunks and stores those not already held
+// by the backend, returning the manifest of the content. A reference is
+// taken to every chunk of the manifest, and released again if the content
+// can not be stored.
+func (svc *blobsService) storeChunks(ctx context.Context, backend string, r io.Reader) (*chunkManifest, error) {
+
+	chunker, err := store.NewChunker(r, *svc.Chunking)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &chunkManifest{}
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err == nil {
+			err = svc.storeChunk(ctx, backend, data, manifest)
+		}
+		if err != nil {
+			svc.releaseChunks(manifest)
+			return nil, err
+		}
+	}
+}
+
+// storeChunk adds a chunk to a manifest, storing its content unless the
+// backend already holds it
+func (svc *blobsService) storeChunk(ctx context.Context, backend string, data []byte, manifest *chunkManifest) error {
+
+	sum := sha256.Sum256(data)
+	ref := chunkRef{
+		Key:  store.BackendKey(backend, hex.EncodeToString(sum[:])+chunkSuffix),
+		Size: int64(len(data)),
+	}
+
+	created, err := svc.acquireChunk(ctx, &db.Chunk{ObjectKey: ref.Key, Size: ref.Size})
+	if err != nil {
+		return err
+	}
+	manifest.Chunks = append(manifest.Chunks, ref)
+	manifest.Size += ref.Size
+
+	// The upload that recorded the chunk may still be storing it, or may
+	// have failed to, in which case it is stored again
+	if !created {
+		_, err := svc.Store.Stat(ctx, ref.Key)
+		if err != store.ErrNotFound {
+			return err
+		}
+	}
+	_, err = svc.Store.Put(ctx, ref.Key, bytes.NewReader(data), ref.Size, store.PutOptions{})
+	return err
+}
+
+// acquireChunk takes a reference to a chunk, returning true if the chunk is
+// new. Chunks being garbage collected are acquired once they are gone.
+func (svc *blobsService) acquireChunk(ctx context.Context, chunk *db.Chunk) (bool, error) {
+	for {
+		created, err := svc.Database.AcquireChunk(chunk)
+		if err != db.ErrCollecting {
+			return created, err
+		}
+		select {
+		case <-time.After(chunkRetryDelay):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// releaseChunks releases the references a manifest holds to its chunks.
+// Chunks left without references are removed by the garbage collector.
+func (svc *blobsService) releaseChunks(manifest *chunkManifest) {
+	if manifest == nil {
+		return
+	}
+	for _, ref := range manifest.Chunks {
+		if err := svc.Database.ReleaseChunk(ref.Key); err != nil {
+			log.WithError(err).WithField("key", ref.Key).Error("Failed to release chunk")
+		}
+	}
+}
+
+// encode returns the manifest as it is stored, along with its size
+func (m *chunkManifest) encode() (io.Reader, int64) {
+	data, _ := json.Marshal(m)
+	return bytes.NewReader(data), int64(len(data))
+}
+
+// readManifest reads the chunk manifest stored at a key
+func readManifest(ctx context.Context, s store.ObjectStore, key string) (*chunkManifest, error) {
+	obj, err := s.Get(ctx, key, store.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	manifest := &chunkManifest{}
+	if err := json.NewDecoder(obj).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("Invalid chunk manifest: %s", err.Error())
+	}
+	return manifest, nil
+}
+
+// readChunks returns length bytes of the content of a chunked blob from the
+// given offset. Only the chunks holding the range are read, each as it is
+// reached.
+func (svc *blobsService) readChunks(ctx context.Context, blob *db.Blob, offset, length int64) (io.ReadCloser, error) {
+
+	manifest, err := readManifest(ctx, svc.Store, objectKey(blob))
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Size != blob.Size {
+		return nil, fmt.Errorf("Chunk manifest holds %d bytes, expected %d", manifest.Size, blob.Size)
+	}
+
+	var sections []store.Section
+	for _, ref := range manifest.Chunks {
+		if length <= 0 {
+			break
+		}
+		if offset >= ref.Size {
+			offset -= ref.Size
+			continue
+		}
+		section := store.Section{Name: ref.Key}
+		section.Offset, section.Length = offset, ref.Size-offset
+		if section.Length > length {
+			section.Length = length
+		}
+		sections = append(sections, section)
+		offset = 0
+		length -= section.Length
+	}
+	return store.NewSequenceReader(ctx, svc.Store, sections), nil
+}
+
+// collectChunks removes chunks that have had no references for the grace
+// period. The grace period spares chunks released by content that is soon
+// uploaded again, such as a blob being rewritten, from being removed and
+// stored afresh.
+func (svc *blobsService) collectChunks(grace time.Duration) error {
+
+	const batchSize = 100
+
+	cutoff := time.Now().Add(-grace)
+
+	for {
+		chunks, err := svc.Database.CollectChunks(cutoff, batchSize)
+		if err != nil {
+			return err
+		}
+		collected := 0
+		for _, chunk := range chunks {
+			// Chunks that fail to be removed stay claimed and are retried
+			// on the next pass
+			if err := svc.Store.Remove(context.Background(), chunk.ObjectKey); err != nil {
+				log.WithError(err).WithField("key", chunk.ObjectKey).Error("Failed to remove chunk")
+				continue
+			}
+			if err := svc.Database.DeleteChunk(chunk.ObjectKey); err != nil {
+				log.WithError(err).WithField("key", chunk.ObjectKey).Error("Failed to delete chunk")
+				continue
+			}
+			collected++
+		}
+		if collected > 0 {
+			log.WithField("chunks", collected).Info("Collected unreferenced chunks")
+		}
+		if len(chunks) < batchSize || collected == 0 {
+			return nil
+		}
+	}
+}
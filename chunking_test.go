@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestNewChunking(t *testing.T) {
+	chunking, err := newChunking("1M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunking.AvgSize != 1<<20 || chunking.MinSize != 256<<10 || chunking.MaxSize != 4<<20 {
+		t.Errorf("Unexpected chunk sizes for 1M: %+v", *chunking)
+	}
+
+	svc := &blobsService{Chunking: chunking}
+	if !svc.chunks(-1) || !svc.chunks(1<<20) {
+		t.Error("Expected uploads of unknown or large size to be chunked")
+	}
+	if svc.chunks(1 << 10) {
+		t.Error("Expected uploads smaller than a chunk to be stored whole")
+	}
+	if (&blobsService{}).chunks(1 << 20) {
+		t.Error("Expected uploads to be stored whole without a chunk size")
+	}
+
+	for _, size := range []string{"", "big", "512", "1G"} {
+		if _, err := newChunking(size); err == nil {
+			t.Errorf("Expected chunk size '%s' to be invalid", size)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jinzhu/gorm"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/db/dbtest"
+	"github.com/myzie/blobs/store"
+	"github.com/myzie/blobs/store/storetest"
+)
+
+// blobscheck runs the conformance suites against every ObjectStore and
+// Database implementation. Those needing no external service always run;
+// Minio and Postgres run when they are configured.
+func main() {
+
+	var (
+		minioURL    string
+		minioBucket string
+		minioRegion string
+		minioSSL    bool
+		postgresURL string
+	)
+
+	flag.StringVar(&minioURL, "minio-url", "", "Minio or S3 endpoint to check, using AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	flag.StringVar(&minioBucket, "minio-bucket", "blobscheck", "Bucket to check Minio with")
+	flag.StringVar(&minioRegion, "minio-region", "us-east-1", "Minio region")
+	flag.BoolVar(&minioSSL, "minio-ssl", false, "Use SSL to connect to Minio")
+	flag.StringVar(&postgresURL, "postgres", "", "Postgres database to check. Its blob tables are dropped!")
+	flag.Parse()
+
+	tmp, err := ioutil.TempDir("", "blobscheck-")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(tmp)
+
+	var failed bool
+	report := func(name string, failures []error) {
+		if len(failures) == 0 {
+			fmt.Printf("PASS %s\n", name)
+			return
+		}
+		failed = true
+		fmt.Printf("FAIL %s\n", name)
+		for _, f := range failures {
+			fmt.Printf("    %s\n", f)
+		}
+	}
+
+	// Object stores
+	report("memory store", storeFailures(func() (store.ObjectStore, error) {
+		return store.NewMemoryObjectStore(), nil
+	}))
+	report("local store", storeFailures(func() (store.ObjectStore, error) {
+		root, err := ioutil.TempDir(tmp, "local-")
+		if err != nil {
+			return nil, err
+		}
+		return store.NewLocalObjectStore(store.LocalOpts{Root: root})
+	}))
+	report("router store", storeFailures(func() (store.ObjectStore, error) {
+		root, err := ioutil.TempDir(tmp, "router-")
+		if err != nil {
+			return nil, err
+		}
+		local, err := store.NewLocalObjectStore(store.LocalOpts{Root: root})
+		if err != nil {
+			return nil, err
+		}
+		backends := map[string]store.ObjectStore{"memory": store.NewMemoryObjectStore()}
+		return store.NewRouter(local, backends, []store.Mount{{Prefix: "/tmp/**", Backend: "memory"}})
+	}))
+	report("sync replicator store", storeFailures(func() (store.ObjectStore, error) {
+		return newReplicator(false)
+	}))
+	report("async replicator store", storeFailures(func() (store.ObjectStore, error) {
+		return newReplicator(true)
+	}))
+	report("encrypting store", storeFailures(func() (store.ObjectStore, error) {
+		return newEncryptor(store.NewMemoryObjectStore())
+	}))
+	report("encrypting local store", storeFailures(func() (store.ObjectStore, error) {
+		root, err := ioutil.TempDir(tmp, "encrypt-")
+		if err != nil {
+			return nil, err
+		}
+		local, err := store.NewLocalObjectStore(store.LocalOpts{Root: root})
+		if err != nil {
+			return nil, err
+		}
+		return newEncryptor(local)
+	}))
+	report("caching store", storeFailures(func() (store.ObjectStore, error) {
+		dir, err := ioutil.TempDir(tmp, "cache-")
+		if err != nil {
+			return nil, err
+		}
+		return store.NewCachingStore(store.NewMemoryObjectStore(), store.CacheOpts{Dir: dir, MaxSize: 64 << 20})
+	}))
+	if minioURL != "" {
+		minioStore, err := store.NewMinioObjectStore(store.MinioOpts{
+			URL:    minioURL,
+			Bucket: minioBucket,
+			Region: minioRegion,
+			UseSSL: minioSSL,
+		})
+		report("minio store", storeFailures(func() (store.ObjectStore, error) {
+			return minioStore, err
+		}))
+	}
+
+	// Databases
+	report("memory database", dbFailures(func() (db.Database, error) {
+		return db.NewMemoryDB(), nil
+	}))
+	report("sqlite database", dbFailures(func() (db.Database, error) {
+		f, err := ioutil.TempFile(tmp, "sqlite-")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		return db.NewSQLiteDB(filepath.Clean(f.Name()))
+	}))
+	if postgresURL != "" {
+		gormDB, err := gorm.Open("postgres", postgresURL)
+		report("postgres database", dbFailures(func() (db.Database, error) {
+			if err != nil {
+				return nil, err
+			}
+			return resetPostgres(gormDB)
+		}))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// resetPostgres drops and recreates the blob tables, so that every check
+// starts with an empty Database
+func resetPostgres(gormDB *gorm.DB) (db.Database, error) {
+	if err := gormDB.DropTableIfExists(db.Blob{}, db.Upload{}, db.Chunk{}).Error; err != nil {
+		return nil, err
+	}
+	if err := gormDB.AutoMigrate(db.Blob{}, db.Upload{}, db.Chunk{}).Error; err != nil {
+		return nil, err
+	}
+	return db.NewStandardDB(gormDB), nil
+}
+
+// newReplicator returns a Replicator over two in-memory replicas
+func newReplicator(async bool) (store.ObjectStore, error) {
+	return store.NewReplicator(store.ReplicatorOpts{
+		Replicas: []store.Replica{
+			{Name: "a", Store: store.NewMemoryObjectStore()},
+			{Name: "b", Store: store.NewMemoryObjectStore()},
+		},
+		Async: async,
+		Queue: store.NewMemoryQueue(),
+	})
+}
+
+// newEncryptor returns an EncryptingStore over the given store using a
+// random master key
+func newEncryptor(s store.ObjectStore) (store.ObjectStore, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	keys, err := store.NewKeyring([]store.MasterKey{{ID: "check", Key: key}})
+	if err != nil {
+		return nil, err
+	}
+	return store.NewEncryptingStore(s, keys), nil
+}
+
+func storeFailures(newStore storetest.Factory) []error {
+	var errs []error
+	for _, f := range storetest.Run(newStore) {
+		errs = append(errs, f)
+	}
+	return errs
+}
+
+func dbFailures(newDB dbtest.Factory) []error {
+	var errs []error
+	for _, f := range dbtest.Run(newDB) {
+		errs = append(errs, f)
+	}
+	return errs
+}
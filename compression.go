@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+)
+
+// compressionFor returns the encoding content of the given type is stored
+// with, or an empty string if it is stored as is
+func (svc *blobsService) compressionFor(contentType string) string {
+	if svc.Compression == "" || !svc.CompressTypes.Allows(contentType) {
+		return ""
+	}
+	return svc.Compression
+}
+
+// setEncodingHeaders sets the headers describing how the content of a blob
+// is encoded in a full response, returning true if the object is to be sent
+// compressed as stored. That is the case when the request accepts its
+// encoding. The digest describes the content, so it is dropped when the
+// content is sent encoded, and the entity tag is replaced with one naming
+// the encoding.
+func setEncodingHeaders(header http.Header, req *http.Request, blob *db.Blob) bool {
+	if blob.Encoding == "" {
+		return false
+	}
+	header.Add("Vary", "Accept-Encoding")
+	if !acceptsEncoding(req.Header.Get("Accept-Encoding"), blob.Encoding) {
+		return false
+	}
+	header.Set("Content-Encoding", blob.Encoding)
+	header.Set("ETag", encodedETag(blob))
+	header.Del("Digest")
+	return true
+}
+
+// contentLength returns the length of a full response with the content of a
+// blob, sent either encoded as stored or decoded
+func contentLength(blob *db.Blob, encoded bool) int64 {
+	if encoded {
+		return blob.StoredSize
+	}
+	return blob.Size
+}
+
+// acceptsEncoding returns true if an Accept-Encoding header accepts the
+// given encoding, either by name or with a wildcard, with a non-zero
+// quality value
+func acceptsEncoding(accept, encoding string) bool {
+	accepted := false
+	for _, item := range strings.Split(accept, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		// An explicit entry for the encoding overrides the wildcard
+		if name == encoding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// readContent returns the content of a blob, decompressing its object
+// unless encoded is set, or reassembling it from its chunks
+func (svc *blobsService) readContent(ctx context.Context, blob *db.Blob, encoded bool) (io.ReadCloser, error) {
+	if blob.Chunked {
+		return svc.readChunks(ctx, blob, 0, blob.Size)
+	}
+	obj, err := svc.Store.Get(ctx, objectKey(blob), store.GetOptions{})
+	if err != nil || blob.Encoding == "" || encoded {
+		return obj, err
+	}
+	return store.Decompress(obj, blob.Encoding)
+}
+
+// readEncodedRange returns a range of the content of a compressed blob.
+// Compressed objects can not be read from an offset, so the content is
+// decompressed from its start and the bytes before the range discarded.
+func (svc *blobsService) readEncodedRange(ctx context.Context, blob *db.Blob, r byteRange) (io.ReadCloser, error) {
+	content, err := svc.readContent(ctx, blob, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, content, r.Start); err != nil {
+		content.Close()
+		return nil, err
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(content, r.Length()), Closer: content}, nil
+}
+
+// limitedReadCloser reads part of a stream and closes the whole
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
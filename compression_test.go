@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/myzie/blobs/db"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		accept   string
+		encoding string
+		want     bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"gzip, deflate, br", "zstd", false},
+		{"deflate, GZIP;q=0.5", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"*", "zstd", true},
+		{"*;q=0", "zstd", false},
+		{"*, zstd;q=0", "zstd", false},
+		{"zstd;q=1, *;q=0", "zstd", true},
+		{"gzip;q=x", "gzip", false},
+	}
+	for _, test := range tests {
+		if got := acceptsEncoding(test.accept, test.encoding); got != test.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, want %v", test.accept, test.encoding, got, test.want)
+		}
+	}
+}
+
+func TestSetEncodingHeaders(t *testing.T) {
+	blob := &db.Blob{ID: "id", Version: 3, Encoding: "gzip", SHA256: "00"}
+
+	header := http.Header{}
+	setBlobHeaders(header, blob)
+	req := httptest.NewRequest("GET", "/blobs/a.txt", nil)
+	if setEncodingHeaders(header, req, blob) {
+		t.Error("Expected content to be decoded for a client not accepting gzip")
+	}
+	identityTag := header.Get("ETag")
+
+	header = http.Header{}
+	setBlobHeaders(header, blob)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if !setEncodingHeaders(header, req, blob) {
+		t.Fatal("Expected content to be sent encoded to a client accepting gzip")
+	}
+	if header.Get("Content-Encoding") != "gzip" || header.Get("Digest") != "" {
+		t.Errorf("Unexpected encoded headers: %v", header)
+	}
+	encodedTag := header.Get("ETag")
+	if encodedTag == identityTag {
+		t.Errorf("Encoded and decoded content share the ETag %s", encodedTag)
+	}
+
+	// Either tag shows the blob is unchanged
+	for _, tag := range []string{identityTag, encodedTag} {
+		if !(preconditions{IfNoneMatch: tag}).notModified(blob) {
+			t.Errorf("Expected If-None-Match %s to match", tag)
+		}
+	}
+	blob.Version++
+	if (preconditions{IfNoneMatch: encodedTag}).notModified(blob) {
+		t.Error("Expected If-None-Match to fail once the blob changed")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/myzie/blobs/db"
+)
+
+// etag returns the entity tag of a blob. It changes whenever the blob content
+// or properties change since every update increments the blob version.
+func etag(blob *db.Blob) string {
+	return fmt.Sprintf(`"%s-%d"`, blob.ID, blob.Version)
+}
+
+// encodedETag returns the entity tag of the content of a blob when it is
+// sent compressed as stored, which must differ from that of the content
+func encodedETag(blob *db.Blob) string {
+	return fmt.Sprintf(`"%s-%d-%s"`, blob.ID, blob.Version, blob.Encoding)
+}
+
+// lastModified returns the blob modification time at the one second
+// resolution of HTTP dates
+func lastModified(blob *db.Blob) time.Time {
+	return blob.UpdatedAt.UTC().Truncate(time.Second)
+}
+
+// preconditions holds the conditional headers of a request. See RFC 7232.
+type preconditions struct {
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   time.Time
+	IfUnmodifiedSince time.Time
+}
+
+func newPreconditions(header http.Header) preconditions {
+	p := preconditions{
+		IfMatch:     header.Get("If-Match"),
+		IfNoneMatch: header.Get("If-None-Match"),
+	}
+	// Invalid dates are ignored, as the RFC requires
+	if t, err := http.ParseTime(header.Get("If-Modified-Since")); err == nil {
+		p.IfModifiedSince = t
+	}
+	if t, err := http.ParseTime(header.Get("If-Unmodified-Since")); err == nil {
+		p.IfUnmodifiedSince = t
+	}
+	return p
+}
+
+// allowWrite returns false if the preconditions forbid modifying the blob,
+// in which case the request should fail with 412 Precondition Failed. The
+// blob is nil if it does not exist yet.
+func (p preconditions) allowWrite(blob *db.Blob) bool {
+	if p.IfMatch != "" {
+		if blob == nil || !matchBlob(p.IfMatch, blob, false) {
+			return false
+		}
+	} else if !p.IfUnmodifiedSince.IsZero() {
+		if blob == nil || lastModified(blob).After(p.IfUnmodifiedSince) {
+			return false
+		}
+	}
+	if p.IfNoneMatch != "" && blob != nil && matchBlob(p.IfNoneMatch, blob, true) {
+		return false
+	}
+	return true
+}
+
+// notModified returns true if a read of the blob should be answered with
+// 304 Not Modified
+func (p preconditions) notModified(blob *db.Blob) bool {
+	if p.IfNoneMatch != "" {
+		return matchBlob(p.IfNoneMatch, blob, true)
+	}
+	if !p.IfModifiedSince.IsZero() {
+		return !lastModified(blob).After(p.IfModifiedSince)
+	}
+	return false
+}
+
+// matchBlob returns true if the list of entity tags in a conditional header
+// matches the blob, whether its content was sent encoded or not
+func matchBlob(list string, blob *db.Blob, weak bool) bool {
+	if matchETag(list, etag(blob), weak) {
+		return true
+	}
+	return blob.Encoding != "" && matchETag(list, encodedETag(blob), weak)
+}
+
+// matchETag returns true if the list of entity tags in a conditional header
+// contains tag or is "*". Weak comparison ignores the W/ prefix.
+func matchETag(list, tag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
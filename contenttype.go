@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/myzie/blobs/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultContentType is used when nothing more specific is known
+const defaultContentType = "application/octet-stream"
+
+// sniffLen is the number of leading bytes used to detect content types
+const sniffLen = 512
+
+// maxContentTypeLen matches the size of the content type database column
+const maxContentTypeLen = 100
+
+// validContentType returns true if the value is a well formed media type
+func validContentType(value string) bool {
+	if len(value) > maxContentTypeLen {
+		return false
+	}
+	_, _, err := mime.ParseMediaType(value)
+	return err == nil
+}
+
+// declaredContentType picks the type declared by an explicit attribute over
+// the one in the header of the uploaded part, ignoring invalid values
+func declaredContentType(attribute, partHeader string) string {
+	if attribute != "" {
+		return attribute
+	}
+	if validContentType(partHeader) {
+		return partHeader
+	}
+	return ""
+}
+
+// blobContentType returns the content type a blob is served with. Blobs
+// stored before content types were recorded are served as binary data.
+func blobContentType(blob *db.Blob) string {
+	if blob.ContentType == "" {
+		return defaultContentType
+	}
+	return blob.ContentType
+}
+
+// contentDisposition returns a Content-Disposition header value for a blob,
+// naming the file after the last element of its path
+func contentDisposition(blob *db.Blob, inline bool) string {
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{
+		"filename": path.Base(blob.Path),
+	})
+}
+
+// sniffUpload determines the content type of an upload, reading its first
+// bytes. The upload reader is replaced so that those bytes are not lost.
+func sniffUpload(up *upload) (string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(up.Reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+	up.Reader = io.MultiReader(bytes.NewReader(head), up.Reader)
+	return resolveContentType(up.ContentType, sniffContentType(head)), nil
+}
+
+// resolveContentType decides the content type of an upload from the type
+// declared by the client and the type sniffed from its first bytes. The
+// declared type wins unless the sniffer positively identifies the content
+// as something else, e.g. HTML or an image format, since the sniffer can
+// not tell apart the many text formats it reports as plain text.
+func resolveContentType(declared, sniffed string) string {
+
+	declaredType, _, err := mime.ParseMediaType(declared)
+	if err != nil || declaredType == defaultContentType {
+		return sniffed
+	}
+	sniffedType, _, err := mime.ParseMediaType(sniffed)
+	if err != nil {
+		return declared
+	}
+	switch sniffedType {
+	case defaultContentType, "text/plain", "text/xml":
+		return declared
+	}
+	if sniffedType != declaredType {
+		log.WithFields(log.Fields{
+			"declared": declared,
+			"sniffed":  sniffed,
+		}).Warn("Declared content type does not match content")
+		return sniffed
+	}
+	return declared
+}
+
+// sniffContentType detects the content type of the leading bytes of content
+func sniffContentType(head []byte) string {
+	return http.DetectContentType(head)
+}
+
+// typeList is an allowlist of content types, such as those that may be
+// displayed inline by browsers. Entries are media types such as
+// "application/pdf" or wildcards such as "image/*".
+type typeList []string
+
+// parseTypeList parses a comma separated allowlist
+func parseTypeList(list string) typeList {
+	var types typeList
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// Allows returns true if the allowlist includes the given content type
+func (types typeList) Allows(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
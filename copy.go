@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/myzie/base"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// Copy creates a blob at a new path sharing the content of an existing
+// blob. No content is copied; both blobs refer to the same object until
+// either is overwritten, and the object is removed along with the last
+// blob referring to it.
+func (svc *blobsService) Copy(c echo.Context) error {
+
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(*base.JWTClaims)
+	userID := claims.Subject
+
+	// Require application/json
+	contentType := c.Request().Header.Get("Content-Type")
+	if !isJSON(contentType) {
+		return c.JSON(BadRequest, errorView{"Only JSON is accepted"})
+	}
+
+	var attrs BlobCopyAttributes
+	if err := c.Bind(&attrs); err != nil {
+		return c.JSON(BadRequest, errorView{"Failed to bind attributes"})
+	}
+	attrs.Normalize()
+	if attrs.From == attrs.To {
+		return c.JSON(BadRequest, errorView{"Source and destination are the same"})
+	}
+
+	src, err := svc.Database.Get(attrs.From)
+	if err != nil {
+		return databaseError(c, err, "Failed to look up Blob")
+	}
+	if !src.Committed() {
+		return c.JSON(Conflict, errorView{"Blob upload incomplete"})
+	}
+
+	// Record the key of the source so that references to it can be counted
+	if src.ObjectKey == "" {
+		src.ObjectKey = src.Key()
+		if err := svc.Database.Update(src, []string{"object_key"}); err != nil {
+			return databaseError(c, err, "Failed to update blob")
+		}
+	}
+
+	blob := &db.Blob{
+		ID:          uid(),
+		CreatedBy:   userID,
+		UpdatedBy:   userID,
+		Path:        attrs.To,
+		Size:        src.Size,
+		Properties:  src.Properties,
+		SHA256:      src.SHA256,
+		ContentType: src.ContentType,
+		Encoding:    src.Encoding,
+		StoredSize:  src.StoredSize,
+		Chunked:     src.Chunked,
+		State:       db.StateCommitted,
+		Revision:    src.Revision,
+		ObjectKey:   src.ObjectKey,
+		Backend:     src.Backend,
+	}
+	if err := svc.Database.Save(blob); err != nil {
+		return databaseError(c, err, "Failed to save blob")
+	}
+
+	// The source may have been overwritten or deleted while the copy was
+	// saved, in which case the shared object may already be gone. Once the
+	// copy is saved it is counted as a reference, so checking the source
+	// afterwards closes the window.
+	current, err := svc.Database.Get(attrs.From)
+	if err != nil || current.ID != src.ID || current.ObjectKey != src.ObjectKey || current.Backend != src.Backend {
+		if delErr := svc.Database.Delete(blob); delErr != nil {
+			log.WithError(delErr).WithField("id", blob.ID).Error("Failed to delete copy")
+		}
+		if err != nil && err != db.ErrNotFound {
+			return databaseError(c, err, "Failed to look up Blob")
+		}
+		return c.JSON(Conflict, errorView{"Blob changed during copy"})
+	}
+
+	log.WithFields(log.Fields{
+		"id":         blob.ID,
+		"source":     src.ID,
+		"key":        objectKey(blob),
+		"created_by": blob.CreatedBy,
+		"path":       blob.Path,
+	}).Info("Blob copied")
+
+	c.Response().Header().Set("ETag", etag(blob))
+	return c.JSON(Created, newBlobView(blob))
+}
+
+// releaseObject removes an object that a blob no longer refers to, unless
+// other blobs still do. The object is given by its key within the backend
+// holding it. Callers must have already switched the blob away
+// from the object in the database so that concurrent releases of the same
+// object can not each see the other as a remaining reference. Since the
+// switch has been made, removal goes ahead even if the request that led to
+// it was cancelled. The object of a chunked blob is its manifest, whose
+// references to its chunks are released along with it.
+func (svc *blobsService) releaseObject(backend, key string, chunked bool) {
+
+	// Blobs moved between tiers leave copies of the blob behind, so the
+	// same key may be held by several backends
+	refs, err := svc.Database.List(db.Query{
+		OrderBy:   "id",
+		ObjectKey: key,
+	})
+	key = store.BackendKey(backend, key)
+	if err != nil {
+		log.WithError(err).WithField("key", key).Error("Failed to count object references")
+		return
+	}
+	for _, ref := range refs {
+		if ref.Backend == backend {
+			log.WithField("key", key).Info("Object still referenced; keeping it")
+			return
+		}
+	}
+	if chunked {
+		manifest, err := readManifest(context.Background(), svc.Store, key)
+		if err != nil && err != store.ErrNotFound {
+			log.WithError(err).WithField("key", key).Error("Failed to read chunk manifest")
+			return
+		}
+		svc.releaseChunks(manifest)
+	}
+	if err := svc.Store.Remove(context.Background(), key); err != nil {
+		log.WithError(err).WithField("key", key).Error("Failed to delete object")
+	}
+}
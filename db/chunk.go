@@ -0,0 +1,27 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCollecting is returned when a reference is taken to a Chunk that is
+// being garbage collected. The Chunk may be recorded again once collection
+// completes.
+var ErrCollecting = errors.New("Chunk being collected")
+
+// Chunk is a piece of content stored once and shared by the manifests of
+// chunked Blobs. Chunks are reference counted; once no manifest refers to
+// a Chunk it is garbage collected.
+type Chunk struct {
+	// ObjectKey is the storage key of the Chunk, including its backend
+	ObjectKey string `gorm:"size:250;primary_key"`
+	Size      int64
+
+	// Refs counts the references to the Chunk. It is -1 while the Chunk is
+	// being collected.
+	Refs int64 `gorm:"not null;default:0;index"`
+
+	// UpdatedAt is when a reference was last taken or released
+	UpdatedAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// chunkTable implements the Chunk methods of a Database on top of gorm.
+// Chunks have the same representation in Postgres and SQLite.
+type chunkTable struct {
+	gormDB *gorm.DB
+}
+
+// AcquireChunk takes a reference to a Chunk, recording it if it is new
+func (t *chunkTable) AcquireChunk(chunk *Chunk) (bool, error) {
+
+	// A concurrent acquire may record the Chunk between the attempt to take
+	// a reference and the attempt to create it, in which case the reference
+	// is taken on the next pass
+	for attempt := 0; attempt < 3; attempt++ {
+		result := t.gormDB.Model(&Chunk{}).
+			Where("object_key = ? AND refs >= 0", chunk.ObjectKey).
+			UpdateColumns(map[string]interface{}{
+				"refs":       gorm.Expr("refs + 1"),
+				"updated_at": time.Now(),
+			})
+		if result.Error != nil {
+			return false, translateError(result.Error)
+		}
+		if result.RowsAffected > 0 {
+			return false, nil
+		}
+
+		created := *chunk
+		created.Refs = 1
+		created.UpdatedAt = time.Now()
+		err := translateError(t.gormDB.Create(&created).Error)
+		if err == nil {
+			return true, nil
+		}
+		if err != ErrConflict {
+			return false, err
+		}
+
+		existing := &Chunk{}
+		err = t.gormDB.Where("object_key = ?", chunk.ObjectKey).First(existing).Error
+		if err == nil && existing.Refs < 0 {
+			return false, ErrCollecting
+		}
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return false, translateError(err)
+		}
+	}
+	return false, ErrCollecting
+}
+
+// ReleaseChunk releases a reference to the Chunk with the given key
+func (t *chunkTable) ReleaseChunk(key string) error {
+	result := t.gormDB.Model(&Chunk{}).
+		Where("object_key = ? AND refs > 0", key).
+		UpdateColumns(map[string]interface{}{
+			"refs":       gorm.Expr("refs - 1"),
+			"updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CollectChunks claims unreferenced Chunks for garbage collection
+func (t *chunkTable) CollectChunks(cutoff time.Time, limit int) ([]*Chunk, error) {
+
+	unreferenced := t.gormDB.Model(&Chunk{}).
+		Select("object_key").
+		Where("refs = 0 AND updated_at < ?", cutoff).
+		Limit(limit).
+		QueryExpr()
+	err := t.gormDB.Model(&Chunk{}).
+		Where("refs = 0 AND object_key IN (?)", unreferenced).
+		UpdateColumn("refs", -1).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	var chunks []*Chunk
+	err = t.gormDB.Where("refs < 0").Order("object_key").Limit(limit).Find(&chunks).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return chunks, nil
+}
+
+// DeleteChunk deletes a Chunk claimed for garbage collection
+func (t *chunkTable) DeleteChunk(key string) error {
+	result := t.gormDB.Where("object_key = ? AND refs < 0", key).Delete(&Chunk{})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -1,15 +1,34 @@
 package db
 
+import "time"
+
 //go:generate mockgen -source=db.go -package db -destination mock.go
 
 // Query used to list Blobs
 type Query struct {
 	Offset  int
-	Limit   int
+	Limit   int // Zero lists every match
 	OrderBy string
+
+	// Pending restricts results to Blobs with an upload in progress
+	Pending bool
+
+	// ObjectKey restricts results to Blobs whose content is stored under
+	// the given key, which copies of a Blob share
+	ObjectKey string
+
+	// UpdatedBefore restricts results to records last updated before the
+	// given time, if set. Unlike the other filters it applies to Uploads.
+	UpdatedBefore time.Time
 }
 
-// Database holding Blob metadata
+// Database holding Blob metadata. Implementations return ErrNotFound when
+// a Blob does not exist, ErrConflict when a write would duplicate a path and
+// a *ValidationError when a Blob fails validation.
+//
+// Blob versions provide optimistic concurrency. Update and Delete only
+// succeed if the stored Blob has the same Version as the one given, and
+// return ErrModified otherwise. Save and Update increment the Version.
 type Database interface {
 
 	// Get a Blob with the given path
@@ -21,9 +40,62 @@ type Database interface {
 	// Update the specified Blob fields
 	Update(*Blob, []string) error
 
+	// Relocate records that the committed Blob content has moved to the
+	// object with the given key in the given backend, and clears Restoring.
+	// It fails with ErrModified unless the content is still where the Blob
+	// says it is. Neither the Version nor UpdatedAt changes, since the
+	// content itself is unchanged.
+	Relocate(blob *Blob, backend, objectKey string) error
+
+	// Touch updates the specified fields recording how a Blob is used, such
+	// as when it was last read. Neither its Version nor UpdatedAt changes,
+	// so it never conflicts with other writes.
+	Touch(*Blob, []string) error
+
 	// List Blobs matching the query
 	List(Query) ([]*Blob, error)
 
 	// Delete the Blob from the Database
 	Delete(*Blob) error
+
+	// Move the Blob at path from, and every Blob beneath it, to the same
+	// relative path beneath to. Either all Blobs are moved or none are. It
+	// returns the moved Blobs, or ErrBusy if any has an upload in progress.
+	Move(from, to string) ([]*Blob, error)
+
+	// GetUpload returns the Upload with the given ID
+	GetUpload(id string) (*Upload, error)
+
+	// SaveUpload saves the Upload to the Database which updates all its
+	// fields
+	SaveUpload(*Upload) error
+
+	// UpdateUpload updates the specified Upload fields
+	UpdateUpload(*Upload, []string) error
+
+	// ListUploads lists Uploads matching the query
+	ListUploads(Query) ([]*Upload, error)
+
+	// DeleteUpload deletes the Upload from the Database
+	DeleteUpload(*Upload) error
+
+	// AcquireChunk takes a reference to a Chunk, recording it with a single
+	// reference if it is new. It returns true if the Chunk is new, in which
+	// case its content is to be stored, and ErrCollecting if the Chunk is
+	// being garbage collected.
+	AcquireChunk(*Chunk) (bool, error)
+
+	// ReleaseChunk releases a reference to the Chunk with the given key,
+	// returning ErrNotFound if it has no references
+	ReleaseChunk(key string) error
+
+	// CollectChunks claims up to limit Chunks that have had no references
+	// since before cutoff for garbage collection, and returns them along
+	// with Chunks claimed earlier whose collection did not complete. Claimed
+	// Chunks can not be acquired.
+	CollectChunks(cutoff time.Time, limit int) ([]*Chunk, error)
+
+	// DeleteChunk deletes a Chunk claimed for garbage collection once its
+	// content has been removed
+	DeleteChunk(key string) error
 }
@@ -0,0 +1,38 @@
+package db_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/db/dbtest"
+)
+
+func TestMemoryDB(t *testing.T) {
+	for _, f := range dbtest.Run(func() (db.Database, error) {
+		return db.NewMemoryDB(), nil
+	}) {
+		t.Error(f)
+	}
+}
+
+func TestSQLiteDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs-sqlite-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range dbtest.Run(func() (db.Database, error) {
+		f, err := ioutil.TempFile(dir, "")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		return db.NewSQLiteDB(filepath.Clean(f.Name()))
+	}) {
+		t.Error(f)
+	}
+}
@@ -0,0 +1,971 @@
+// Package dbtest checks that a db.Database behaves as the rest of the
+// service expects. Every in-tree Database is checked by cmd/blobscheck, and
+// new implementations can be checked the same way, or from their own tests
+// with:
+//
+//	for _, f := range dbtest.Run(newDB) {
+//		t.Error(f)
+//	}
+package dbtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/myzie/blobs/db"
+)
+
+// Factory returns an empty Database for a check
+type Factory func() (db.Database, error)
+
+// Case is a single conformance check
+type Case struct {
+	Name string
+	Run  func(d db.Database) error
+}
+
+// Failure reports a check that did not pass
+type Failure struct {
+	Case string
+	Err  error
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("%s: %s", f.Case, f.Err)
+}
+
+// Cases lists every check in the suite
+var Cases = []Case{
+	{"NotFound", testNotFound},
+	{"SaveGet", testSaveGet},
+	{"Overwrite", testOverwrite},
+	{"Conflict", testConflict},
+	{"Validation", testValidation},
+	{"Versioning", testVersioning},
+	{"UpdateFields", testUpdateFields},
+	{"RelocateTouch", testRelocateTouch},
+	{"ListOrder", testListOrder},
+	{"ListPagination", testListPagination},
+	{"ListFilters", testListFilters},
+	{"Move", testMove},
+	{"Uploads", testUploads},
+	{"Chunks", testChunks},
+	{"ConcurrentUpdates", testConcurrentUpdates},
+	{"ConcurrentSaves", testConcurrentSaves},
+}
+
+// Run runs every check, each against a new Database from the factory, and
+// returns the failures, if any
+func Run(newDB Factory) []*Failure {
+	var failures []*Failure
+	for _, c := range Cases {
+		d, err := newDB()
+		if err != nil {
+			err = fmt.Errorf("Failed to create database: %s", err)
+		} else {
+			err = c.Run(d)
+		}
+		if err != nil {
+			failures = append(failures, &Failure{Case: c.Name, Err: err})
+		}
+	}
+	return failures
+}
+
+func testNotFound(d db.Database) error {
+	blob := newBlob("/missing")
+	if _, err := d.Get(blob.Path); err != db.ErrNotFound {
+		return fmt.Errorf("Get returned %v, expected ErrNotFound", err)
+	}
+	if err := d.Update(blob, []string{"size"}); err != db.ErrNotFound {
+		return fmt.Errorf("Update returned %v, expected ErrNotFound", err)
+	}
+	if err := d.Delete(blob); err != db.ErrNotFound {
+		return fmt.Errorf("Delete returned %v, expected ErrNotFound", err)
+	}
+	if _, err := d.Move("/missing", "/elsewhere"); err != db.ErrNotFound {
+		return fmt.Errorf("Move returned %v, expected ErrNotFound", err)
+	}
+
+	upload := newUpload("/missing")
+	if _, err := d.GetUpload(upload.ID); err != db.ErrNotFound {
+		return fmt.Errorf("GetUpload returned %v, expected ErrNotFound", err)
+	}
+	if err := d.UpdateUpload(upload, []string{"offset"}); err != db.ErrNotFound {
+		return fmt.Errorf("UpdateUpload returned %v, expected ErrNotFound", err)
+	}
+	if err := d.DeleteUpload(upload); err != db.ErrNotFound {
+		return fmt.Errorf("DeleteUpload returned %v, expected ErrNotFound", err)
+	}
+	return nil
+}
+
+func testSaveGet(d db.Database) error {
+	blob := newBlob("/dir/file.txt")
+	blob.Size = 5 << 30 // Beyond 32 bits
+	blob.SHA256 = strings.Repeat("ab", 32)
+	blob.ContentType = "text/plain"
+	blob.PendingRevision = randomID()
+	blob.ObjectKey = blob.ID + "/object.txt"
+	blob.Backend = "cold"
+	blob.PendingBackend = "scratch"
+	blob.Encoding = "zstd"
+	blob.StoredSize = 1 << 30
+	blob.Chunked = true
+
+	before := time.Now().Add(-time.Second)
+	if err := d.Save(blob); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+	if blob.Version != 1 {
+		return fmt.Errorf("Save set version %d, expected 1", blob.Version)
+	}
+	if blob.CreatedAt.Before(before) || blob.UpdatedAt.Before(before) {
+		return fmt.Errorf("Save did not set timestamps")
+	}
+
+	got, err := d.Get(blob.Path)
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	if err := compareBlobs(got, blob); err != nil {
+		return err
+	}
+
+	// Changes to a returned Blob are not stored until saved
+	got.Size = 1
+	got, err = d.Get(blob.Path)
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	if got.Size != blob.Size {
+		return fmt.Errorf("Changing a returned Blob changed the stored Blob")
+	}
+	return nil
+}
+
+func testOverwrite(d db.Database) error {
+	blob := newBlob("/before")
+	if err := d.Save(blob); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+
+	// Saving again replaces every field, including the path
+	blob.Path = "/after"
+	blob.Size = 42
+	blob.Properties = postgres.Jsonb{RawMessage: json.RawMessage(`{"replaced":true}`)}
+	if err := d.Save(blob); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+	if blob.Version != 2 {
+		return fmt.Errorf("Save set version %d, expected 2", blob.Version)
+	}
+	if _, err := d.Get("/before"); err != db.ErrNotFound {
+		return fmt.Errorf("Get of the old path returned %v, expected ErrNotFound", err)
+	}
+	got, err := d.Get("/after")
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	return compareBlobs(got, blob)
+}
+
+func testConflict(d db.Database) error {
+	first := newBlob("/taken")
+	if err := d.Save(first); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+	if err := d.Save(newBlob("/taken")); err != db.ErrConflict {
+		return fmt.Errorf("Save to a taken path returned %v, expected ErrConflict", err)
+	}
+
+	second := newBlob("/free")
+	if err := d.Save(second); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+	second.Path = "/taken"
+	if err := d.Update(second, []string{"path"}); err != db.ErrConflict {
+		return fmt.Errorf("Update to a taken path returned %v, expected ErrConflict", err)
+	}
+
+	for path, id := range map[string]string{"/taken": first.ID, "/free": second.ID} {
+		got, err := d.Get(path)
+		if err != nil {
+			return fmt.Errorf("Get failed: %s", err)
+		}
+		if got.ID != id {
+			return fmt.Errorf("A failed write changed the Blob at '%s'", path)
+		}
+	}
+	return nil
+}
+
+func testValidation(d db.Database) error {
+	invalid := []*db.Blob{
+		newBlob(""),
+		newBlob("relative"),
+		newBlob("/" + strings.Repeat("x", 250)),
+	}
+	large := newBlob("/large")
+	large.Properties = postgres.Jsonb{RawMessage: json.RawMessage(
+		`{"x":"` + strings.Repeat("x", db.MaxPropertiesSize) + `"}`)}
+	invalid = append(invalid, large)
+
+	for _, blob := range invalid {
+		if _, ok := d.Save(blob).(*db.ValidationError); !ok {
+			return fmt.Errorf("Save of an invalid Blob did not return a ValidationError")
+		}
+	}
+
+	valid := newBlob("/valid")
+	if err := d.Save(valid); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+	valid.Path = "relative"
+	if _, ok := d.Update(valid, []string{"path"}).(*db.ValidationError); !ok {
+		return fmt.Errorf("Update of an invalid Blob did not return a ValidationError")
+	}
+
+	upload := newUpload("relative")
+	if _, ok := d.SaveUpload(upload).(*db.ValidationError); !ok {
+		return fmt.Errorf("SaveUpload of an invalid Upload did not return a ValidationError")
+	}
+	return nil
+}
+
+func testVersioning(d db.Database) error {
+	blob := newBlob("/versioned")
+	if err := d.Save(blob); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+	stale := *blob
+
+	blob.Size = 2
+	if err := d.Update(blob, []string{"size"}); err != nil {
+		return fmt.Errorf("Update failed: %s", err)
+	}
+	if blob.Version != 2 {
+		return fmt.Errorf("Update set version %d, expected 2", blob.Version)
+	}
+
+	stale.Size = 3
+	if err := d.Update(&stale, []string{"size"}); err != db.ErrModified {
+		return fmt.Errorf("Update of a stale Blob returned %v, expected ErrModified", err)
+	}
+	if err := d.Delete(&stale); err != db.ErrModified {
+		return fmt.Errorf("Delete of a stale Blob returned %v, expected ErrModified", err)
+	}
+	got, err := d.Get(blob.Path)
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	if got.Size != 2 || got.Version != 2 {
+		return fmt.Errorf("A stale write changed the Blob")
+	}
+
+	if err := d.Delete(blob); err != nil {
+		return fmt.Errorf("Delete failed: %s", err)
+	}
+	if _, err := d.Get(blob.Path); err != db.ErrNotFound {
+		return fmt.Errorf("Get after Delete returned %v, expected ErrNotFound", err)
+	}
+	return nil
+}
+
+func testUpdateFields(d db.Database) error {
+	blob := newBlob("/fields")
+	blob.Size = 10
+	blob.ContentType = "text/plain"
+	blob.PendingRevision = randomID()
+	blob.PendingBackend = "cold"
+	if err := d.Save(blob); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+
+	// Only the named fields are written, including those cleared to their
+	// zero value
+	blob.Size = 20
+	blob.ContentType = "application/json"
+	blob.PendingRevision = ""
+	blob.Backend = blob.PendingBackend
+	blob.PendingBackend = ""
+	blob.Encoding = "gzip"
+	blob.StoredSize = 8
+	blob.Chunked = false
+	fields := []string{"size", "pending_revision", "backend", "pending_backend", "encoding", "stored_size", "chunked"}
+	if err := d.Update(blob, fields); err != nil {
+		return fmt.Errorf("Update failed: %s", err)
+	}
+	got, err := d.Get(blob.Path)
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	if got.Size != 20 {
+		return fmt.Errorf("Update left size %d, expected 20", got.Size)
+	}
+	if got.PendingRevision != "" {
+		return fmt.Errorf("Update did not clear the pending revision")
+	}
+	if got.Backend != "cold" || got.PendingBackend != "" {
+		return fmt.Errorf("Update left backends '%s' and '%s', expected 'cold' and ''", got.Backend, got.PendingBackend)
+	}
+	if got.Encoding != "gzip" || got.StoredSize != 8 {
+		return fmt.Errorf("Update left encoding '%s' and stored size %d, expected 'gzip' and 8", got.Encoding, got.StoredSize)
+	}
+	if got.Chunked {
+		return fmt.Errorf("Update did not clear the chunked flag")
+	}
+	if got.ContentType != "text/plain" {
+		return fmt.Errorf("Update wrote content type '%s', which was not named", got.ContentType)
+	}
+	return nil
+}
+
+func testRelocateTouch(d db.Database) error {
+	blob := newBlob("/relocated")
+	if err := d.Save(blob); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+	saved, err := d.Get(blob.Path)
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	stale := *blob
+	time.Sleep(20 * time.Millisecond)
+
+	// Relocate is guarded on the content location, but changes neither the
+	// version nor the modification time
+	blob.Restoring = true
+	if err := d.Relocate(blob, "cold", "relocated"); err != nil {
+		return fmt.Errorf("Relocate failed: %s", err)
+	}
+	if blob.Version != 1 || blob.Backend != "cold" || blob.ObjectKey != "relocated" || blob.Restoring {
+		return fmt.Errorf("Relocate left version %d backend '%s' key '%s'", blob.Version, blob.Backend, blob.ObjectKey)
+	}
+	if err := d.Relocate(&stale, "other", "relocated"); err != db.ErrModified {
+		return fmt.Errorf("Relocate of moved content returned %v, expected ErrModified", err)
+	}
+	missing := newBlob("/never-saved")
+	if err := d.Relocate(missing, "cold", "relocated"); err != db.ErrNotFound {
+		return fmt.Errorf("Relocate of a missing Blob returned %v, expected ErrNotFound", err)
+	}
+
+	// Touch is neither versioned nor changes the modification time
+	accessed := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	stale.LastAccessedAt = accessed
+	stale.Restoring = true
+	if err := d.Touch(&stale, []string{"last_accessed_at", "restoring"}); err != nil {
+		return fmt.Errorf("Touch failed: %s", err)
+	}
+
+	got, err := d.Get(blob.Path)
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	if got.Backend != "cold" || got.ObjectKey != "relocated" || got.Version != 1 {
+		return fmt.Errorf("Relocate left backend '%s' version %d, expected 'cold' version 1", got.Backend, got.Version)
+	}
+	if !got.UpdatedAt.Equal(saved.UpdatedAt) {
+		return fmt.Errorf("Relocate or Touch changed UpdatedAt from %s to %s", saved.UpdatedAt, got.UpdatedAt)
+	}
+	if !got.LastAccessedAt.Equal(accessed) || !got.Restoring {
+		return fmt.Errorf("Touch left last access %s and restoring %t", got.LastAccessedAt, got.Restoring)
+	}
+
+	if err := d.Touch(missing, []string{"restoring"}); err != db.ErrNotFound {
+		return fmt.Errorf("Touch of a missing Blob returned %v, expected ErrNotFound", err)
+	}
+	return nil
+}
+
+func testListOrder(d db.Database) error {
+	blobs, err := saveBlobs(d, 7)
+	if err != nil {
+		return err
+	}
+
+	orders := map[string]func(a, b *db.Blob) bool{
+		"":          func(a, b *db.Blob) bool { return a.ID < b.ID },
+		"id":        func(a, b *db.Blob) bool { return a.ID < b.ID },
+		"path":      func(a, b *db.Blob) bool { return a.Path < b.Path },
+		"path desc": func(a, b *db.Blob) bool { return a.Path > b.Path },
+		"size":      func(a, b *db.Blob) bool { return a.Size < b.Size },
+		"size desc": func(a, b *db.Blob) bool { return a.Size > b.Size },
+	}
+	for orderBy, less := range orders {
+		expected := append([]*db.Blob(nil), blobs...)
+		sort.Slice(expected, func(i, j int) bool { return less(expected[i], expected[j]) })
+
+		got, err := d.List(db.Query{OrderBy: orderBy})
+		if err != nil {
+			return fmt.Errorf("List by '%s' failed: %s", orderBy, err)
+		}
+		if err := compareIDs(got, expected); err != nil {
+			return fmt.Errorf("List by '%s': %s", orderBy, err)
+		}
+	}
+
+	for _, orderBy := range []string{"version", "path sideways", "path; delete from blobs"} {
+		if _, err := d.List(db.Query{OrderBy: orderBy}); err == nil {
+			return fmt.Errorf("List by '%s' succeeded", orderBy)
+		}
+	}
+	return nil
+}
+
+func testListPagination(d db.Database) error {
+	blobs, err := saveBlobs(d, 7)
+	if err != nil {
+		return err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Path < blobs[j].Path })
+
+	for limit := 1; limit <= 8; limit++ {
+		var got []*db.Blob
+		for offset := 0; ; offset += limit {
+			page, err := d.List(db.Query{Offset: offset, Limit: limit, OrderBy: "path"})
+			if err != nil {
+				return fmt.Errorf("List failed: %s", err)
+			}
+			if len(page) > limit {
+				return fmt.Errorf("List with limit %d returned %d Blobs", limit, len(page))
+			}
+			got = append(got, page...)
+			if len(page) < limit {
+				break
+			}
+		}
+		if err := compareIDs(got, blobs); err != nil {
+			return fmt.Errorf("Pages of %d: %s", limit, err)
+		}
+	}
+
+	got, err := d.List(db.Query{Offset: len(blobs), OrderBy: "path"})
+	if err != nil {
+		return fmt.Errorf("List failed: %s", err)
+	}
+	if len(got) != 0 {
+		return fmt.Errorf("List past the end returned %d Blobs", len(got))
+	}
+	return nil
+}
+
+func testListFilters(d db.Database) error {
+	old := newBlob("/old")
+	old.ObjectKey = "shared"
+	if err := d.Save(old); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(20 * time.Millisecond)
+
+	pending := newBlob("/pending")
+	pending.State = db.StatePending
+	pending.Revision = ""
+	pending.PendingRevision = randomID()
+	copied := newBlob("/copied")
+	copied.ObjectKey = "shared"
+	for _, blob := range []*db.Blob{pending, copied} {
+		if err := d.Save(blob); err != nil {
+			return fmt.Errorf("Save failed: %s", err)
+		}
+	}
+
+	queries := []struct {
+		Query    db.Query
+		Expected []*db.Blob
+	}{
+		{db.Query{Pending: true}, []*db.Blob{pending}},
+		{db.Query{ObjectKey: "shared"}, []*db.Blob{old, copied}},
+		{db.Query{UpdatedBefore: cutoff}, []*db.Blob{old}},
+		{db.Query{ObjectKey: "shared", UpdatedBefore: cutoff}, []*db.Blob{old}},
+	}
+	for _, q := range queries {
+		got, err := d.List(q.Query)
+		if err != nil {
+			return fmt.Errorf("List failed: %s", err)
+		}
+		expected := append([]*db.Blob(nil), q.Expected...)
+		sort.Slice(expected, func(i, j int) bool { return expected[i].ID < expected[j].ID })
+		if err := compareIDs(got, expected); err != nil {
+			return fmt.Errorf("List of %+v: %s", q.Query, err)
+		}
+	}
+	return nil
+}
+
+func testMove(d db.Database) error {
+	paths := []string{"/from/a", "/from/b/c", "/from", "/fromage", "/From/upper", "/taken/a"}
+	saved := map[string]*db.Blob{}
+	for _, path := range paths {
+		blob := newBlob(path)
+		if err := d.Save(blob); err != nil {
+			return fmt.Errorf("Save failed: %s", err)
+		}
+		saved[path] = blob
+	}
+
+	if _, ok := moveError(d.Move("/from", "/from/inside")).(*db.ValidationError); !ok {
+		return fmt.Errorf("Move beneath itself did not return a ValidationError")
+	}
+	if err := moveError(d.Move("/from", "/taken")); err != db.ErrConflict {
+		return fmt.Errorf("Move onto a taken path returned %v, expected ErrConflict", err)
+	}
+	if _, err := d.Get("/from/a"); err != nil {
+		return fmt.Errorf("A failed Move changed Blobs")
+	}
+
+	moved, err := d.Move("/from", "/to")
+	if err != nil {
+		return fmt.Errorf("Move failed: %s", err)
+	}
+	expected := map[string]string{"/to": "/from", "/to/a": "/from/a", "/to/b/c": "/from/b/c"}
+	if len(moved) != len(expected) {
+		return fmt.Errorf("Move returned %d Blobs, expected %d", len(moved), len(expected))
+	}
+	for _, blob := range moved {
+		from, ok := expected[blob.Path]
+		if !ok || blob.ID != saved[from].ID {
+			return fmt.Errorf("Move returned an unexpected Blob at '%s'", blob.Path)
+		}
+		got, err := d.Get(blob.Path)
+		if err != nil {
+			return fmt.Errorf("Get of moved Blob failed: %s", err)
+		}
+		if got.ID != blob.ID || got.Version != saved[from].Version+1 {
+			return fmt.Errorf("Moved Blob at '%s' is not as returned", blob.Path)
+		}
+		if _, err := d.Get(from); err != db.ErrNotFound {
+			return fmt.Errorf("Get of a moved Blob's old path returned %v", err)
+		}
+	}
+
+	// Paths that merely share a prefix, or differ in case, stay put
+	for _, path := range []string{"/fromage", "/From/upper"} {
+		if got, err := d.Get(path); err != nil || got.ID != saved[path].ID {
+			return fmt.Errorf("Move changed the Blob at '%s'", path)
+		}
+	}
+
+	busy := saved["/taken/a"]
+	busy.PendingRevision = randomID()
+	if err := d.Update(busy, []string{"pending_revision"}); err != nil {
+		return fmt.Errorf("Update failed: %s", err)
+	}
+	if err := moveError(d.Move("/taken", "/busy")); err != db.ErrBusy {
+		return fmt.Errorf("Move of a Blob with an upload in progress returned %v, expected ErrBusy", err)
+	}
+	return nil
+}
+
+func testChunks(d db.Database) error {
+	chunk := &db.Chunk{ObjectKey: "chunks/" + randomID(), Size: 10}
+
+	// The first reference records the chunk, later ones share it
+	for i, expectNew := range []bool{true, false} {
+		created, err := d.AcquireChunk(chunk)
+		if err != nil {
+			return fmt.Errorf("AcquireChunk failed: %s", err)
+		}
+		if created != expectNew {
+			return fmt.Errorf("AcquireChunk %d reported new %t, expected %t", i+1, created, expectNew)
+		}
+	}
+
+	// Referenced chunks are never collected
+	future := time.Now().Add(time.Hour)
+	if err := d.ReleaseChunk(chunk.ObjectKey); err != nil {
+		return fmt.Errorf("ReleaseChunk failed: %s", err)
+	}
+	chunks, err := d.CollectChunks(future, 10)
+	if err != nil {
+		return fmt.Errorf("CollectChunks failed: %s", err)
+	}
+	if len(chunks) != 0 {
+		return fmt.Errorf("CollectChunks claimed a referenced chunk")
+	}
+
+	// Unreferenced chunks are only collected once released before the cutoff
+	if err := d.ReleaseChunk(chunk.ObjectKey); err != nil {
+		return fmt.Errorf("ReleaseChunk failed: %s", err)
+	}
+	if err := d.ReleaseChunk(chunk.ObjectKey); err != db.ErrNotFound {
+		return fmt.Errorf("ReleaseChunk of an unreferenced chunk returned %v, expected ErrNotFound", err)
+	}
+	if chunks, err = d.CollectChunks(time.Now().Add(-time.Hour), 10); err != nil || len(chunks) != 0 {
+		return fmt.Errorf("CollectChunks claimed %d chunks released after the cutoff (%v)", len(chunks), err)
+	}
+	if chunks, err = d.CollectChunks(future, 10); err != nil {
+		return fmt.Errorf("CollectChunks failed: %s", err)
+	}
+	if len(chunks) != 1 || chunks[0].ObjectKey != chunk.ObjectKey || chunks[0].Size != 10 {
+		return fmt.Errorf("CollectChunks returned %d chunks, expected the released chunk", len(chunks))
+	}
+
+	// Claimed chunks can not be acquired, and are returned until deleted
+	if _, err := d.AcquireChunk(chunk); err != db.ErrCollecting {
+		return fmt.Errorf("AcquireChunk of a claimed chunk returned %v, expected ErrCollecting", err)
+	}
+	if chunks, err = d.CollectChunks(future, 10); err != nil || len(chunks) != 1 {
+		return fmt.Errorf("CollectChunks returned %d chunks, expected the claimed chunk (%v)", len(chunks), err)
+	}
+	if err := d.DeleteChunk(chunk.ObjectKey); err != nil {
+		return fmt.Errorf("DeleteChunk failed: %s", err)
+	}
+	if err := d.DeleteChunk(chunk.ObjectKey); err != db.ErrNotFound {
+		return fmt.Errorf("DeleteChunk of a deleted chunk returned %v, expected ErrNotFound", err)
+	}
+
+	// Once deleted the chunk may be recorded again
+	created, err := d.AcquireChunk(chunk)
+	if err != nil || !created {
+		return fmt.Errorf("AcquireChunk after DeleteChunk returned %t, %v, expected a new chunk", created, err)
+	}
+
+	// Concurrent references are all counted
+	shared := &db.Chunk{ObjectKey: "chunks/" + randomID(), Size: 5}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	news := make(chan bool, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			created, err := d.AcquireChunk(shared)
+			errs <- err
+			news <- created
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(news)
+	for err := range errs {
+		if err != nil {
+			return fmt.Errorf("Concurrent AcquireChunk failed: %s", err)
+		}
+	}
+	count := 0
+	for created := range news {
+		if created {
+			count++
+		}
+	}
+	if count != 1 {
+		return fmt.Errorf("Concurrent AcquireChunk created the chunk %d times, expected once", count)
+	}
+	for i := 0; i < 8; i++ {
+		if err := d.ReleaseChunk(shared.ObjectKey); err != nil {
+			return fmt.Errorf("ReleaseChunk %d failed: %s", i+1, err)
+		}
+	}
+	if err := d.ReleaseChunk(shared.ObjectKey); err != db.ErrNotFound {
+		return fmt.Errorf("ReleaseChunk beyond the references taken returned %v, expected ErrNotFound", err)
+	}
+	return nil
+}
+
+func testUploads(d db.Database) error {
+	upload := newUpload("/upload")
+	if err := d.SaveUpload(upload); err != nil {
+		return fmt.Errorf("SaveUpload failed: %s", err)
+	}
+	if upload.Version != 1 {
+		return fmt.Errorf("SaveUpload set version %d, expected 1", upload.Version)
+	}
+	got, err := d.GetUpload(upload.ID)
+	if err != nil {
+		return fmt.Errorf("GetUpload failed: %s", err)
+	}
+	if got.Path != upload.Path || got.Length != upload.Length || got.CreatedBy != upload.CreatedBy {
+		return fmt.Errorf("GetUpload returned %+v, expected %+v", got, upload)
+	}
+
+	stale := *upload
+	upload.AddPart("p1", 40)
+	upload.Digest = "state"
+	if err := d.UpdateUpload(upload, []string{"offset", "parts", "digest"}); err != nil {
+		return fmt.Errorf("UpdateUpload failed: %s", err)
+	}
+	stale.AddPart("p2", 40)
+	if err := d.UpdateUpload(&stale, []string{"offset", "parts"}); err != db.ErrModified {
+		return fmt.Errorf("UpdateUpload of a stale Upload returned %v, expected ErrModified", err)
+	}
+	got, err = d.GetUpload(upload.ID)
+	if err != nil {
+		return fmt.Errorf("GetUpload failed: %s", err)
+	}
+	if got.Offset != 40 || got.Parts != "p1" || got.Digest != "state" || got.Version != 2 {
+		return fmt.Errorf("GetUpload returned offset %d, parts '%s' and digest '%s' at version %d", got.Offset, got.Parts, got.Digest, got.Version)
+	}
+
+	// Completion is claimed with a versioned update, so only one claim of
+	// the same version succeeds
+	claim := *upload
+	claim.CompletingAt = time.Now()
+	if err := d.UpdateUpload(&claim, []string{"completing_at"}); err != nil {
+		return fmt.Errorf("UpdateUpload failed: %s", err)
+	}
+	rival := *upload
+	rival.CompletingAt = time.Now()
+	if err := d.UpdateUpload(&rival, []string{"completing_at"}); err != db.ErrModified {
+		return fmt.Errorf("UpdateUpload of a claimed Upload returned %v, expected ErrModified", err)
+	}
+	got, err = d.GetUpload(upload.ID)
+	if err != nil {
+		return fmt.Errorf("GetUpload failed: %s", err)
+	}
+	if got.CompletingAt.IsZero() {
+		return fmt.Errorf("GetUpload returned an Upload without its completion claim")
+	}
+	*upload = claim
+
+	time.Sleep(20 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	recent := newUpload("/recent")
+	if err := d.SaveUpload(recent); err != nil {
+		return fmt.Errorf("SaveUpload failed: %s", err)
+	}
+
+	all, err := d.ListUploads(db.Query{})
+	if err != nil {
+		return fmt.Errorf("ListUploads failed: %s", err)
+	}
+	if len(all) != 2 || all[0].ID > all[1].ID {
+		return fmt.Errorf("ListUploads returned %d Uploads, expected 2 ordered by ID", len(all))
+	}
+	expired, err := d.ListUploads(db.Query{UpdatedBefore: cutoff})
+	if err != nil {
+		return fmt.Errorf("ListUploads failed: %s", err)
+	}
+	if len(expired) != 1 || expired[0].ID != upload.ID {
+		return fmt.Errorf("ListUploads before a time returned %d Uploads, expected 1", len(expired))
+	}
+
+	if err := d.DeleteUpload(&stale); err != db.ErrModified {
+		return fmt.Errorf("DeleteUpload of a stale Upload returned %v, expected ErrModified", err)
+	}
+	if err := d.DeleteUpload(upload); err != nil {
+		return fmt.Errorf("DeleteUpload failed: %s", err)
+	}
+	if _, err := d.GetUpload(upload.ID); err != db.ErrNotFound {
+		return fmt.Errorf("GetUpload after DeleteUpload returned %v, expected ErrNotFound", err)
+	}
+	return nil
+}
+
+func testConcurrentUpdates(d db.Database) error {
+	const writers = 8
+
+	blob := newBlob("/contended")
+	if err := d.Save(blob); err != nil {
+		return fmt.Errorf("Save failed: %s", err)
+	}
+
+	// Every writer starts from the same version, so exactly one succeeds
+	results := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mine := *blob
+			mine.Size = int64(i + 100)
+			results <- d.Update(&mine, []string{"size"})
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		switch err {
+		case nil:
+			succeeded++
+		case db.ErrModified:
+		default:
+			return fmt.Errorf("Concurrent Update failed: %s", err)
+		}
+	}
+	if succeeded != 1 {
+		return fmt.Errorf("%d concurrent Updates of one version succeeded, expected 1", succeeded)
+	}
+	got, err := d.Get(blob.Path)
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	if got.Version != 2 {
+		return fmt.Errorf("Blob has version %d after concurrent Updates, expected 2", got.Version)
+	}
+	return nil
+}
+
+func testConcurrentSaves(d db.Database) error {
+	const writers = 8
+
+	// Writers each save a Blob of their own and race to save one path
+	results := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := d.Save(newBlob(fmt.Sprintf("/own/%d", i))); err != nil {
+				results <- fmt.Errorf("Concurrent Save failed: %s", err)
+				return
+			}
+			results <- d.Save(newBlob("/contended"))
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		switch err {
+		case nil:
+			succeeded++
+		case db.ErrConflict:
+		default:
+			return err
+		}
+	}
+	if succeeded != 1 {
+		return fmt.Errorf("%d concurrent Saves to one path succeeded, expected 1", succeeded)
+	}
+	all, err := d.List(db.Query{})
+	if err != nil {
+		return fmt.Errorf("List failed: %s", err)
+	}
+	if len(all) != writers+1 {
+		return fmt.Errorf("List returned %d Blobs, expected %d", len(all), writers+1)
+	}
+	return nil
+}
+
+// saveBlobs saves n Blobs whose paths, sizes and IDs are ordered
+// differently from one another
+func saveBlobs(d db.Database, n int) ([]*db.Blob, error) {
+	var blobs []*db.Blob
+	for i := 0; i < n; i++ {
+		blob := newBlob(fmt.Sprintf("/list/%c", 'a'+(i*3)%n))
+		blob.Size = int64((i * 5) % n)
+		if err := d.Save(blob); err != nil {
+			return nil, fmt.Errorf("Save failed: %s", err)
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
+
+// compareIDs checks that Blobs are those expected, in order
+func compareIDs(got, expected []*db.Blob) error {
+	paths := func(blobs []*db.Blob) string {
+		var s []string
+		for _, blob := range blobs {
+			s = append(s, blob.Path)
+		}
+		return strings.Join(s, ",")
+	}
+	if len(got) != len(expected) {
+		return fmt.Errorf("Got [%s], expected [%s]", paths(got), paths(expected))
+	}
+	for i := range got {
+		if got[i].ID != expected[i].ID {
+			return fmt.Errorf("Got [%s], expected [%s]", paths(got), paths(expected))
+		}
+	}
+	return nil
+}
+
+// compareBlobs checks that a Blob read back holds what was saved
+func compareBlobs(got, expected *db.Blob) error {
+	fields := []struct {
+		Name      string
+		Got, Want interface{}
+	}{
+		{"ID", got.ID, expected.ID},
+		{"Path", got.Path, expected.Path},
+		{"CreatedBy", got.CreatedBy, expected.CreatedBy},
+		{"UpdatedBy", got.UpdatedBy, expected.UpdatedBy},
+		{"Size", got.Size, expected.Size},
+		{"Version", got.Version, expected.Version},
+		{"SHA256", got.SHA256, expected.SHA256},
+		{"ContentType", got.ContentType, expected.ContentType},
+		{"State", got.State, expected.State},
+		{"Revision", got.Revision, expected.Revision},
+		{"PendingRevision", got.PendingRevision, expected.PendingRevision},
+		{"ObjectKey", got.ObjectKey, expected.ObjectKey},
+		{"Backend", got.Backend, expected.Backend},
+		{"PendingBackend", got.PendingBackend, expected.PendingBackend},
+		{"Restoring", got.Restoring, expected.Restoring},
+		{"Encoding", got.Encoding, expected.Encoding},
+		{"StoredSize", got.StoredSize, expected.StoredSize},
+		{"Chunked", got.Chunked, expected.Chunked},
+	}
+	for _, f := range fields {
+		if f.Got != f.Want {
+			return fmt.Errorf("Blob %s is %v, expected %v", f.Name, f.Got, f.Want)
+		}
+	}
+	if d := got.CreatedAt.Sub(expected.CreatedAt); d < -time.Second || d > time.Second {
+		return fmt.Errorf("Blob CreatedAt is %s, expected %s", got.CreatedAt, expected.CreatedAt)
+	}
+
+	// Properties are compared as JSON values since databases may reformat
+	var gotProps, wantProps interface{}
+	if err := json.Unmarshal(got.Properties.RawMessage, &gotProps); err != nil {
+		return fmt.Errorf("Blob properties are invalid: %s", err)
+	}
+	json.Unmarshal(expected.Properties.RawMessage, &wantProps)
+	if !reflect.DeepEqual(gotProps, wantProps) {
+		return fmt.Errorf("Blob properties are %s, expected %s", got.Properties.RawMessage, expected.Properties.RawMessage)
+	}
+	return nil
+}
+
+// mustFail returns the error from a call that is expected to fail
+func moveError(_ []*db.Blob, err error) error {
+	return err
+}
+
+func newBlob(path string) *db.Blob {
+	return &db.Blob{
+		ID:          randomID(),
+		CreatedBy:   "dbtest",
+		UpdatedBy:   "dbtest",
+		Path:        path,
+		Size:        1,
+		Properties:  postgres.Jsonb{RawMessage: json.RawMessage(`{"test":[1,"two"]}`)},
+		State:       db.StateCommitted,
+		Revision:    randomID(),
+		ContentType: "application/octet-stream",
+	}
+}
+
+func newUpload(path string) *db.Upload {
+	return &db.Upload{
+		ID:        randomID(),
+		CreatedBy: "dbtest",
+		Path:      path,
+		Length:    100,
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
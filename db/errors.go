@@ -0,0 +1,69 @@
+package db
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// ErrNotFound is returned when the requested Blob does not exist
+var ErrNotFound = errors.New("Blob not found")
+
+// ErrConflict is returned when a write would give a Blob the same path as
+// another Blob
+var ErrConflict = errors.New("Blob path already exists")
+
+// ErrModified is returned when a Blob being updated or deleted was changed
+// by someone else since it was read
+var ErrModified = errors.New("Blob was modified")
+
+// ErrBusy is returned when a Blob can not be moved because an upload to it
+// is in progress
+var ErrBusy = errors.New("Blob upload in progress")
+
+// ValidationError is returned when a Blob fails validation. It carries
+// every problem reported by Blob.Validate.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validate returns a ValidationError if the Blob is invalid
+func validate(blob *Blob) error {
+	if errs := blob.Validate(); len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// translateError converts driver specific errors into the errors defined by
+// this package. Unrecognized errors are returned unchanged.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	switch e := err.(type) {
+	case *pq.Error:
+		if e.Code == "23505" { // unique_violation
+			return ErrConflict
+		}
+	case sqlite3.Error:
+		if e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return ErrConflict
+		}
+	}
+	return err
+}
@@ -1,16 +1,25 @@
 package db
 
 import (
+	"fmt"
+	"math"
+
 	"github.com/jinzhu/gorm"
 )
 
 type standardDB struct {
+	uploadTable
+	chunkTable
 	gormDB *gorm.DB
 }
 
 // NewStandardDB returns an interface to a Blob Database
 func NewStandardDB(gormDB *gorm.DB) Database {
-	return &standardDB{gormDB: gormDB}
+	return &standardDB{
+		uploadTable: uploadTable{gormDB: gormDB},
+		chunkTable:  chunkTable{gormDB: gormDB},
+		gormDB:      gormDB,
+	}
 }
 
 // Get a Blob with the given path
@@ -18,19 +27,83 @@ func (db *standardDB) Get(path string) (*Blob, error) {
 	blob := &Blob{}
 	err := db.gormDB.Where("path = ?", path).First(blob).Error
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	return blob, nil
 }
 
 // Save the Blob to the Database which updates all its fields
 func (db *standardDB) Save(blob *Blob) error {
-	return db.gormDB.Save(blob).Error
+	if err := validate(blob); err != nil {
+		return err
+	}
+	blob.Version++
+	if err := db.gormDB.Save(blob).Error; err != nil {
+		blob.Version--
+		return translateError(err)
+	}
+	return nil
 }
 
 // Update the specified Blob fields
 func (db *standardDB) Update(blob *Blob, fields []string) error {
-	return db.gormDB.Model(blob).Select(fields).Updates(blob).Error
+	if err := validate(blob); err != nil {
+		return err
+	}
+	expected := blob.Version
+	blob.Version++
+	values, err := updateValues(db.gormDB, blob, append(fields[:len(fields):len(fields)], "version"))
+	if err != nil {
+		blob.Version = expected
+		return err
+	}
+	result := db.gormDB.Model(blob).Where("version = ?", expected).Updates(values)
+	if result.Error != nil {
+		blob.Version = expected
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		blob.Version = expected
+		return db.modified(blob.ID)
+	}
+	return nil
+}
+
+// Relocate records that the committed Blob content has moved
+func (db *standardDB) Relocate(blob *Blob, backend, objectKey string) error {
+	result := db.gormDB.Model(blob).
+		Where("revision = ? AND backend = ? AND object_key = ?", blob.Revision, blob.Backend, blob.ObjectKey).
+		UpdateColumns(map[string]interface{}{
+			"backend":    backend,
+			"object_key": objectKey,
+			"restoring":  false,
+		})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return db.modified(blob.ID)
+	}
+	blob.Backend = backend
+	blob.ObjectKey = objectKey
+	blob.Restoring = false
+	return nil
+}
+
+// Touch writes the specified Blob fields alone
+func (db *standardDB) Touch(blob *Blob, fields []string) error {
+	values, err := updateValues(db.gormDB, blob, fields)
+	if err != nil {
+		return err
+	}
+	result := db.gormDB.Model(blob).UpdateColumns(values)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
 // List Blobs matching the query
@@ -38,19 +111,123 @@ func (db *standardDB) List(q Query) ([]*Blob, error) {
 
 	var blobs []*Blob
 
-	err := db.gormDB.
-		Order(q.OrderBy).
+	order, err := orderClause(q.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+	err = filter(db.gormDB, q).
+		Order(order).
 		Offset(q.Offset).
-		Limit(q.Limit).
+		Limit(limit(q)).
 		Find(&blobs).Error
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	return blobs, nil
 }
 
 // Delete the Blob from the Database
 func (db *standardDB) Delete(blob *Blob) error {
-	return db.gormDB.Delete(blob).Error
+	result := db.gormDB.Where("version = ?", blob.Version).Delete(blob)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return db.modified(blob.ID)
+	}
+	return nil
+}
+
+// Move the Blob at path from, and every Blob beneath it, to the same
+// relative path beneath to
+func (db *standardDB) Move(from, to string) ([]*Blob, error) {
+
+	if err := validateMove(from, to); err != nil {
+		return nil, err
+	}
+
+	tx := db.gormDB.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	var blobs []*Blob
+	err := tx.Where(`path = ? OR path LIKE ? ESCAPE '\'`, from, likeTree(from)).Find(&blobs).Error
+	if err == nil {
+		blobs, err = planMove(blobs, from, to)
+	}
+	for i := 0; err == nil && i < len(blobs); i++ {
+		blob := blobs[i]
+		result := tx.Model(blob).Where("version = ?", blob.Version).
+			Updates(map[string]interface{}{
+				"path":       blob.Path,
+				"object_key": blob.ObjectKey,
+				"version":    blob.Version + 1,
+			})
+		if result.Error != nil {
+			err = translateError(result.Error)
+		} else if result.RowsAffected == 0 {
+			err = ErrModified
+		}
+		blob.Version++
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, translateError(err)
+	}
+	return blobs, nil
+}
+
+// modified explains why a versioned write affected no rows. It returns
+// ErrModified if the Blob exists, which means its version has changed, and
+// ErrNotFound otherwise.
+func (db *standardDB) modified(id string) error {
+	err := db.gormDB.Select("id").Where("id = ?", id).First(&Blob{}).Error
+	if err != nil {
+		return translateError(err)
+	}
+	return ErrModified
+}
+
+// filter applies the conditions of a Query to a gorm search
+func filter(gormDB *gorm.DB, q Query) *gorm.DB {
+	if q.Pending {
+		gormDB = gormDB.Where("pending_revision <> ''")
+	}
+	if q.ObjectKey != "" {
+		gormDB = gormDB.Where("object_key = ?", q.ObjectKey)
+	}
+	if !q.UpdatedBefore.IsZero() {
+		gormDB = gormDB.Where("updated_at < ?", q.UpdatedBefore)
+	}
+	return gormDB
+}
+
+// limit returns the row limit for a Query. A zero limit must list every
+// match, but gorm would pass it on as LIMIT 0, and SQLite does not accept an
+// OFFSET without a LIMIT.
+func limit(q Query) int64 {
+	if q.Limit <= 0 {
+		return math.MaxInt64
+	}
+	return int64(q.Limit)
+}
+
+// updateValues returns the named fields of a model keyed by column name.
+// Passing these to Updates, rather than the model itself, ensures that
+// fields being cleared to their zero value are written too.
+func updateValues(gormDB *gorm.DB, model interface{}, fields []string) (map[string]interface{}, error) {
+	scope := gormDB.NewScope(model)
+	values := make(map[string]interface{}, len(fields))
+	for _, name := range fields {
+		field, ok := scope.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown field: '%s'", name)
+		}
+		values[field.DBName] = field.Field.Interface()
+	}
+	return values, nil
 }
@@ -0,0 +1,536 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryDB struct {
+	mutex   sync.RWMutex
+	blobs   map[string]*Blob
+	paths   map[string]string
+	uploads map[string]*Upload
+	chunks  map[string]*Chunk
+}
+
+// NewMemoryDB returns an interface to a Blob Database held in memory. It is
+// safe for concurrent use and is intended for tests and ephemeral deployments.
+func NewMemoryDB() Database {
+	return &memoryDB{
+		blobs:   map[string]*Blob{},
+		paths:   map[string]string{},
+		uploads: map[string]*Upload{},
+		chunks:  map[string]*Chunk{},
+	}
+}
+
+// Get a Blob with the given path
+func (db *memoryDB) Get(path string) (*Blob, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	id, found := db.paths[path]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return copyBlob(db.blobs[id]), nil
+}
+
+// Save the Blob to the Database which updates all its fields
+func (db *memoryDB) Save(blob *Blob) error {
+	if err := validate(blob); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if id, found := db.paths[blob.Path]; found && id != blob.ID {
+		return ErrConflict
+	}
+	now := time.Now()
+	if blob.CreatedAt.IsZero() {
+		blob.CreatedAt = now
+	}
+	blob.UpdatedAt = now
+	blob.Version++
+	if existing, found := db.blobs[blob.ID]; found {
+		delete(db.paths, existing.Path)
+	}
+	db.blobs[blob.ID] = copyBlob(blob)
+	db.paths[blob.Path] = blob.ID
+	return nil
+}
+
+// Update the specified Blob fields
+func (db *memoryDB) Update(blob *Blob, fields []string) error {
+	if err := validate(blob); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.blobs[blob.ID]
+	if !found {
+		return ErrNotFound
+	}
+	if existing.Version != blob.Version {
+		return ErrModified
+	}
+	updated := copyBlob(existing)
+	for _, field := range fields {
+		if err := setBlobField(updated, blob, field); err != nil {
+			return err
+		}
+	}
+	if id, found := db.paths[updated.Path]; found && id != updated.ID {
+		return ErrConflict
+	}
+	updated.Version++
+	updated.UpdatedAt = time.Now()
+	blob.Version = updated.Version
+	blob.UpdatedAt = updated.UpdatedAt
+	delete(db.paths, existing.Path)
+	db.blobs[updated.ID] = updated
+	db.paths[updated.Path] = updated.ID
+	return nil
+}
+
+// Relocate records that the committed Blob content has moved
+func (db *memoryDB) Relocate(blob *Blob, backend, objectKey string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.blobs[blob.ID]
+	if !found {
+		return ErrNotFound
+	}
+	if existing.Revision != blob.Revision || existing.Backend != blob.Backend || existing.ObjectKey != blob.ObjectKey {
+		return ErrModified
+	}
+	updated := copyBlob(existing)
+	updated.Backend = backend
+	updated.ObjectKey = objectKey
+	updated.Restoring = false
+	db.blobs[updated.ID] = updated
+	blob.Backend = backend
+	blob.ObjectKey = objectKey
+	blob.Restoring = false
+	return nil
+}
+
+// Touch writes the specified Blob fields alone
+func (db *memoryDB) Touch(blob *Blob, fields []string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.blobs[blob.ID]
+	if !found {
+		return ErrNotFound
+	}
+	updated := copyBlob(existing)
+	for _, field := range fields {
+		if err := setBlobField(updated, blob, field); err != nil {
+			return err
+		}
+	}
+	if updated.Path != existing.Path {
+		return fmt.Errorf("Touch can not change the path")
+	}
+	db.blobs[updated.ID] = updated
+	return nil
+}
+
+// List Blobs matching the query
+func (db *memoryDB) List(q Query) ([]*Blob, error) {
+
+	less, err := blobOrder(q.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mutex.RLock()
+	blobs := make([]*Blob, 0, len(db.blobs))
+	for _, blob := range db.blobs {
+		if q.Pending && blob.PendingRevision == "" {
+			continue
+		}
+		if q.ObjectKey != "" && blob.ObjectKey != q.ObjectKey {
+			continue
+		}
+		if !q.UpdatedBefore.IsZero() && !blob.UpdatedAt.Before(q.UpdatedBefore) {
+			continue
+		}
+		blobs = append(blobs, copyBlob(blob))
+	}
+	db.mutex.RUnlock()
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return less(blobs[i], blobs[j])
+	})
+
+	if q.Offset >= len(blobs) {
+		return []*Blob{}, nil
+	}
+	blobs = blobs[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(blobs) {
+		blobs = blobs[:q.Limit]
+	}
+	return blobs, nil
+}
+
+// Delete the Blob from the Database
+func (db *memoryDB) Delete(blob *Blob) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.blobs[blob.ID]
+	if !found {
+		return ErrNotFound
+	}
+	if existing.Version != blob.Version {
+		return ErrModified
+	}
+	delete(db.paths, existing.Path)
+	delete(db.blobs, blob.ID)
+	return nil
+}
+
+// Move the Blob at path from, and every Blob beneath it, to the same
+// relative path beneath to
+func (db *memoryDB) Move(from, to string) ([]*Blob, error) {
+
+	if err := validateMove(from, to); err != nil {
+		return nil, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var found []*Blob
+	for _, blob := range db.blobs {
+		if inTree(blob.Path, from) {
+			found = append(found, copyBlob(blob))
+		}
+	}
+	blobs, err := planMove(found, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Destinations must be free or vacated by the move itself
+	for _, blob := range blobs {
+		if id, found := db.paths[blob.Path]; found && !inTree(db.blobs[id].Path, from) {
+			return nil, ErrConflict
+		}
+	}
+
+	now := time.Now()
+	for _, blob := range blobs {
+		delete(db.paths, db.blobs[blob.ID].Path)
+	}
+	for _, blob := range blobs {
+		blob.Version++
+		blob.UpdatedAt = now
+		db.blobs[blob.ID] = copyBlob(blob)
+		db.paths[blob.Path] = blob.ID
+	}
+	return blobs, nil
+}
+
+// GetUpload returns the Upload with the given ID
+func (db *memoryDB) GetUpload(id string) (*Upload, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	upload, found := db.uploads[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	c := *upload
+	return &c, nil
+}
+
+// SaveUpload saves the Upload to the Database which updates all its fields
+func (db *memoryDB) SaveUpload(upload *Upload) error {
+	if err := validateUpload(upload); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	now := time.Now()
+	if upload.CreatedAt.IsZero() {
+		upload.CreatedAt = now
+	}
+	upload.UpdatedAt = now
+	upload.Version++
+	c := *upload
+	db.uploads[upload.ID] = &c
+	return nil
+}
+
+// UpdateUpload updates the specified Upload fields
+func (db *memoryDB) UpdateUpload(upload *Upload, fields []string) error {
+	if err := validateUpload(upload); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.uploads[upload.ID]
+	if !found {
+		return ErrNotFound
+	}
+	if existing.Version != upload.Version {
+		return ErrModified
+	}
+	updated := *existing
+	for _, field := range fields {
+		switch field {
+		case "offset":
+			updated.Offset = upload.Offset
+		case "parts":
+			updated.Parts = upload.Parts
+		case "digest":
+			updated.Digest = upload.Digest
+		case "completing_at":
+			updated.CompletingAt = upload.CompletingAt
+		default:
+			return fmt.Errorf("Unknown field: '%s'", field)
+		}
+	}
+	updated.Version++
+	updated.UpdatedAt = time.Now()
+	upload.Version = updated.Version
+	upload.UpdatedAt = updated.UpdatedAt
+	db.uploads[upload.ID] = &updated
+	return nil
+}
+
+// ListUploads lists Uploads matching the query. Uploads are ordered by ID.
+func (db *memoryDB) ListUploads(q Query) ([]*Upload, error) {
+	db.mutex.RLock()
+	uploads := make([]*Upload, 0, len(db.uploads))
+	for _, upload := range db.uploads {
+		if !q.UpdatedBefore.IsZero() && !upload.UpdatedAt.Before(q.UpdatedBefore) {
+			continue
+		}
+		c := *upload
+		uploads = append(uploads, &c)
+	}
+	db.mutex.RUnlock()
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].ID < uploads[j].ID
+	})
+
+	if q.Offset >= len(uploads) {
+		return []*Upload{}, nil
+	}
+	uploads = uploads[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(uploads) {
+		uploads = uploads[:q.Limit]
+	}
+	return uploads, nil
+}
+
+// DeleteUpload deletes the Upload from the Database
+func (db *memoryDB) DeleteUpload(upload *Upload) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.uploads[upload.ID]
+	if !found {
+		return ErrNotFound
+	}
+	if existing.Version != upload.Version {
+		return ErrModified
+	}
+	delete(db.uploads, upload.ID)
+	return nil
+}
+
+// AcquireChunk takes a reference to a Chunk, recording it if it is new
+func (db *memoryDB) AcquireChunk(chunk *Chunk) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.chunks[chunk.ObjectKey]
+	if found && existing.Refs < 0 {
+		return false, ErrCollecting
+	}
+	if found {
+		existing.Refs++
+		existing.UpdatedAt = time.Now()
+		return false, nil
+	}
+	created := *chunk
+	created.Refs = 1
+	created.UpdatedAt = time.Now()
+	db.chunks[chunk.ObjectKey] = &created
+	return true, nil
+}
+
+// ReleaseChunk releases a reference to the Chunk with the given key
+func (db *memoryDB) ReleaseChunk(key string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.chunks[key]
+	if !found || existing.Refs <= 0 {
+		return ErrNotFound
+	}
+	existing.Refs--
+	existing.UpdatedAt = time.Now()
+	return nil
+}
+
+// CollectChunks claims unreferenced Chunks for garbage collection
+func (db *memoryDB) CollectChunks(cutoff time.Time, limit int) ([]*Chunk, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	keys := make([]string, 0, len(db.chunks))
+	for key := range db.chunks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	claimed := 0
+	for _, key := range keys {
+		chunk := db.chunks[key]
+		if claimed < limit && chunk.Refs == 0 && chunk.UpdatedAt.Before(cutoff) {
+			chunk.Refs = -1
+			claimed++
+		}
+	}
+	var chunks []*Chunk
+	for _, key := range keys {
+		if chunk := db.chunks[key]; chunk.Refs < 0 && len(chunks) < limit {
+			c := *chunk
+			chunks = append(chunks, &c)
+		}
+	}
+	return chunks, nil
+}
+
+// DeleteChunk deletes a Chunk claimed for garbage collection
+func (db *memoryDB) DeleteChunk(key string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, found := db.chunks[key]
+	if !found || existing.Refs >= 0 {
+		return ErrNotFound
+	}
+	delete(db.chunks, key)
+	return nil
+}
+
+// copyBlob returns a deep copy of the Blob so that callers never share
+// state with the copy held by the Database
+func copyBlob(blob *Blob) *Blob {
+	c := *blob
+	if blob.Properties.RawMessage != nil {
+		c.Properties.RawMessage = append(json.RawMessage(nil), blob.Properties.RawMessage...)
+	}
+	return &c
+}
+
+// setBlobField copies the named column from src to dst
+func setBlobField(dst, src *Blob, field string) error {
+	switch field {
+	case "created_by":
+		dst.CreatedBy = src.CreatedBy
+	case "updated_by":
+		dst.UpdatedBy = src.UpdatedBy
+	case "path":
+		dst.Path = src.Path
+	case "size":
+		dst.Size = src.Size
+	case "properties":
+		dst.Properties = copyBlob(src).Properties
+	case "sha256":
+		dst.SHA256 = src.SHA256
+	case "content_type":
+		dst.ContentType = src.ContentType
+	case "state":
+		dst.State = src.State
+	case "revision":
+		dst.Revision = src.Revision
+	case "pending_revision":
+		dst.PendingRevision = src.PendingRevision
+	case "object_key":
+		dst.ObjectKey = src.ObjectKey
+	case "backend":
+		dst.Backend = src.Backend
+	case "pending_backend":
+		dst.PendingBackend = src.PendingBackend
+	case "last_accessed_at":
+		dst.LastAccessedAt = src.LastAccessedAt
+	case "restoring":
+		dst.Restoring = src.Restoring
+	case "encoding":
+		dst.Encoding = src.Encoding
+	case "stored_size":
+		dst.StoredSize = src.StoredSize
+	case "chunked":
+		dst.Chunked = src.Chunked
+	default:
+		return fmt.Errorf("Unknown field: '%s'", field)
+	}
+	return nil
+}
+
+// blobOrder returns a less function implementing an "order by" clause such
+// as "path" or "created_at desc". Ties are broken by ID so that pagination
+// is stable.
+func blobOrder(orderBy string) (func(a, b *Blob) bool, error) {
+
+	column, desc, err := parseOrder(orderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	var compare func(a, b *Blob) int
+	switch column {
+	case "id":
+		compare = func(a, b *Blob) int { return strings.Compare(a.ID, b.ID) }
+	case "path":
+		compare = func(a, b *Blob) int { return strings.Compare(a.Path, b.Path) }
+	case "created_by":
+		compare = func(a, b *Blob) int { return strings.Compare(a.CreatedBy, b.CreatedBy) }
+	case "updated_by":
+		compare = func(a, b *Blob) int { return strings.Compare(a.UpdatedBy, b.UpdatedBy) }
+	case "created_at":
+		compare = func(a, b *Blob) int { return compareTimes(a.CreatedAt, b.CreatedAt) }
+	case "updated_at":
+		compare = func(a, b *Blob) int { return compareTimes(a.UpdatedAt, b.UpdatedAt) }
+	case "size":
+		compare = func(a, b *Blob) int { return compareInts(a.Size, b.Size) }
+	default:
+		return nil, fmt.Errorf("Invalid order: '%s'", orderBy)
+	}
+
+	return func(a, b *Blob) bool {
+		c := compare(a, b)
+		if desc {
+			c = -c
+		}
+		if c == 0 {
+			return a.ID < b.ID
+		}
+		return c < 0
+	}, nil
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -6,6 +6,7 @@ package db
 
 import (
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -70,6 +71,30 @@ func (mr *MockDatabaseMockRecorder) Update(arg0, arg1 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockDatabase)(nil).Update), arg0, arg1)
 }
 
+// Relocate mocks base method
+func (m *MockDatabase) Relocate(arg0 *Blob, arg1, arg2 string) error {
+	ret := m.ctrl.Call(m, "Relocate", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Relocate indicates an expected call of Relocate
+func (mr *MockDatabaseMockRecorder) Relocate(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Relocate", reflect.TypeOf((*MockDatabase)(nil).Relocate), arg0, arg1, arg2)
+}
+
+// Touch mocks base method
+func (m *MockDatabase) Touch(arg0 *Blob, arg1 []string) error {
+	ret := m.ctrl.Call(m, "Touch", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Touch indicates an expected call of Touch
+func (mr *MockDatabaseMockRecorder) Touch(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Touch", reflect.TypeOf((*MockDatabase)(nil).Touch), arg0, arg1)
+}
+
 // List mocks base method
 func (m *MockDatabase) List(arg0 Query) ([]*Blob, error) {
 	ret := m.ctrl.Call(m, "List", arg0)
@@ -94,3 +119,128 @@ func (m *MockDatabase) Delete(arg0 *Blob) error {
 func (mr *MockDatabaseMockRecorder) Delete(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockDatabase)(nil).Delete), arg0)
 }
+
+// Move mocks base method
+func (m *MockDatabase) Move(from, to string) ([]*Blob, error) {
+	ret := m.ctrl.Call(m, "Move", from, to)
+	ret0, _ := ret[0].([]*Blob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Move indicates an expected call of Move
+func (mr *MockDatabaseMockRecorder) Move(from, to interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Move", reflect.TypeOf((*MockDatabase)(nil).Move), from, to)
+}
+
+// GetUpload mocks base method
+func (m *MockDatabase) GetUpload(id string) (*Upload, error) {
+	ret := m.ctrl.Call(m, "GetUpload", id)
+	ret0, _ := ret[0].(*Upload)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUpload indicates an expected call of GetUpload
+func (mr *MockDatabaseMockRecorder) GetUpload(id interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUpload", reflect.TypeOf((*MockDatabase)(nil).GetUpload), id)
+}
+
+// SaveUpload mocks base method
+func (m *MockDatabase) SaveUpload(arg0 *Upload) error {
+	ret := m.ctrl.Call(m, "SaveUpload", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveUpload indicates an expected call of SaveUpload
+func (mr *MockDatabaseMockRecorder) SaveUpload(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUpload", reflect.TypeOf((*MockDatabase)(nil).SaveUpload), arg0)
+}
+
+// UpdateUpload mocks base method
+func (m *MockDatabase) UpdateUpload(arg0 *Upload, arg1 []string) error {
+	ret := m.ctrl.Call(m, "UpdateUpload", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateUpload indicates an expected call of UpdateUpload
+func (mr *MockDatabaseMockRecorder) UpdateUpload(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUpload", reflect.TypeOf((*MockDatabase)(nil).UpdateUpload), arg0, arg1)
+}
+
+// ListUploads mocks base method
+func (m *MockDatabase) ListUploads(arg0 Query) ([]*Upload, error) {
+	ret := m.ctrl.Call(m, "ListUploads", arg0)
+	ret0, _ := ret[0].([]*Upload)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListUploads indicates an expected call of ListUploads
+func (mr *MockDatabaseMockRecorder) ListUploads(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListUploads", reflect.TypeOf((*MockDatabase)(nil).ListUploads), arg0)
+}
+
+// DeleteUpload mocks base method
+func (m *MockDatabase) DeleteUpload(arg0 *Upload) error {
+	ret := m.ctrl.Call(m, "DeleteUpload", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUpload indicates an expected call of DeleteUpload
+func (mr *MockDatabaseMockRecorder) DeleteUpload(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUpload", reflect.TypeOf((*MockDatabase)(nil).DeleteUpload), arg0)
+}
+
+// AcquireChunk mocks base method
+func (m *MockDatabase) AcquireChunk(arg0 *Chunk) (bool, error) {
+	ret := m.ctrl.Call(m, "AcquireChunk", arg0)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AcquireChunk indicates an expected call of AcquireChunk
+func (mr *MockDatabaseMockRecorder) AcquireChunk(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcquireChunk", reflect.TypeOf((*MockDatabase)(nil).AcquireChunk), arg0)
+}
+
+// ReleaseChunk mocks base method
+func (m *MockDatabase) ReleaseChunk(key string) error {
+	ret := m.ctrl.Call(m, "ReleaseChunk", key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseChunk indicates an expected call of ReleaseChunk
+func (mr *MockDatabaseMockRecorder) ReleaseChunk(key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseChunk", reflect.TypeOf((*MockDatabase)(nil).ReleaseChunk), key)
+}
+
+// CollectChunks mocks base method
+func (m *MockDatabase) CollectChunks(cutoff time.Time, limit int) ([]*Chunk, error) {
+	ret := m.ctrl.Call(m, "CollectChunks", cutoff, limit)
+	ret0, _ := ret[0].([]*Chunk)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CollectChunks indicates an expected call of CollectChunks
+func (mr *MockDatabaseMockRecorder) CollectChunks(cutoff, limit interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CollectChunks", reflect.TypeOf((*MockDatabase)(nil).CollectChunks), cutoff, limit)
+}
+
+// DeleteChunk mocks base method
+func (m *MockDatabase) DeleteChunk(key string) error {
+	ret := m.ctrl.Call(m, "DeleteChunk", key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteChunk indicates an expected call of DeleteChunk
+func (mr *MockDatabaseMockRecorder) DeleteChunk(key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteChunk", reflect.TypeOf((*MockDatabase)(nil).DeleteChunk), key)
+}
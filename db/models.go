@@ -13,6 +13,16 @@ import (
 // MaxPropertiesSize specifies the max size in bytes for Blob properties
 const MaxPropertiesSize = 10 * 1024
 
+// Blob states. A Blob is pending until its first upload has been stored and
+// verified, at which point it is committed. A Blob whose first upload did not
+// complete is marked failed. Blobs saved before states were introduced have
+// an empty state and are treated as committed.
+const (
+	StatePending   = "pending"
+	StateCommitted = "committed"
+	StateFailed    = "failed"
+)
+
 var nameRegex = regexp.MustCompile(`^[0-9A-Za-z_][A-Za-z0-9-_ ]*(\.[a-zA-Z0-9]+)?$`)
 
 // Blob is a stored object
@@ -25,11 +35,94 @@ type Blob struct {
 	Path       string    `gorm:"size:250;unique_index"`
 	Size       int64
 	Properties postgres.Jsonb
+
+	// Version is incremented on every change to the Blob
+	Version int64 `gorm:"not null;default:0"`
+
+	// SHA256 is the hex encoded SHA-256 digest of the Blob content
+	SHA256 string `gorm:"size:64"`
+
+	// ContentType is the media type of the Blob content
+	ContentType string `gorm:"size:100"`
+
+	// State of the Blob upload: pending, committed or failed
+	State string `gorm:"size:20;index"`
+
+	// Revision identifies the object holding the committed Blob content
+	Revision string `gorm:"size:50"`
+
+	// PendingRevision identifies an object being uploaded to replace the
+	// committed content. It is empty when no upload is in progress.
+	PendingRevision string `gorm:"size:50;index"`
+
+	// ObjectKey is the storage key of the committed content. It is recorded
+	// when a Blob is uploaded, moved or copied, since keys include the
+	// extension of the path at the time of upload. Copies of a Blob share
+	// its key.
+	ObjectKey string `gorm:"size:250;index"`
+
+	// Backend names the storage backend holding the committed content, and
+	// PendingBackend the backend an upload in progress is staged in. They are
+	// empty for the default backend.
+	Backend        string `gorm:"size:50"`
+	PendingBackend string `gorm:"size:50"`
+
+	// LastAccessedAt is when the content was last read, recorded at a coarse
+	// resolution. It is zero if the content has not been read.
+	LastAccessedAt time.Time
+
+	// Restoring is set while content requested from a slow storage tier is
+	// moved back to a faster one
+	Restoring bool
+
+	// Encoding is the compression applied to the stored object, if any, and
+	// StoredSize the size of the object as stored. Size remains the size of
+	// the content itself.
+	Encoding   string `gorm:"size:20"`
+	StoredSize int64
+
+	// Chunked is set when the content is stored as deduplicated chunks, in
+	// which case the object holds the manifest listing them
+	Chunked bool
 }
 
 // Key used when storing the blob
 func (b *Blob) Key() string {
-	return fmt.Sprintf("%s/%s%s", b.ID, b.ID, b.Extension())
+	if b.ObjectKey != "" {
+		return b.ObjectKey
+	}
+	return b.KeyFor(b.Revision)
+}
+
+// Rename changes the path of the Blob, recording its storage key first so
+// that the key does not change along with the path extension
+func (b *Blob) Rename(path string) {
+	if b.ObjectKey == "" && b.Committed() {
+		b.ObjectKey = b.Key()
+	}
+	b.Path = path
+}
+
+// PendingKey is the staging key of an upload in progress, if any
+func (b *Blob) PendingKey() string {
+	if b.PendingRevision == "" {
+		return ""
+	}
+	return b.KeyFor(b.PendingRevision)
+}
+
+// KeyFor returns the storage key of the given revision of the blob. Blobs
+// stored before revisions were introduced are keyed by their ID alone.
+func (b *Blob) KeyFor(revision string) string {
+	if revision == "" {
+		return fmt.Sprintf("%s/%s%s", b.ID, b.ID, b.Extension())
+	}
+	return fmt.Sprintf("%s/%s%s", b.ID, revision, b.Extension())
+}
+
+// Committed returns true if the Blob content has been stored and verified
+func (b *Blob) Committed() bool {
+	return b.State == "" || b.State == StateCommitted
 }
 
 // Extension of the file when uploaded
@@ -65,9 +158,5 @@ func (b *Blob) Validate() []error {
 
 // BeforeSave is called as the Blob is being saved to the database
 func (b *Blob) BeforeSave() error {
-	errs := b.Validate()
-	if errs != nil {
-		return errs[0]
-	}
-	return nil
+	return validate(b)
 }
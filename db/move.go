@@ -0,0 +1,65 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// validateMove checks the source and destination paths of a move
+func validateMove(from, to string) error {
+	var errs []error
+	if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+		errs = append(errs, errors.New("Invalid move: paths must start with /"))
+	} else if from == to {
+		errs = append(errs, errors.New("Invalid move: source and destination are the same"))
+	} else if strings.HasPrefix(to, from+"/") {
+		errs = append(errs, fmt.Errorf("Invalid move: '%s' is beneath '%s'", to, from))
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// inTree returns true if the path is from or beneath it
+func inTree(path, from string) bool {
+	return path == from || strings.HasPrefix(path, from+"/")
+}
+
+// likeTree returns a LIKE pattern matching the paths beneath from
+func likeTree(from string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(from)
+	return escaped + "/%"
+}
+
+// planMove prepares the Blobs found by a move query, setting their new
+// paths. Matches that are not in the tree are dropped since SQLite compares
+// LIKE patterns without regard to case. Blobs are ordered so that a path
+// vacated by one Blob is never claimed by another before it has moved.
+// Moving to a shorter path can only land on a path that is itself shorter,
+// so shortest first suffices.
+func planMove(found []*Blob, from, to string) ([]*Blob, error) {
+	var blobs []*Blob
+	for _, blob := range found {
+		if !inTree(blob.Path, from) {
+			continue
+		}
+		if blob.PendingRevision != "" {
+			return nil, ErrBusy
+		}
+		blob.Rename(to + strings.TrimPrefix(blob.Path, from))
+		if err := validate(blob); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+	if len(blobs) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.SliceStable(blobs, func(i, j int) bool {
+		return len(blobs[i].Path) < len(blobs[j].Path)
+	})
+	return blobs, nil
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// orderColumns lists the columns Blobs may be ordered by
+var orderColumns = map[string]bool{
+	"id":         true,
+	"path":       true,
+	"created_by": true,
+	"updated_by": true,
+	"created_at": true,
+	"updated_at": true,
+	"size":       true,
+}
+
+// parseOrder parses an "order by" clause such as "path" or "created_at desc".
+// An empty clause orders by ID.
+func parseOrder(orderBy string) (column string, desc bool, err error) {
+
+	parts := strings.Fields(strings.ToLower(orderBy))
+	if len(parts) == 0 {
+		parts = []string{"id"}
+	}
+	if len(parts) > 2 || !orderColumns[parts[0]] {
+		return "", false, fmt.Errorf("Invalid order: '%s'", orderBy)
+	}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "asc":
+		case "desc":
+			desc = true
+		default:
+			return "", false, fmt.Errorf("Invalid order: '%s'", orderBy)
+		}
+	}
+	return parts[0], desc, nil
+}
+
+// orderClause returns the SQL ordering for an "order by" clause. As in the
+// memory Database, ties are broken by ID so that pagination is stable.
+func orderClause(orderBy string) (string, error) {
+	column, desc, err := parseOrder(orderBy)
+	if err != nil {
+		return "", err
+	}
+	clause := column
+	if desc {
+		clause += " desc"
+	}
+	if column != "id" {
+		clause += ", id"
+	}
+	return clause, nil
+}
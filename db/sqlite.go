@@ -0,0 +1,316 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+
+	// Registers the sqlite3 gorm dialect and database/sql driver
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// sqliteBlob is the SQLite representation of a Blob. Properties are kept as
+// JSON text since SQLite has no equivalent of the Postgres jsonb type.
+type sqliteBlob struct {
+	ID         string    `gorm:"size:50;primary_key;unique_index"`
+	CreatedAt  time.Time `gorm:"index"`
+	UpdatedAt  time.Time `gorm:"index"`
+	CreatedBy  string    `gorm:"size:50;index"`
+	UpdatedBy  string    `gorm:"size:50;index"`
+	Path       string    `gorm:"size:250;unique_index"`
+	Size       int64
+	Properties string `gorm:"type:text"`
+	SHA256     string `gorm:"size:64"`
+	Version    int64  `gorm:"not null;default:0"`
+
+	ContentType string `gorm:"size:100"`
+
+	State           string `gorm:"size:20;index"`
+	Revision        string `gorm:"size:50"`
+	PendingRevision string `gorm:"size:50;index"`
+	ObjectKey       string `gorm:"size:250;index"`
+	Backend         string `gorm:"size:50"`
+	PendingBackend  string `gorm:"size:50"`
+	LastAccessedAt  time.Time
+	Restoring       bool
+	Encoding        string `gorm:"size:20"`
+	StoredSize      int64
+	Chunked         bool
+}
+
+// TableName shares the table name used for Blobs in Postgres
+func (sqliteBlob) TableName() string {
+	return "blobs"
+}
+
+func newSQLiteBlob(blob *Blob) *sqliteBlob {
+	return &sqliteBlob{
+		ID:         blob.ID,
+		CreatedAt:  blob.CreatedAt,
+		UpdatedAt:  blob.UpdatedAt,
+		CreatedBy:  blob.CreatedBy,
+		UpdatedBy:  blob.UpdatedBy,
+		Path:       blob.Path,
+		Size:       blob.Size,
+		Properties: string(blob.Properties.RawMessage),
+		SHA256:     blob.SHA256,
+		Version:    blob.Version,
+
+		ContentType: blob.ContentType,
+
+		State:           blob.State,
+		Revision:        blob.Revision,
+		PendingRevision: blob.PendingRevision,
+		ObjectKey:       blob.ObjectKey,
+		Backend:         blob.Backend,
+		PendingBackend:  blob.PendingBackend,
+		LastAccessedAt:  blob.LastAccessedAt,
+		Restoring:       blob.Restoring,
+		Encoding:        blob.Encoding,
+		StoredSize:      blob.StoredSize,
+		Chunked:         blob.Chunked,
+	}
+}
+
+func (row *sqliteBlob) blob() *Blob {
+	blob := &Blob{
+		ID:        row.ID,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+		CreatedBy: row.CreatedBy,
+		UpdatedBy: row.UpdatedBy,
+		Path:      row.Path,
+		Size:      row.Size,
+		SHA256:    row.SHA256,
+		Version:   row.Version,
+
+		ContentType: row.ContentType,
+
+		State:           row.State,
+		Revision:        row.Revision,
+		PendingRevision: row.PendingRevision,
+		ObjectKey:       row.ObjectKey,
+		Backend:         row.Backend,
+		PendingBackend:  row.PendingBackend,
+		LastAccessedAt:  row.LastAccessedAt,
+		Restoring:       row.Restoring,
+		Encoding:        row.Encoding,
+		StoredSize:      row.StoredSize,
+		Chunked:         row.Chunked,
+	}
+	if row.Properties != "" {
+		blob.Properties = postgres.Jsonb{RawMessage: json.RawMessage(row.Properties)}
+	}
+	return blob
+}
+
+type sqliteDB struct {
+	uploadTable
+	chunkTable
+	gormDB *gorm.DB
+}
+
+// NewSQLiteDB opens the SQLite database file at the given path, creating and
+// migrating it as needed, and returns an interface to a Blob Database.
+func NewSQLiteDB(path string) (Database, error) {
+
+	gormDB, err := gorm.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer; serializing connections avoids
+	// "database is locked" errors under concurrent requests.
+	gormDB.DB().SetMaxOpenConns(1)
+
+	if err := gormDB.AutoMigrate(&sqliteBlob{}, &Upload{}, &Chunk{}).Error; err != nil {
+		gormDB.Close()
+		return nil, err
+	}
+	return &sqliteDB{
+		uploadTable: uploadTable{gormDB: gormDB},
+		chunkTable:  chunkTable{gormDB: gormDB},
+		gormDB:      gormDB,
+	}, nil
+}
+
+// Get a Blob with the given path
+func (db *sqliteDB) Get(path string) (*Blob, error) {
+	row := &sqliteBlob{}
+	err := db.gormDB.Where("path = ?", path).First(row).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return row.blob(), nil
+}
+
+// Save the Blob to the Database which updates all its fields
+func (db *sqliteDB) Save(blob *Blob) error {
+	if err := validate(blob); err != nil {
+		return err
+	}
+	row := newSQLiteBlob(blob)
+	row.Version++
+	if err := db.gormDB.Save(row).Error; err != nil {
+		return translateError(err)
+	}
+	blob.Version = row.Version
+	blob.CreatedAt = row.CreatedAt
+	blob.UpdatedAt = row.UpdatedAt
+	return nil
+}
+
+// Update the specified Blob fields
+func (db *sqliteDB) Update(blob *Blob, fields []string) error {
+	if err := validate(blob); err != nil {
+		return err
+	}
+	row := newSQLiteBlob(blob)
+	row.Version++
+	values, err := updateValues(db.gormDB, row, append(fields[:len(fields):len(fields)], "version"))
+	if err != nil {
+		return err
+	}
+	result := db.gormDB.Model(row).Where("version = ?", blob.Version).Updates(values)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return db.modified(blob.ID)
+	}
+	blob.Version = row.Version
+	blob.UpdatedAt = row.UpdatedAt
+	return nil
+}
+
+// Relocate records that the committed Blob content has moved
+func (db *sqliteDB) Relocate(blob *Blob, backend, objectKey string) error {
+	result := db.gormDB.Model(&sqliteBlob{}).
+		Where("id = ? AND revision = ? AND backend = ? AND object_key = ?", blob.ID, blob.Revision, blob.Backend, blob.ObjectKey).
+		UpdateColumns(map[string]interface{}{
+			"backend":    backend,
+			"object_key": objectKey,
+			"restoring":  false,
+		})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return db.modified(blob.ID)
+	}
+	blob.Backend = backend
+	blob.ObjectKey = objectKey
+	blob.Restoring = false
+	return nil
+}
+
+// Touch writes the specified Blob fields alone
+func (db *sqliteDB) Touch(blob *Blob, fields []string) error {
+	row := newSQLiteBlob(blob)
+	values, err := updateValues(db.gormDB, row, fields)
+	if err != nil {
+		return err
+	}
+	result := db.gormDB.Model(row).UpdateColumns(values)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List Blobs matching the query
+func (db *sqliteDB) List(q Query) ([]*Blob, error) {
+
+	var rows []*sqliteBlob
+
+	order, err := orderClause(q.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+	err = filter(db.gormDB, q).
+		Order(order).
+		Offset(q.Offset).
+		Limit(limit(q)).
+		Find(&rows).Error
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+	blobs := make([]*Blob, 0, len(rows))
+	for _, row := range rows {
+		blobs = append(blobs, row.blob())
+	}
+	return blobs, nil
+}
+
+// Delete the Blob from the Database
+func (db *sqliteDB) Delete(blob *Blob) error {
+	result := db.gormDB.Where("version = ?", blob.Version).Delete(newSQLiteBlob(blob))
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return db.modified(blob.ID)
+	}
+	return nil
+}
+
+// Move the Blob at path from, and every Blob beneath it, to the same
+// relative path beneath to
+func (db *sqliteDB) Move(from, to string) ([]*Blob, error) {
+
+	if err := validateMove(from, to); err != nil {
+		return nil, err
+	}
+
+	tx := db.gormDB.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	var rows []*sqliteBlob
+	err := tx.Where(`path = ? OR path LIKE ? ESCAPE '\'`, from, likeTree(from)).Find(&rows).Error
+	blobs := make([]*Blob, 0, len(rows))
+	for _, row := range rows {
+		blobs = append(blobs, row.blob())
+	}
+	if err == nil {
+		blobs, err = planMove(blobs, from, to)
+	}
+	for i := 0; err == nil && i < len(blobs); i++ {
+		blob := blobs[i]
+		result := tx.Model(&sqliteBlob{ID: blob.ID}).Where("version = ?", blob.Version).
+			Updates(map[string]interface{}{
+				"path":       blob.Path,
+				"object_key": blob.ObjectKey,
+				"version":    blob.Version + 1,
+			})
+		if result.Error != nil {
+			err = translateError(result.Error)
+		} else if result.RowsAffected == 0 {
+			err = ErrModified
+		}
+		blob.Version++
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, translateError(err)
+	}
+	return blobs, nil
+}
+
+// modified returns ErrModified if the Blob exists and ErrNotFound otherwise
+func (db *sqliteDB) modified(id string) error {
+	err := db.gormDB.Select("id").Where("id = ?", id).First(&sqliteBlob{}).Error
+	if err != nil {
+		return translateError(err)
+	}
+	return ErrModified
+}
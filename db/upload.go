@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Upload is a resumable upload session. Content is received in chunks which
+// are stored as part objects until the upload is complete, at which point
+// the parts are assembled into the content of the Blob at Path.
+type Upload struct {
+	ID        string    `gorm:"size:50;primary_key;unique_index"`
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time `gorm:"index"`
+	CreatedBy string    `gorm:"size:50;index"`
+	Path      string    `gorm:"size:250"`
+
+	// Length is the total size of the upload and Offset the number of bytes
+	// received so far
+	Length int64
+	Offset int64
+
+	// Parts holds the space separated IDs of the part objects holding the
+	// content received so far, in order
+	Parts string `gorm:"type:text"`
+
+	// Digest holds the state of the hashes of the content received so far,
+	// so that the content need not be read again to hash it once complete.
+	// It is empty if the state was not kept.
+	Digest string `gorm:"type:text"`
+
+	// CompletingAt is set while the upload is being completed, so that only
+	// one request completes it
+	CompletingAt time.Time
+
+	// Attributes of the Blob to create once the upload is complete
+	ContentType string `gorm:"size:100"`
+	Hash        string `gorm:"size:200"`
+	Properties  string `gorm:"type:text"`
+
+	// Version is incremented on every change to the Upload
+	Version int64 `gorm:"not null;default:0"`
+}
+
+// PartKey returns the storage key of the part with the given ID
+func (u *Upload) PartKey(part string) string {
+	return fmt.Sprintf("%s/%s.part", u.ID, part)
+}
+
+// PartKeys returns the storage keys of all parts received so far
+func (u *Upload) PartKeys() []string {
+	parts := strings.Fields(u.Parts)
+	keys := make([]string, len(parts))
+	for i, part := range parts {
+		keys[i] = u.PartKey(part)
+	}
+	return keys
+}
+
+// AddPart records a part holding the next n bytes of the upload
+func (u *Upload) AddPart(part string, n int64) {
+	if u.Parts == "" {
+		u.Parts = part
+	} else {
+		u.Parts += " " + part
+	}
+	u.Offset += n
+}
+
+// Complete returns true once all content of the upload has been received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// Validate the upload
+func (u *Upload) Validate() []error {
+
+	var errs []error
+
+	fail := func(msg string) {
+		errs = append(errs, errors.New(msg))
+	}
+
+	if len(u.Path) == 0 || u.Path[0] != '/' {
+		fail("Invalid path")
+	}
+	if u.Length < 0 {
+		fail("Invalid length")
+	}
+	if u.Offset < 0 || u.Offset > u.Length {
+		fail("Invalid offset")
+	}
+	if len(u.Properties) > MaxPropertiesSize {
+		fail("Invalid properties: too large")
+	}
+
+	return errs
+}
+
+// validateUpload returns a ValidationError if the Upload is invalid
+func validateUpload(u *Upload) error {
+	if errs := u.Validate(); len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// uploadTable implements the Upload methods of a Database on top of gorm.
+// Uploads have the same representation in Postgres and SQLite.
+type uploadTable struct {
+	gormDB *gorm.DB
+}
+
+// GetUpload returns the Upload with the given ID
+func (t *uploadTable) GetUpload(id string) (*Upload, error) {
+	upload := &Upload{}
+	err := t.gormDB.Where("id = ?", id).First(upload).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return upload, nil
+}
+
+// SaveUpload saves the Upload to the Database which updates all its fields
+func (t *uploadTable) SaveUpload(upload *Upload) error {
+	if err := validateUpload(upload); err != nil {
+		return err
+	}
+	upload.Version++
+	if err := t.gormDB.Save(upload).Error; err != nil {
+		upload.Version--
+		return translateError(err)
+	}
+	return nil
+}
+
+// UpdateUpload updates the specified Upload fields
+func (t *uploadTable) UpdateUpload(upload *Upload, fields []string) error {
+	if err := validateUpload(upload); err != nil {
+		return err
+	}
+	expected := upload.Version
+	upload.Version++
+	values, err := updateValues(t.gormDB, upload, append(fields[:len(fields):len(fields)], "version"))
+	if err != nil {
+		upload.Version = expected
+		return err
+	}
+	result := t.gormDB.Model(upload).Where("version = ?", expected).Updates(values)
+	if result.Error != nil {
+		upload.Version = expected
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		upload.Version = expected
+		return t.modified(upload.ID)
+	}
+	return nil
+}
+
+// ListUploads lists Uploads matching the query. Uploads are ordered by ID.
+func (t *uploadTable) ListUploads(q Query) ([]*Upload, error) {
+
+	var uploads []*Upload
+
+	search := t.gormDB
+	if !q.UpdatedBefore.IsZero() {
+		search = search.Where("updated_at < ?", q.UpdatedBefore)
+	}
+	err := search.
+		Order("id").
+		Offset(q.Offset).
+		Limit(limit(q)).
+		Find(&uploads).Error
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return uploads, nil
+}
+
+// DeleteUpload deletes the Upload from the Database
+func (t *uploadTable) DeleteUpload(upload *Upload) error {
+	result := t.gormDB.Where("version = ?", upload.Version).Delete(upload)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return t.modified(upload.ID)
+	}
+	return nil
+}
+
+// modified returns ErrModified if the Upload exists and ErrNotFound otherwise
+func (t *uploadTable) modified(id string) error {
+	err := t.gormDB.Select("id").Where("id = ?", id).First(&Upload{}).Error
+	if err != nil {
+		return translateError(err)
+	}
+	return ErrModified
+}
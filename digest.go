@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// checksum is a hash supplied by a client for content it is uploading
+type checksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// parseChecksum parses a client supplied hash. The hash is given in hex and
+// may be prefixed with its algorithm, e.g. "md5:9e107d9d...". Hashes without
+// a prefix are taken to be SHA-256.
+func parseChecksum(s string) (*checksum, error) {
+
+	algorithm := "sha256"
+	value := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		algorithm = strings.ToLower(s[:i])
+		value = s[i+1:]
+	}
+	sum, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hash: '%s'", s)
+	}
+
+	var size int
+	switch algorithm {
+	case "sha256":
+		size = sha256.Size
+	case "md5":
+		size = md5.Size
+	case "crc32c":
+		size = crc32.Size
+	default:
+		return nil, fmt.Errorf("Unsupported hash algorithm: '%s'", algorithm)
+	}
+	if len(sum) != size {
+		return nil, fmt.Errorf("Invalid %s hash length: %d", algorithm, len(sum))
+	}
+	return &checksum{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// digester is an io.Writer that hashes content as it is written. SHA-256 is
+// always computed. Other algorithms are only computed when a client supplied
+// checksum needs them.
+type digester struct {
+	sha256   hash.Hash
+	other    hash.Hash
+	expected *checksum
+}
+
+func newDigester(expected *checksum) *digester {
+	d := &digester{sha256: sha256.New(), expected: expected}
+	if expected != nil {
+		switch expected.Algorithm {
+		case "md5":
+			d.other = md5.New()
+		case "crc32c":
+			d.other = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		}
+	}
+	return d
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	if d.other != nil {
+		d.other.Write(p)
+	}
+	return len(p), nil
+}
+
+// SHA256 returns the hex encoded SHA-256 digest of the content
+func (d *digester) SHA256() string {
+	return hex.EncodeToString(d.sha256.Sum(nil))
+}
+
+// Verify returns true if the content matches the expected checksum, if any
+func (d *digester) Verify() bool {
+	if d.expected == nil {
+		return true
+	}
+	h := d.sha256
+	if d.other != nil {
+		h = d.other
+	}
+	return bytes.Equal(h.Sum(nil), d.expected.Sum)
+}
+
+// State returns the state of the hashes, from which restoreDigester
+// continues hashing further content
+func (d *digester) State() (string, error) {
+	var states []string
+	for _, h := range d.hashes() {
+		data, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		states = append(states, base64.StdEncoding.EncodeToString(data))
+	}
+	return strings.Join(states, " "), nil
+}
+
+// restoreDigester returns a digester that continues from a state returned
+// by State, or starts afresh if the state is empty
+func restoreDigester(expected *checksum, state string) (*digester, error) {
+	d := newDigester(expected)
+	if state == "" {
+		return d, nil
+	}
+	states := strings.Fields(state)
+	hashes := d.hashes()
+	if len(states) != len(hashes) {
+		return nil, fmt.Errorf("Invalid digest state: %d hashes, expected %d", len(states), len(hashes))
+	}
+	for i, h := range hashes {
+		data, err := base64.StdEncoding.DecodeString(states[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid digest state: %s", err.Error())
+		}
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("Invalid digest state: %s", err.Error())
+		}
+	}
+	return d, nil
+}
+
+// hashes returns the hashes being computed
+func (d *digester) hashes() []hash.Hash {
+	if d.other == nil {
+		return []hash.Hash{d.sha256}
+	}
+	return []hash.Hash{d.sha256, d.other}
+}
+
+// digestHeader formats a hex SHA-256 digest as an RFC 3230 Digest header
+func digestHeader(sha256Hex string) string {
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
+}
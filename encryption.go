@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// rotateKeys rewraps the data keys of the objects in every encrypting store
+// with the current master key. Once it completes, older master keys may be
+// removed from the keyfile.
+func rotateKeys(encryptors []*store.EncryptingStore) error {
+
+	var rotated, failed int
+	for _, encryptor := range encryptors {
+		n, err := encryptor.RotateAll(context.Background())
+		rotated += n
+		if err != nil {
+			log.WithError(err).Error("Failed to rotate keys")
+			failed++
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"stores":  len(encryptors),
+		"rotated": rotated,
+		"failed":  failed,
+	}).Info("Key rotation complete")
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to rotate keys of %d object stores", failed)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/labstack/echo"
+	"github.com/myzie/blobs/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// databaseError responds to a request that failed because of a Database
+// error. Errors defined by the db package map to client errors; anything
+// else is logged and reported as an internal error with the given message.
+func databaseError(c echo.Context, err error, msg string) error {
+
+	if verr, ok := err.(*db.ValidationError); ok {
+		details := make([]string, len(verr.Errors))
+		for i, e := range verr.Errors {
+			details[i] = e.Error()
+		}
+		return c.JSON(UnprocessableEntity, validationErrorView{"Invalid blob", details})
+	}
+
+	switch err {
+	case db.ErrNotFound:
+		return c.JSON(NotFound, errorView{"Blob not found"})
+	case db.ErrConflict:
+		return c.JSON(Conflict, errorView{"Blob path already exists"})
+	case db.ErrModified:
+		return c.JSON(PreconditionFailed, errorView{"Blob was modified"})
+	case db.ErrBusy:
+		return c.JSON(Conflict, errorView{"Blob upload in progress"})
+	}
+
+	log.WithError(err).Error(msg)
+	return c.JSON(InternalServerError, errorView{msg})
+}
+
+// serviceError responds to a request that failed with an error returned by
+// one of the service helpers. These return an *echo.HTTPError for failures
+// that they have already logged or that are the fault of the client.
+func serviceError(c echo.Context, err error, msg string) error {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return c.JSON(he.Code, errorView{fmt.Sprint(he.Message)})
+	}
+	return databaseError(c, err, msg)
+}
@@ -8,5 +8,5 @@ fi
 
 curl -s \
     -H "Authorization: Bearer $BLOBS_TOKEN" \
-    -H "Content-Type: application/json"     \
+    -H "Accept: application/json"           \
     "http://localhost:8080/blobs$FILE" | jq '.'
@@ -4,11 +4,11 @@ STORAGE_PATH=$1
 
 FILE=$2
 FILE_NAME=$(basename "${FILE}")
-FILE_SIZE=$(wc -c <"${FILE}" | tr -d '[:space:]')
+FILE_HASH=$(shasum -a 256 "${FILE}" | cut -d ' ' -f 1)
 
 curl -s                                   \
   -F "path=${STORAGE_PATH}"               \
-  -F "size=${FILE_SIZE}"                  \
+  -F "hash=sha256:${FILE_HASH}"           \
   -F "file=@${FILE}"                      \
   -X POST                                 \
   -H "Authorization: Bearer $BLOBS_TOKEN" \
@@ -0,0 +1,14 @@
+#!/bin/bash
+
+set -e
+
+STORAGE_PATH="$1"
+
+FILE="$2"
+FILE_HASH=$(shasum -a 256 "${FILE}" | cut -d ' ' -f 1)
+
+curl -s                                   \
+  -T "${FILE}"                            \
+  -H "Authorization: Bearer $BLOBS_TOKEN" \
+  -H "X-Blob-Hash: sha256:${FILE_HASH}"   \
+  "http://localhost:8080/blobs${STORAGE_PATH}" | jq '.'
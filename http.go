@@ -7,7 +7,17 @@ const (
 	NotFound            = http.StatusNotFound
 	BadRequest          = http.StatusBadRequest
 	OK                  = http.StatusOK
+	PartialContent      = http.StatusPartialContent
 	InternalServerError = http.StatusInternalServerError
 	NoContent           = http.StatusNoContent
+	NotModified         = http.StatusNotModified
+	PreconditionFailed  = http.StatusPreconditionFailed
 	Created             = http.StatusCreated
+	Conflict            = http.StatusConflict
+	UnprocessableEntity = http.StatusUnprocessableEntity
+	RequestTooLarge     = http.StatusRequestEntityTooLarge
+	RangeNotSatisfiable = http.StatusRequestedRangeNotSatisfiable
+	ServiceUnavailable  = http.StatusServiceUnavailable
+
+	UnsupportedMediaType = http.StatusUnsupportedMediaType
 )
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/myzie/base"
 	"github.com/myzie/blobs/db"
 	"github.com/myzie/blobs/store"
@@ -10,40 +14,357 @@ import (
 
 func main() {
 
-	var sizeLimit string
+	var (
+		sizeLimit string
+		storeType string
+		storeRoot string
+		backends  string
+		mounts    string
+		keyfile   string
+		rotate    bool
+		cacheDir  string
+		cacheSize string
+		dbType    string
+		dbPath    string
+
+		replicas          string
+		replicationMode   string
+		replicationQuorum int
+		replicationQueue  string
+		repair            bool
+		repairVerify      bool
+
+		tierPolicies string
+		slowTiers    string
+		tierInterval time.Duration
+		restoreHold  time.Duration
+
+		inlineTypes string
+
+		compression   string
+		compressTypes string
+
+		chunkSize  string
+		chunkGrace time.Duration
+
+		pendingTimeout time.Duration
+		uploadExpiry   time.Duration
+		presignExpiry  time.Duration
+	)
 	flag.StringVar(&sizeLimit, "blob-size-limit", "100M", "Blob size limit")
+	flag.StringVar(&storeType, "object-store", "minio", "Object store type (minio, local or memory)")
+	flag.StringVar(&storeRoot, "object-store-root", "/var/lib/blobs", "Root directory for the local object store")
+	flag.StringVar(&backends, "object-store-backends", "",
+		"Comma separated additional object stores as name=type:arg, where arg is the bucket for minio or the root for local")
+	flag.StringVar(&mounts, "object-store-mounts", "",
+		"Comma separated rules routing paths to additional object stores, as /prefix/**=name")
+	flag.StringVar(&keyfile, "object-store-keyfile", "",
+		"File of master keys encrypting objects at rest, one 'id base64key' per line with the current key last")
+	flag.BoolVar(&rotate, "rotate-keys", false, "Rewrap the data keys of all objects with the current master key, then exit")
+	flag.StringVar(&cacheDir, "object-store-cache", "", "Directory caching objects read from the default object store, or empty for none")
+	flag.StringVar(&cacheSize, "object-store-cache-size", "1G", "Size of the object cache")
+	flag.StringVar(&replicas, "object-store-replicas", "",
+		"Comma separated object stores replicating the default store, as name=type:arg")
+	flag.StringVar(&replicationMode, "replication-mode", "sync", "Replica write mode (sync or async)")
+	flag.IntVar(&replicationQuorum, "replication-quorum", 0, "Replicas that must accept a synchronous write, or 0 for all")
+	flag.StringVar(&replicationQueue, "replication-queue", "/var/lib/blobs/replication", "Directory recording writes still to be made to replicas")
+	flag.BoolVar(&repair, "repair-replicas", false, "Copy objects again to replicas missing them or holding wrong content, then exit")
+	flag.BoolVar(&repairVerify, "repair-verify", false, "Check the SHA-256 of every replica when repairing, which reads every object")
+	flag.StringVar(&tierPolicies, "tier-policies", "",
+		"Comma separated policies moving blobs between object stores, as tier:condition&condition")
+	flag.StringVar(&slowTiers, "slow-tiers", "", "Comma separated object stores whose blobs are restored before being read")
+	flag.DurationVar(&tierInterval, "tier-interval", 10*time.Minute, "Time between evaluations of the tier policies")
+	flag.DurationVar(&restoreHold, "tier-restore-hold", 24*time.Hour, "Time for which blobs that were read are kept out of slow tiers")
+	flag.StringVar(&dbType, "database", "postgres", "Blob metadata database type (postgres, sqlite or memory)")
+	flag.StringVar(&dbPath, "database-path", "blobs.db", "Database file for the sqlite database")
+	flag.StringVar(&inlineTypes, "inline-content-types", "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain",
+		"Comma separated content types that may be displayed inline by browsers")
+	flag.StringVar(&compression, "compression", "", "Encoding compressible content is stored with (gzip or zstd), or empty for none")
+	flag.StringVar(&compressTypes, "compress-content-types", "text/*,application/json,application/x-ndjson,application/xml",
+		"Comma separated content types that are compressed when stored")
+	flag.StringVar(&chunkSize, "chunk-size", "", "Average size of the deduplicated chunks uploads are stored as, or empty to store uploads whole")
+	flag.DurationVar(&chunkGrace, "chunk-gc-grace", time.Hour, "Time for which unreferenced chunks are kept before they are removed")
+	flag.DurationVar(&pendingTimeout, "pending-upload-timeout", time.Hour, "Age after which incomplete uploads are abandoned")
+	flag.DurationVar(&presignExpiry, "presign-expiry", 15*time.Minute, "Time for which presigned object store URLs are valid")
+	flag.DurationVar(&uploadExpiry, "resumable-upload-expiry", 24*time.Hour, "Time after which resumable uploads without progress are discarded")
 
 	log.Infof("Blob size limit: %s", sizeLimit)
 
 	base := base.Must()
 
-	objStoreSettings := base.Settings.ObjectStore
+	if compression != "" {
+		if !store.ValidEncoding(compression) {
+			log.Fatalf("Unknown compression: '%s'", compression)
+		}
+		log.Infof("Compressing content with %s: %s", compression, compressTypes)
+	}
+
+	var chunking *store.ChunkerOpts
+	if chunkSize != "" {
+		var err error
+		if chunking, err = newChunking(chunkSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	stores := &storeFactory{Base: base}
+	if keyfile != "" {
+		keys, err := store.LoadKeyring(keyfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Encrypting objects with master key: %s", keys.Current())
+		stores.Keys = keys
+	}
+
+	objStore, err := openObjectStore(base, storeType, storeRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cache *store.CachingStore
+	if cacheDir != "" {
+		cache, err = newCache(objStore, cacheDir, cacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		objStore = cache
+	}
+	objStore = stores.encrypt(objStore)
+	var replicator *store.Replicator
+	if replicas != "" {
+		replicator, err = newReplicator(stores, objStore, replicas, replicationMode, replicationQuorum, replicationQueue)
+		if err != nil {
+			log.Fatal(err)
+		}
+		objStore = replicator
+	}
+	if backends != "" || mounts != "" {
+		objStore, err = newRouter(stores, objStore, backends, mounts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var tiers *tiering
+	if tierPolicies != "" || slowTiers != "" {
+		tiers, err = newTiering(objStore, tierPolicies, slowTiers, restoreHold)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	objStore, err := store.NewMinioObjectStore(store.MinioOpts{
-		Bucket: objStoreSettings.Bucket,
-		Region: objStoreSettings.Region,
-		URL:    objStoreSettings.URL,
-		UseSSL: !objStoreSettings.DisableSSL,
-	})
+	if rotate {
+		if stores.Keys == nil {
+			log.Fatal("No keyfile configured to rotate keys with")
+		}
+		if err := rotateKeys(stores.encryptors); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	blobDB, err := newDatabase(base, dbType, dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	blobDB := db.NewStandardDB(base.DB)
+	if repair {
+		if replicator == nil {
+			log.Fatal("No replicas configured to repair")
+		}
+		if err := repairReplicas(blobDB, replicator, repairVerify); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	serviceOpts := blobsServiceOpts{
-		Base:      base,
-		Store:     objStore,
-		Database:  blobDB,
-		SizeLimit: sizeLimit,
+		Base:        base,
+		Store:       objStore,
+		Database:    blobDB,
+		SizeLimit:   sizeLimit,
+		InlineTypes: inlineTypes,
+
+		UploadExpiry:  uploadExpiry,
+		PresignExpiry: presignExpiry,
+		Tiering:       tiers,
+
+		Compression:   compression,
+		CompressTypes: compressTypes,
+
+		Chunking:   chunking,
+		ChunkGrace: chunkGrace,
 	}
 
 	service := newBlobsService(serviceOpts)
 
-	if err := service.DB.AutoMigrate(db.Blob{}).Error; err != nil {
-		log.Fatal(err)
+	go service.runCleanup(pendingTimeout/4, pendingTimeout)
+	if replicator != nil {
+		go runReplication(replicator, 10*time.Second)
+	}
+	if cache != nil {
+		go logCacheStats(cache, 10*time.Minute)
+	}
+	if tiers != nil {
+		go service.runTiering(tierInterval)
 	}
+
 	if err := service.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// storeFactory creates the object stores given on the command line,
+// encrypting each of them when a keyring is configured
+type storeFactory struct {
+	Base *base.Base
+	Keys *store.Keyring
+
+	// encryptors holds the encrypting stores created, so that their keys
+	// can be rotated
+	encryptors []*store.EncryptingStore
+}
+
+// newObjectStore returns the ObjectStore of the given type, wrapped in an
+// EncryptingStore if objects are encrypted
+func (f *storeFactory) newObjectStore(storeType, arg string) (store.ObjectStore, error) {
+	objStore, err := openObjectStore(f.Base, storeType, arg)
+	if err != nil {
+		return nil, err
+	}
+	return f.encrypt(objStore), nil
+}
+
+// encrypt wraps a store in an EncryptingStore if objects are encrypted
+func (f *storeFactory) encrypt(objStore store.ObjectStore) store.ObjectStore {
+	if f.Keys == nil {
+		return objStore
+	}
+	encryptor := store.NewEncryptingStore(objStore, f.Keys)
+	f.encryptors = append(f.encryptors, encryptor)
+	return encryptor
+}
+
+// openObjectStore returns the ObjectStore selected by the object-store flag.
+// The argument is the bucket for minio, defaulting to the configured bucket,
+// or the root directory for local.
+func openObjectStore(base *base.Base, storeType, arg string) (store.ObjectStore, error) {
+
+	switch storeType {
+	case "minio":
+		objStoreSettings := base.Settings.ObjectStore
+		bucket := objStoreSettings.Bucket
+		if arg != "" {
+			bucket = arg
+		}
+		log.Infof("Minio object store bucket: %s", bucket)
+		return store.NewMinioObjectStore(store.MinioOpts{
+			Bucket: bucket,
+			Region: objStoreSettings.Region,
+			URL:    objStoreSettings.URL,
+			UseSSL: !objStoreSettings.DisableSSL,
+		})
+	case "local":
+		log.Infof("Local object store root: %s", arg)
+		return store.NewLocalObjectStore(store.LocalOpts{Root: arg})
+	case "memory":
+		log.Warn("Using in-memory object store; objects are lost on exit")
+		return store.NewMemoryObjectStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown object store type: '%s'", storeType)
+	}
+}
+
+// namedStore is an object store given a name on the command line
+type namedStore struct {
+	Name  string
+	Store store.ObjectStore
+}
+
+// newNamedStores returns the object stores described by a comma separated
+// list of name=type:arg entries
+func newNamedStores(stores *storeFactory, specs string) ([]namedStore, error) {
+
+	var named []namedStore
+	names := map[string]bool{}
+	for _, spec := range splitList(specs) {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid object store: '%s'", spec)
+		}
+		name := parts[0]
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate object store: '%s'", name)
+		}
+		names[name] = true
+		typeAndArg := strings.SplitN(parts[1], ":", 2)
+		var arg string
+		if len(typeAndArg) == 2 {
+			arg = typeAndArg[1]
+		}
+		objStore, err := stores.newObjectStore(typeAndArg[0], arg)
+		if err != nil {
+			return nil, err
+		}
+		named = append(named, namedStore{Name: name, Store: objStore})
+	}
+	return named, nil
+}
+
+// newRouter returns a store.Router over the default store and the stores
+// described by the object-store-backends flag, following the rules of the
+// object-store-mounts flag
+func newRouter(stores *storeFactory, fallback store.ObjectStore, backends, mounts string) (store.ObjectStore, error) {
+
+	named, err := newNamedStores(stores, backends)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]store.ObjectStore{}
+	for _, n := range named {
+		byName[n.Name] = n.Store
+	}
+
+	var rules []store.Mount
+	for _, spec := range splitList(mounts) {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid object store mount: '%s'", spec)
+		}
+		log.Infof("Object store mount: %s -> %s", parts[0], parts[1])
+		rules = append(rules, store.Mount{Prefix: parts[0], Backend: parts[1]})
+	}
+
+	return store.NewRouter(fallback, byName, rules)
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newDatabase returns the Database selected by the database flag
+func newDatabase(base *base.Base, dbType, dbPath string) (db.Database, error) {
+
+	switch dbType {
+	case "postgres":
+		if err := base.DB.AutoMigrate(db.Blob{}, db.Upload{}, db.Chunk{}).Error; err != nil {
+			return nil, err
+		}
+		return db.NewStandardDB(base.DB), nil
+	case "sqlite":
+		log.Infof("SQLite database: %s", dbPath)
+		return db.NewSQLiteDB(dbPath)
+	case "memory":
+		log.Warn("Using in-memory database; blob metadata is lost on exit")
+		return db.NewMemoryDB(), nil
+	default:
+		return nil, fmt.Errorf("Unknown database type: '%s'", dbType)
+	}
+}
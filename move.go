@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/labstack/echo"
+	"github.com/myzie/blobs/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// Move changes the path of a blob, or of every blob beneath a path. Objects
+// are keyed by blob ID and do not record the path, so only the database
+// changes and no object is rewritten.
+func (svc *blobsService) Move(c echo.Context) error {
+
+	// Require application/json
+	contentType := c.Request().Header.Get("Content-Type")
+	if !isJSON(contentType) {
+		return c.JSON(BadRequest, errorView{"Only JSON is accepted"})
+	}
+
+	var attrs BlobMoveAttributes
+	if err := c.Bind(&attrs); err != nil {
+		return c.JSON(BadRequest, errorView{"Failed to bind attributes"})
+	}
+	attrs.Normalize()
+	if attrs.From == attrs.To {
+		return c.JSON(BadRequest, errorView{"Source and destination are the same"})
+	}
+
+	var moved []*db.Blob
+	if attrs.Prefix {
+		blobs, err := svc.Database.Move(attrs.From, attrs.To)
+		if err != nil {
+			return databaseError(c, err, "Failed to move blobs")
+		}
+		moved = blobs
+	} else {
+		blob, err := svc.Database.Get(attrs.From)
+		if err != nil {
+			return databaseError(c, err, "Failed to look up Blob")
+		}
+		if !newPreconditions(c.Request().Header).allowWrite(blob) {
+			return c.JSON(PreconditionFailed, errorView{"Precondition failed"})
+		}
+		if blob.PendingRevision != "" {
+			return databaseError(c, db.ErrBusy, "Failed to move blob")
+		}
+		blob.Rename(attrs.To)
+		if err := svc.Database.Update(blob, []string{"path", "object_key"}); err != nil {
+			return databaseError(c, err, "Failed to move blob")
+		}
+		c.Response().Header().Set("ETag", etag(blob))
+		moved = []*db.Blob{blob}
+	}
+
+	views := make([]*blobView, 0, len(moved))
+	for _, blob := range moved {
+		views = append(views, newBlobView(blob))
+	}
+
+	log.WithFields(log.Fields{
+		"from":  attrs.From,
+		"to":    attrs.To,
+		"count": len(moved),
+	}).Info("Blobs moved")
+
+	return c.JSON(OK, views)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// metaSuffix addresses the metadata sub-resource of a blob, e.g. a GET of
+// /blobs/docs/report.pdf/meta returns the metadata of /docs/report.pdf
+const metaSuffix = "/meta"
+
+// wantsMetadata returns true if a GET request asks for blob metadata rather
+// than blob content. That is the case when application/json is the most
+// preferred type in the Accept header. The deprecated practice of sending
+// "Content-Type: application/json" is also honoured; deprecated reports
+// whether that was the reason.
+func wantsMetadata(req *http.Request) (metadata bool, deprecated bool) {
+	if preferredType(req.Header.Get("Accept")) == "application/json" {
+		return true, false
+	}
+	if isJSON(req.Header.Get("Content-Type")) {
+		return true, true
+	}
+	return false, false
+}
+
+// isJSON returns true if a Content-Type header declares JSON. Parameters
+// such as the charset are ignored.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// preferredType returns the media range with the highest quality value in
+// an Accept header. The first is returned when several share the highest
+// value. An empty string is returned if the header is empty.
+func preferredType(accept string) string {
+	var best string
+	bestQ := 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/labstack/echo"
+	"github.com/myzie/base"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// Presign issues a URL for transferring blob content directly to or from
+// the object store. A GET URL downloads the blob; a PUT URL uploads a new
+// revision, which is committed by a subsequent call to Commit. Stores that
+// can not presign are handled by returning the URL of the equivalent
+// request to this service instead.
+func (svc *blobsService) Presign(c echo.Context) error {
+
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(*base.JWTClaims)
+	userID := claims.Subject
+
+	// Require application/json
+	contentType := c.Request().Header.Get("Content-Type")
+	if !isJSON(contentType) {
+		return c.JSON(BadRequest, errorView{"Only JSON is accepted"})
+	}
+
+	var attrs BlobPresignAttributes
+	if err := c.Bind(&attrs); err != nil {
+		return c.JSON(BadRequest, errorView{"Failed to bind attributes"})
+	}
+	attrs.Normalize()
+
+	switch attrs.Method {
+	case "GET":
+		return svc.presignGet(c, attrs.Path)
+	case "PUT":
+		return svc.presignPut(c, userID, attrs.Path)
+	default:
+		return c.JSON(BadRequest, errorView{"Invalid method"})
+	}
+}
+
+func (svc *blobsService) presignGet(c echo.Context, path string) error {
+
+	blob, err := svc.Database.Get(path)
+	if err != nil {
+		return databaseError(c, err, "Failed to look up Blob")
+	}
+	if !blob.Committed() {
+		return c.JSON(Conflict, errorView{"Blob upload incomplete"})
+	}
+	svc.recordAccess(blob)
+	if svc.restoring(blob) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(restoreRetryAfter))
+		return c.JSON(ServiceUnavailable, errorView{"Blob restoring"})
+	}
+
+	// Compressed content is decompressed by the service for clients that
+	// do not accept its encoding, and chunked content is reassembled by it,
+	// so neither is served directly
+	if blob.Encoding != "" || blob.Chunked {
+		return c.JSON(OK, presignView{Method: "GET", URL: blobURL(path), Proxied: true})
+	}
+
+	// Have the store respond with the headers this service would send
+	contentType := blobContentType(blob)
+	opts := store.PresignOptions{
+		Expiry:             svc.PresignExpiry,
+		ContentType:        contentType,
+		ContentDisposition: contentDisposition(blob, svc.InlineTypes.Allows(contentType)),
+	}
+
+	u, err := svc.Store.PresignGet(c.Request().Context(), objectKey(blob), opts)
+	if err == store.ErrNotSupported {
+		return c.JSON(OK, presignView{Method: "GET", URL: blobURL(path), Proxied: true})
+	}
+	if err != nil {
+		log.WithError(err).WithField("key", objectKey(blob)).Error("Failed to presign URL")
+		return c.JSON(InternalServerError, errorView{"Failed to presign URL"})
+	}
+	return c.JSON(OK, presignView{
+		Method:    "GET",
+		URL:       u.String(),
+		ExpiresAt: time.Now().Add(svc.PresignExpiry),
+	})
+}
+
+func (svc *blobsService) presignPut(c echo.Context, userID, path string) error {
+
+	blob, err := svc.beginUpload(&upload{
+		UserID: userID,
+		Path:   path,
+		Size:   -1,
+
+		Preconditions: newPreconditions(c.Request().Header),
+	})
+	if err != nil {
+		return serviceError(c, err, "Upload failed")
+	}
+
+	opts := store.PresignOptions{Expiry: svc.PresignExpiry}
+	u, err := svc.Store.PresignPut(c.Request().Context(), pendingObjectKey(blob), opts)
+	if err != nil {
+		svc.cancelUpload(blob)
+		if err == store.ErrNotSupported {
+			return c.JSON(OK, presignView{Method: "PUT", URL: blobURL(path), Proxied: true})
+		}
+		log.WithError(err).WithField("key", pendingObjectKey(blob)).Error("Failed to presign URL")
+		return c.JSON(InternalServerError, errorView{"Failed to presign URL"})
+	}
+	return c.JSON(OK, presignView{
+		Method:    "PUT",
+		URL:       u.String(),
+		ExpiresAt: time.Now().Add(svc.PresignExpiry),
+		Revision:  blob.PendingRevision,
+	})
+}
+
+// Commit completes an upload to a presigned URL. The uploaded object is
+// checked with a stat call and read back to record its digest and verify
+// any hash given before the blob is switched over to it.
+func (svc *blobsService) Commit(c echo.Context) error {
+
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(*base.JWTClaims)
+	userID := claims.Subject
+
+	// Require application/json
+	contentType := c.Request().Header.Get("Content-Type")
+	if !isJSON(contentType) {
+		return c.JSON(BadRequest, errorView{"Only JSON is accepted"})
+	}
+
+	var attrs BlobCommitAttributes
+	if err := c.Bind(&attrs); err != nil {
+		return c.JSON(BadRequest, errorView{"Failed to bind attributes"})
+	}
+	attrs.Normalize()
+	if err := attrs.Validate(svc.SizeLimit); err != nil {
+		return c.JSON(BadRequest, errorView{err.Error()})
+	}
+	propJSON, err := attrs.MarshalProperties()
+	if err != nil {
+		return c.JSON(BadRequest, errorView{"JSON error"})
+	}
+	var sum *checksum
+	if attrs.Hash != "" {
+		if sum, err = parseChecksum(attrs.Hash); err != nil {
+			return c.JSON(BadRequest, errorView{err.Error()})
+		}
+	}
+
+	blob, err := svc.Database.Get(attrs.Path)
+	if err != nil {
+		return databaseError(c, err, "Failed to look up Blob")
+	}
+	if attrs.Revision == "" || blob.PendingRevision != attrs.Revision {
+		return c.JSON(Conflict, errorView{"Upload superseded"})
+	}
+	key := pendingObjectKey(blob)
+	ctx := c.Request().Context()
+
+	// The upload may be retried until the URL expires, so a missing object
+	// leaves the upload pending
+	info, err := svc.Store.Stat(ctx, key)
+	if err == store.ErrNotFound {
+		return c.JSON(Conflict, errorView{"Object not uploaded"})
+	}
+	if err != nil {
+		log.WithError(err).WithField("key", key).Error("Failed to stat object")
+		return c.JSON(InternalServerError, errorView{"Failed to verify object"})
+	}
+	if info.Size > svc.SizeLimit {
+		svc.abandon(blob)
+		return c.JSON(RequestTooLarge, errorView{"File too large"})
+	}
+	if attrs.Size > 0 && attrs.Size != info.Size {
+		svc.abandon(blob)
+		return c.JSON(BadRequest, errorView{"File size does not match size attribute"})
+	}
+	up := &upload{
+		UserID:      userID,
+		Path:        attrs.Path,
+		Size:        info.Size,
+		Properties:  postgres.Jsonb{RawMessage: json.RawMessage(propJSON)},
+		ContentType: attrs.ContentType,
+	}
+	if up.ContentType == "" {
+		up.ContentType = info.ContentType
+	}
+	sha256, contentType, ok, err := svc.inspectObject(ctx, key, up.ContentType, sum)
+	if err != nil {
+		log.WithError(err).WithField("key", key).Error("Failed to verify object")
+		return c.JSON(InternalServerError, errorView{"Failed to verify object"})
+	}
+	if !ok {
+		log.WithField("id", blob.ID).Warn("Upload hash mismatch")
+		svc.abandon(blob)
+		return c.JSON(BadRequest, errorView{"Hash mismatch"})
+	}
+	opts := objectOptions(blob, blob.PendingRevision, contentType)
+	if err := svc.Store.Copy(ctx, key, key, opts); err != nil {
+		log.WithError(err).WithField("key", key).Warn("Failed to update object metadata")
+	}
+
+	blob, err = svc.commitUpload(up, blob, info.Size, sha256, contentType)
+	if err != nil {
+		return serviceError(c, err, "Upload failed")
+	}
+	c.Response().Header().Set("ETag", etag(blob))
+	return c.JSON(OK, newBlobView(blob))
+}
+
+// inspectObject reads a stored object back to compute its SHA-256 digest,
+// check it against a client supplied checksum and resolve its content type
+// from the type declared for it and its first bytes. The ETag of the object
+// is not relied upon, as it is not the MD5 of the content when the store
+// encrypts objects with customer or KMS keys.
+func (svc *blobsService) inspectObject(ctx context.Context, key, declared string, sum *checksum) (sha256, contentType string, ok bool, err error) {
+
+	obj, err := svc.Store.Get(ctx, key, store.GetOptions{})
+	if err != nil {
+		return "", "", false, err
+	}
+	defer obj.Close()
+	up := &upload{ContentType: declared, Reader: obj}
+	if contentType, err = sniffUpload(up); err != nil {
+		return "", "", false, err
+	}
+	digest := newDigester(sum)
+	if _, err := io.Copy(digest, up.Reader); err != nil {
+		return "", "", false, err
+	}
+	return digest.SHA256(), contentType, digest.Verify(), nil
+}
+
+// cancelUpload withdraws an upload that was begun but never given content.
+// A blob created for the upload is deleted again rather than being marked
+// as failed.
+func (svc *blobsService) cancelUpload(blob *db.Blob) {
+	if blob.State != db.StatePending || blob.Revision != "" {
+		svc.abandon(blob)
+		return
+	}
+	if err := svc.Database.Delete(blob); err != nil {
+		log.WithError(err).WithField("id", blob.ID).Error("Failed to cancel upload")
+	}
+}
+
+// blobURL returns the URL of a blob on this service
+func blobURL(path string) string {
+	return (&url.URL{Path: "/blobs" + path}).String()
+}
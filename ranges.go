@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// errUnsatisfiableRange is returned when none of the requested ranges
+// overlap the content
+var errUnsatisfiableRange = errors.New("Range not satisfiable")
+
+// byteRange is a range of content with an inclusive end offset
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// Length of the range in bytes
+func (r byteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+// ContentRange returns the Content-Range header value for the range
+func (r byteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// parseRange parses a Range header as described by RFC 7233 for content of
+// the given size. Ranges that start beyond the end of the content are
+// dropped; errUnsatisfiableRange is returned if none are left.
+func parseRange(header string, size int64) ([]byteRange, error) {
+
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, fmt.Errorf("Invalid range: '%s'", header)
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid range: '%s'", header)
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the final N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid range: '%s'", header)
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{Start: size - n, End: size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("Invalid range: '%s'", header)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{Start: start, End: size - 1}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, fmt.Errorf("Invalid range: '%s'", header)
+				}
+				if end < size-1 {
+					r.End = end
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+
+	// Requests for more bytes than the content holds, via overlapping
+	// ranges, are treated as invalid so that the whole content is sent
+	var total int64
+	for _, r := range ranges {
+		total += r.Length()
+	}
+	if total > size {
+		return nil, fmt.Errorf("Invalid range: '%s'", header)
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches returns true if the If-Range precondition, if present,
+// allows a partial response for the blob
+func ifRangeMatches(value string, blob *db.Blob) bool {
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, `"`) {
+		return value == etag(blob)
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return false
+	}
+	return lastModified(blob).Equal(t)
+}
+
+// getRange fetches one range of a blob's object from the store
+func (svc *blobsService) getRange(ctx context.Context, blob *db.Blob, r byteRange) (io.ReadCloser, error) {
+	if blob.Chunked {
+		return svc.readChunks(ctx, blob, r.Start, r.Length())
+	}
+	if blob.Encoding != "" {
+		return svc.readEncodedRange(ctx, blob, r)
+	}
+	return svc.Store.Get(ctx, objectKey(blob), store.GetOptions{Offset: r.Start, Length: r.Length()})
+}
+
+// streamRanges responds with the requested ranges of a blob as partial
+// content. A single range is sent as is; several are sent as a
+// multipart/byteranges document.
+func (svc *blobsService) streamRanges(c echo.Context, blob *db.Blob, contentType string, ranges []byteRange) error {
+
+	ctx := c.Request().Context()
+	header := c.Response().Header()
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		obj, err := svc.getRange(ctx, blob, r)
+		if err != nil {
+			log.WithError(err).Error("Failed to get object range")
+			return c.JSON(InternalServerError, errorView{"Failed to get object"})
+		}
+		defer obj.Close()
+		header.Set("Content-Range", r.ContentRange(blob.Size))
+		header.Set("Content-Length", strconv.FormatInt(r.Length(), 10))
+		return c.Stream(PartialContent, contentType, obj)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for _, r := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {contentType},
+				"Content-Range": {r.ContentRange(blob.Size)},
+			})
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			obj, err := svc.getRange(ctx, blob, r)
+			if err != nil {
+				log.WithError(err).Error("Failed to get object range")
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(part, obj)
+			obj.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		mw.Close()
+		pw.Close()
+	}()
+	defer pr.Close()
+
+	return c.Stream(PartialContent, "multipart/byteranges; boundary="+mw.Boundary(), pr)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// newReplicator returns a store.Replicator keeping copies of the objects of
+// the default store in the stores described by the object-store-replicas
+// flag. The default store is the preferred replica for reads.
+func newReplicator(stores *storeFactory, primary store.ObjectStore, replicas, mode string, quorum int, queueDir string) (*store.Replicator, error) {
+
+	var async bool
+	switch mode {
+	case "sync":
+	case "async":
+		async = true
+	default:
+		return nil, fmt.Errorf("Unknown replication mode: '%s'", mode)
+	}
+
+	named, err := newNamedStores(stores, replicas)
+	if err != nil {
+		return nil, err
+	}
+	opts := store.ReplicatorOpts{
+		Replicas: []store.Replica{{Name: "default", Store: primary}},
+		Async:    async,
+		Quorum:   quorum,
+	}
+	for _, n := range named {
+		opts.Replicas = append(opts.Replicas, store.Replica{Name: n.Name, Store: n.Store})
+	}
+	if opts.Queue, err = store.NewFileQueue(queueDir); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"replicas": len(opts.Replicas),
+		"mode":     mode,
+		"queue":    queueDir,
+	}).Info("Replicating object store")
+
+	return store.NewReplicator(opts)
+}
+
+// runReplication periodically carries out queued replica writes, logging
+// replicas as their health changes
+func runReplication(replicator *store.Replicator, interval time.Duration) {
+	healthy := map[string]bool{}
+	for range time.Tick(interval) {
+		done, err := replicator.Replicate(context.Background())
+		if err != nil {
+			log.WithError(err).Error("Replication failed")
+		}
+		if done > 0 {
+			log.WithField("count", done).Info("Replicated objects")
+		}
+
+		statuses, err := replicator.Status()
+		if err != nil {
+			log.WithError(err).Error("Failed to read replica status")
+			continue
+		}
+		for _, status := range statuses {
+			was, known := healthy[status.Name]
+			healthy[status.Name] = status.Healthy
+			if known && was == status.Healthy {
+				continue
+			}
+			fields := log.Fields{"replica": status.Name, "pending": status.Pending}
+			if status.Healthy {
+				log.WithFields(fields).Info("Replica healthy")
+			} else {
+				log.WithFields(fields).WithField("error", status.LastError).Warn("Replica unhealthy")
+			}
+		}
+	}
+}
+
+// repairReplicas checks the object of every committed blob held by the
+// default store on each replica, copying it again where it is missing or
+// its size differs. The chunks of chunked blobs are checked along with
+// their manifests. When verify is set the content of every replica is
+// hashed and compared as well.
+func repairReplicas(database db.Database, replicator *store.Replicator, verify bool) error {
+
+	const batchSize = 100
+
+	ctx := context.Background()
+	checked := map[string]bool{}
+	var repaired, failed int
+
+	repair := func(key string, opts store.RepairOptions) bool {
+		checked[key] = true
+		names, err := replicator.Repair(ctx, key, opts)
+		if err != nil {
+			log.WithError(err).WithField("key", key).Error("Failed to repair object")
+			failed++
+			return false
+		}
+		if len(names) > 0 {
+			log.WithFields(log.Fields{
+				"key":      key,
+				"replicas": names,
+			}).Info("Repaired object")
+			repaired++
+		}
+		return true
+	}
+
+	for offset := 0; ; offset += batchSize {
+		blobs, err := database.List(db.Query{
+			Offset:  offset,
+			Limit:   batchSize,
+			OrderBy: "id",
+		})
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			// Objects of other backends are not replicated
+			if !blob.Committed() || blob.Backend != "" || checked[blob.Key()] {
+				continue
+			}
+
+			// Compressed objects and chunk manifests are checked as stored
+			opts := store.RepairOptions{Size: blob.Size}
+			if blob.Encoding != "" || blob.Chunked {
+				opts.Size = blob.StoredSize
+			}
+			if verify && blob.Encoding == "" && !blob.Chunked {
+				opts.SHA256 = blob.SHA256
+			}
+			if !repair(blob.Key(), opts) || !blob.Chunked {
+				continue
+			}
+
+			// Chunks are named by the SHA-256 of their content
+			manifest, err := readManifest(ctx, replicator, blob.Key())
+			if err != nil {
+				log.WithError(err).WithField("key", blob.Key()).Error("Failed to read chunk manifest")
+				failed++
+				continue
+			}
+			for _, chunk := range manifest.Chunks {
+				if checked[chunk.Key] {
+					continue
+				}
+				opts := store.RepairOptions{Size: chunk.Size}
+				if verify {
+					opts.SHA256 = strings.TrimSuffix(chunk.Key, chunkSuffix)
+				}
+				repair(chunk.Key, opts)
+			}
+		}
+		if len(blobs) < batchSize {
+			break
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"checked":  len(checked),
+		"repaired": repaired,
+		"failed":   failed,
+	}).Info("Replica repair complete")
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to repair %d objects", failed)
+	}
+	return nil
+}
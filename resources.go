@@ -4,40 +4,54 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"path/filepath"
 	"strings"
 )
 
-// BlobUploadAttributes contains fields sent by a client in an upload form
+// BlobUploadAttributes contains fields sent by a client in an upload form.
+// The Size and Hash fields are optional and, when set, are checked against
+// the content actually uploaded. ContentType overrides the type given in the
+// header of the uploaded file part.
 type BlobUploadAttributes struct {
-	Path       string                 `json:"path" form:"path"`
-	Hash       string                 `json:"hash" form:"hash"`
-	Size       int64                  `json:"size" form:"size"`
-	Properties map[string]interface{} `json:"properties" form:"properties"`
+	Path        string                 `json:"path" form:"path"`
+	Hash        string                 `json:"hash" form:"hash"`
+	Size        int64                  `json:"size" form:"size"`
+	ContentType string                 `json:"content_type" form:"content_type"`
+	Properties  map[string]interface{} `json:"properties" form:"properties"`
 }
 
 // Normalize attributes to standard form. Especially the path format.
 func (attrs *BlobUploadAttributes) Normalize() {
-	// Normalize by trimming trailing slash; adding preceding slash
-	if strings.HasSuffix(attrs.Path, "/") {
-		attrs.Path = attrs.Path[:len(attrs.Path)-1]
+	attrs.Path = normalizePath(attrs.Path)
+}
+
+// normalizePath trims a trailing slash and adds a preceding slash
+func normalizePath(path string) string {
+	if strings.HasSuffix(path, "/") {
+		path = path[:len(path)-1]
 	}
-	if !strings.HasPrefix(attrs.Path, "/") {
-		attrs.Path = "/" + attrs.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
 	}
+	return path
 }
 
-// Validate checks whether the attributes are valid
-func (attrs *BlobUploadAttributes) Validate() error {
-	if attrs.Size < 1 {
-		return errors.New("File is empty")
+// Validate checks whether the attributes are valid for an upload of at most
+// sizeLimit bytes
+func (attrs *BlobUploadAttributes) Validate(sizeLimit int64) error {
+	if attrs.Size < 0 {
+		return errors.New("Invalid size")
 	}
-	if attrs.Size > MaxUploadSize {
+	if attrs.Size > sizeLimit {
 		return fmt.Errorf("File size too large: %d", attrs.Size)
 	}
 	if !strings.HasPrefix(attrs.Path, "/") {
 		return fmt.Errorf("Invalid path: '%s'", attrs.Path)
 	}
+	if attrs.ContentType != "" && !validContentType(attrs.ContentType) {
+		return fmt.Errorf("Invalid content type: '%s'", attrs.ContentType)
+	}
 	return nil
 }
 
@@ -60,3 +74,79 @@ func (attrs *BlobUploadAttributes) MarshalProperties() ([]byte, error) {
 type BlobProperties struct {
 	Properties map[string]interface{} `json:"properties" form:"properties"`
 }
+
+// BlobMoveAttributes describes a move sent from a client. With Prefix set,
+// every blob beneath the From path is moved along with the blob at it.
+type BlobMoveAttributes struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Prefix bool   `json:"prefix"`
+}
+
+// Normalize the move paths
+func (attrs *BlobMoveAttributes) Normalize() {
+	attrs.From = normalizePath(attrs.From)
+	attrs.To = normalizePath(attrs.To)
+}
+
+// BlobCopyAttributes describes a copy sent from a client
+type BlobCopyAttributes struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Normalize the copy paths
+func (attrs *BlobCopyAttributes) Normalize() {
+	attrs.From = normalizePath(attrs.From)
+	attrs.To = normalizePath(attrs.To)
+}
+
+// propertyHeaderPrefix marks headers that each set one blob property on a
+// raw upload, e.g. "X-Blob-Property-Owner: alice"
+const propertyHeaderPrefix = "X-Blob-Property-"
+
+// headerProperties returns the blob properties given in the headers of a
+// raw upload. The X-Blob-Properties header holds a JSON object of
+// properties, to which X-Blob-Property-<name> headers add string values.
+// Header names are case insensitive so property names are lower cased.
+func headerProperties(header http.Header) (map[string]interface{}, error) {
+	var props map[string]interface{}
+	if value := header.Get("X-Blob-Properties"); value != "" {
+		if err := json.Unmarshal([]byte(value), &props); err != nil {
+			return nil, errors.New("Invalid X-Blob-Properties header")
+		}
+	}
+	for key, values := range header {
+		if !strings.HasPrefix(key, propertyHeaderPrefix) || len(key) == len(propertyHeaderPrefix) {
+			continue
+		}
+		if props == nil {
+			props = map[string]interface{}{}
+		}
+		props[strings.ToLower(key[len(propertyHeaderPrefix):])] = values[0]
+	}
+	return props, nil
+}
+
+// BlobPresignAttributes describes a presigned URL requested by a client.
+// Method is GET to download the blob or PUT to upload new content.
+type BlobPresignAttributes struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+}
+
+// Normalize the path and method
+func (attrs *BlobPresignAttributes) Normalize() {
+	attrs.Path = normalizePath(attrs.Path)
+	attrs.Method = strings.ToUpper(attrs.Method)
+	if attrs.Method == "" {
+		attrs.Method = "GET"
+	}
+}
+
+// BlobCommitAttributes completes an upload to a presigned URL. Revision is
+// the one issued with the URL; the remaining fields are as for an upload.
+type BlobCommitAttributes struct {
+	BlobUploadAttributes
+	Revision string `json:"revision"`
+}
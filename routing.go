@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+)
+
+// route returns the name of the backend that new content for the blob at
+// the path is stored in, or an empty string for the default backend
+func (svc *blobsService) route(path string) string {
+	if router, ok := svc.Store.(store.PathRouter); ok {
+		return router.Route(path)
+	}
+	return ""
+}
+
+// objectKey returns the key of the committed content of a blob, qualified
+// with the backend holding it
+func objectKey(blob *db.Blob) string {
+	return store.BackendKey(blob.Backend, blob.Key())
+}
+
+// pendingObjectKey returns the staging key of the upload in progress on a
+// blob, qualified with the backend it is staged in, or an empty string when
+// there is none
+func pendingObjectKey(blob *db.Blob) string {
+	if blob.PendingRevision == "" {
+		return ""
+	}
+	return store.BackendKey(blob.PendingBackend, blob.PendingKey())
+}
@@ -0,0 +1,335 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// cachePrefix starts the names of cached object files
+const cachePrefix = "object-"
+
+// CacheOpts are provided to configure a CachingStore
+type CacheOpts struct {
+	// Dir holds the cached objects
+	Dir string
+
+	// MaxSize bounds the total size of cached objects. The least recently
+	// read objects are evicted to keep within it.
+	MaxSize int64
+
+	// MaxObjectSize is the size of the largest object cached. Zero allows
+	// objects up to an eighth of MaxSize.
+	MaxObjectSize int64
+}
+
+// CacheStats describe the use of a CachingStore. Reads of objects too large
+// to cache count as misses and are also counted as bypassed.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Bypassed  int64
+	Evictions int64
+	Objects   int
+	Size      int64
+}
+
+// cacheEntry is an object held in the cache
+type cacheEntry struct {
+	Key  string
+	Path string
+	Size int64
+}
+
+// cacheFill is a cache miss being filled. Concurrent misses for the same
+// key wait for a single fill.
+type cacheFill struct {
+	done chan struct{}
+	err  error
+
+	// stale is set if the object changes while it is being filled, in which
+	// case the content read is not cached
+	stale bool
+}
+
+// CachingStore is an ObjectStore decorator that keeps recently read objects
+// in files on local disk. A read that misses fetches the whole object into
+// the cache, so that later reads of it, including ranges, are served from
+// disk. Objects are invalidated when they are written, copied over or
+// removed through the store; changes made to the underlying store by other
+// means are not seen. The cache starts empty.
+type CachingStore struct {
+	store ObjectStore
+	opts  CacheOpts
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	fills   map[string]*cacheFill
+	stats   CacheStats
+}
+
+// NewCachingStore returns a CachingStore in front of the given store
+func NewCachingStore(s ObjectStore, opts CacheOpts) (*CachingStore, error) {
+
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("Cache error: directory not set")
+	}
+	if opts.MaxSize <= 0 {
+		return nil, fmt.Errorf("Cache error: invalid size %d", opts.MaxSize)
+	}
+	if opts.MaxObjectSize <= 0 {
+		opts.MaxObjectSize = opts.MaxSize / 8
+	}
+	if opts.MaxObjectSize > opts.MaxSize {
+		opts.MaxObjectSize = opts.MaxSize
+	}
+	dir, err := filepath.Abs(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Cache error: %s", err.Error())
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Cache error: %s", err.Error())
+	}
+	opts.Dir = dir
+
+	// Objects may have changed since files were cached, so they are dropped
+	stale, err := filepath.Glob(filepath.Join(dir, cachePrefix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("Cache error: %s", err.Error())
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Cache error: %s", err.Error())
+		}
+	}
+
+	return &CachingStore{
+		store:   s,
+		opts:    opts,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		fills:   map[string]*cacheFill{},
+	}, nil
+}
+
+// Stats returns the cache statistics
+func (c *CachingStore) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Get serves an object from the cache. On a miss the whole object is
+// fetched into the cache before any of it is returned, even if only a range
+// was requested, so the first byte of a miss waits for the object to be
+// copied to disk. Objects too large to cache are read through instead.
+func (c *CachingStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+
+	c.mu.Lock()
+	if obj, found, err := c.open(ctx, objectName, opts); found {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return obj, err
+	}
+	c.stats.Misses++
+	fill, busy := c.fills[objectName]
+	if !busy {
+		fill = &cacheFill{done: make(chan struct{})}
+		c.fills[objectName] = fill
+	}
+	c.mu.Unlock()
+
+	if busy {
+		select {
+		case <-fill.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		c.fill(ctx, objectName, fill)
+	}
+	if fill.err == ErrNotFound || (!busy && fill.err != nil) {
+		return nil, fill.err
+	}
+
+	c.mu.Lock()
+	obj, found, err := c.open(ctx, objectName, opts)
+	c.mu.Unlock()
+	if found {
+		return obj, err
+	}
+
+	// The object was too large to cache, was invalidated while it was being
+	// filled, or the fill of another reader failed
+	return c.store.Get(ctx, objectName, opts)
+}
+
+// open opens a cached object, returning false if it is not cached. The
+// caller holds the lock, so that the file is not evicted before it is
+// opened.
+func (c *CachingStore) open(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, bool, error) {
+
+	el, found := c.entries[objectName]
+	if !found {
+		return nil, false, nil
+	}
+	entry := el.Value.(*cacheEntry)
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		c.evict(el)
+		return nil, false, nil
+	}
+	c.lru.MoveToFront(el)
+
+	start, length, ok, err := objectRange(opts, entry.Size)
+	if err != nil {
+		f.Close()
+		return nil, true, err
+	}
+	if !ok {
+		return &fileReader{Reader: f, File: f, Context: ctx}, true, nil
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, true, err
+	}
+	return &fileReader{Reader: io.LimitReader(f, length), File: f, Context: ctx}, true, nil
+}
+
+// fill fetches an object into the cache, then releases the readers waiting
+// for it
+func (c *CachingStore) fill(ctx context.Context, objectName string, fill *cacheFill) {
+
+	entry, err := c.fetch(ctx, objectName)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fills, objectName)
+	fill.err = err
+	close(fill.done)
+
+	if entry == nil {
+		if err == nil {
+			c.stats.Bypassed++
+		}
+		return
+	}
+	if fill.stale {
+		os.Remove(entry.Path)
+		return
+	}
+	if el, found := c.entries[objectName]; found {
+		c.evict(el)
+	}
+	c.entries[objectName] = c.lru.PushFront(entry)
+	c.stats.Objects++
+	c.stats.Size += entry.Size
+	for c.stats.Size > c.opts.MaxSize {
+		c.evict(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// fetch copies an object into a cache file, returning nil if it is too
+// large to cache
+func (c *CachingStore) fetch(ctx context.Context, objectName string) (*cacheEntry, error) {
+
+	info, err := c.store.Stat(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size > c.opts.MaxObjectSize {
+		return nil, nil
+	}
+
+	obj, err := c.store.Get(ctx, objectName, GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	f, err := ioutil.TempFile(c.opts.Dir, cachePrefix)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(f, io.LimitReader(obj, c.opts.MaxObjectSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || n > c.opts.MaxObjectSize {
+		// Objects replaced by larger ones since the stat are not cached
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &cacheEntry{Key: objectName, Path: f.Name(), Size: n}, nil
+}
+
+// evict removes an entry from the cache. The caller holds the lock.
+func (c *CachingStore) evict(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.Key)
+	c.stats.Objects--
+	c.stats.Size -= entry.Size
+	os.Remove(entry.Path)
+}
+
+// invalidate drops an object that has changed from the cache, along with
+// any content of it being filled
+func (c *CachingStore) invalidate(objectName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[objectName]; found {
+		c.evict(el)
+	}
+	if fill, found := c.fills[objectName]; found {
+		fill.stale = true
+	}
+}
+
+func (c *CachingStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (int64, error) {
+	defer c.invalidate(objectName)
+	return c.store.Put(ctx, objectName, reader, size, opts)
+}
+
+func (c *CachingStore) Remove(ctx context.Context, objectName string) error {
+	defer c.invalidate(objectName)
+	return c.store.Remove(ctx, objectName)
+}
+
+func (c *CachingStore) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	return c.store.Stat(ctx, objectName)
+}
+
+func (c *CachingStore) Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error {
+	defer c.invalidate(dstName)
+	return c.store.Copy(ctx, srcName, dstName, opts)
+}
+
+// Compose assembles the object in the underlying store, if it can
+func (c *CachingStore) Compose(ctx context.Context, dstName string, srcNames []string, opts PutOptions) error {
+	composer, ok := c.store.(Composer)
+	if !ok {
+		return ErrNotSupported
+	}
+	defer c.invalidate(dstName)
+	return composer.Compose(ctx, dstName, srcNames, opts)
+}
+
+func (c *CachingStore) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	return c.store.List(ctx, opts)
+}
+
+func (c *CachingStore) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return c.store.PresignGet(ctx, objectName, opts)
+}
+
+func (c *CachingStore) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return c.store.PresignPut(ctx, objectName, opts)
+}
@@ -0,0 +1,229 @@
+package store
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedStore is an ObjectStore counting reads of content, which it holds
+// up while a gate is set
+type gatedStore struct {
+	ObjectStore
+
+	mu    sync.Mutex
+	gets  int
+	gate  chan struct{}
+	ready chan struct{}
+}
+
+func (s *gatedStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	obj, err := s.ObjectStore.Get(ctx, objectName, opts)
+	s.mu.Lock()
+	s.gets++
+	gate, ready := s.gate, s.ready
+	s.mu.Unlock()
+	if gate != nil {
+		ready <- struct{}{}
+		<-gate
+	}
+	return obj, err
+}
+
+// hold sets the gate, returning a channel signalled as reads reach it
+func (s *gatedStore) hold() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gate, s.ready = make(chan struct{}), make(chan struct{}, 100)
+	return s.ready
+}
+
+// release lets reads held at the gate through, and clears it
+func (s *gatedStore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.gate)
+	s.gate = nil
+}
+
+func (s *gatedStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func newTestCache(t *testing.T, opts CacheOpts) (*CachingStore, *gatedStore, func()) {
+	dir, err := ioutil.TempDir("", "blobs-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &gatedStore{ObjectStore: NewMemoryObjectStore()}
+	opts.Dir = dir
+	c, err := NewCachingStore(inner, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, inner, func() { os.RemoveAll(dir) }
+}
+
+func readAll(s ObjectStore, name string, opts GetOptions) (string, error) {
+	obj, err := s.Get(context.Background(), name, opts)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	data, err := ioutil.ReadAll(obj)
+	return string(data), err
+}
+
+func putString(t *testing.T, s ObjectStore, name, content string) {
+	if _, err := s.Put(context.Background(), name, strings.NewReader(content), -1, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachingStoreConcurrentMisses(t *testing.T) {
+	c, inner, cleanup := newTestCache(t, CacheOpts{MaxSize: 1 << 20})
+	defer cleanup()
+	putString(t, c, "a", "content")
+
+	ready := inner.hold()
+	const readers = 5
+	results := make(chan string, readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			data, err := readAll(c, "a", GetOptions{})
+			if err != nil {
+				data = err.Error()
+			}
+			results <- data
+		}()
+	}
+	<-ready
+	for deadline := time.Now().Add(5 * time.Second); c.Stats().Misses < readers; {
+		if time.Now().After(deadline) {
+			t.Fatal("Readers did not all miss")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	inner.release()
+
+	for i := 0; i < readers; i++ {
+		if data := <-results; data != "content" {
+			t.Errorf("Read %q", data)
+		}
+	}
+	if n := inner.count(); n != 1 {
+		t.Errorf("Concurrent misses read the object %d times, expected once", n)
+	}
+
+	if data, err := readAll(c, "a", GetOptions{Offset: 3, Length: 2}); err != nil || data != "te" {
+		t.Errorf("Read range %q, %v", data, err)
+	}
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Objects != 1 || stats.Size != 7 || inner.count() != 1 {
+		t.Errorf("Unexpected stats %+v after %d reads", stats, inner.count())
+	}
+}
+
+func TestCachingStoreStaleFill(t *testing.T) {
+	c, inner, cleanup := newTestCache(t, CacheOpts{MaxSize: 1 << 20})
+	defer cleanup()
+	putString(t, c, "a", "one")
+
+	// The object is replaced while the miss is being filled
+	ready := inner.hold()
+	result := make(chan string, 1)
+	go func() {
+		data, _ := readAll(c, "a", GetOptions{})
+		result <- data
+	}()
+	<-ready
+	putString(t, c, "a", "two")
+	inner.release()
+	if data := <-result; data != "two" {
+		t.Errorf("Read %q, expected the content now stored", data)
+	}
+
+	// The content filled is not kept
+	if stats := c.Stats(); stats.Objects != 0 {
+		t.Errorf("Stale content cached: %+v", stats)
+	}
+	if data, err := readAll(c, "a", GetOptions{}); err != nil || data != "two" {
+		t.Errorf("Read %q, %v after the object changed", data, err)
+	}
+	if data, err := readAll(c, "a", GetOptions{}); err != nil || data != "two" {
+		t.Errorf("Read %q, %v from the cache", data, err)
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCachingStoreEviction(t *testing.T) {
+	c, inner, cleanup := newTestCache(t, CacheOpts{MaxSize: 100, MaxObjectSize: 40})
+	defer cleanup()
+
+	content := strings.Repeat("x", 30)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		putString(t, c, name, content)
+	}
+	putString(t, c, "large", strings.Repeat("x", 50))
+
+	// a, b and c fill the cache; reading a makes b the least recently read,
+	// so it makes way for d
+	for _, name := range []string{"a", "b", "c", "a", "d"} {
+		if _, err := readAll(c, name, GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 4 || stats.Evictions != 1 || stats.Objects != 3 || stats.Size != 90 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	gets := inner.count()
+	for _, name := range []string{"a", "c", "d"} {
+		if _, err := readAll(c, name, GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inner.count() != gets {
+		t.Error("Expected the most recently read objects to stay cached")
+	}
+
+	// Objects too large to cache are read through
+	for i := 0; i < 2; i++ {
+		if data, err := readAll(c, "large", GetOptions{}); err != nil || len(data) != 50 {
+			t.Fatalf("Read %d bytes, %v", len(data), err)
+		}
+	}
+	if stats = c.Stats(); stats.Bypassed != 2 || stats.Objects != 3 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	files, err := filepath.Glob(filepath.Join(c.opts.Dir, cachePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != stats.Objects {
+		t.Errorf("%d cache files held for %d objects", len(files), stats.Objects)
+	}
+
+	// Removing an object drops it from the cache
+	if err := c.Remove(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAll(c, "a", GetOptions{}); err != ErrNotFound {
+		t.Errorf("Expected a removed object to be gone, got %v", err)
+	}
+	if stats = c.Stats(); stats.Objects != 2 || stats.Size != 60 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// gearTable holds the random values rolled into the chunker fingerprint for
+// each byte. It is generated from a fixed seed; changing it moves every
+// chunk boundary and so defeats deduplication against stored chunks.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ChunkerOpts bound the size of the chunks content is split into
+type ChunkerOpts struct {
+	MinSize int
+	AvgSize int // Rounded down to a power of two
+	MaxSize int
+}
+
+// DefaultChunkerOpts returns chunk bounds around the given average size,
+// with chunks between a quarter and four times its size
+func DefaultChunkerOpts(avgSize int) ChunkerOpts {
+	return ChunkerOpts{MinSize: avgSize / 4, AvgSize: avgSize, MaxSize: avgSize * 4}
+}
+
+// Chunker splits content into chunks at boundaries chosen by the content
+// itself, using the FastCDC algorithm. An edit to the content only moves
+// the boundaries of the chunks near it, so similar content shares most of
+// its chunks.
+type Chunker struct {
+	reader io.Reader
+	opts   ChunkerOpts
+
+	// Chunks shorter than the average size are cut where the fingerprint
+	// has the bits of maskS clear, and longer ones where it has the fewer
+	// bits of maskL clear, which normalizes chunk sizes
+	maskS, maskL uint64
+
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+// NewChunker returns a Chunker splitting the content read from r
+func NewChunker(r io.Reader, opts ChunkerOpts) (*Chunker, error) {
+	if opts.MinSize <= 0 || opts.AvgSize <= opts.MinSize || opts.MaxSize <= opts.AvgSize {
+		return nil, fmt.Errorf("Invalid chunk sizes: min %d avg %d max %d", opts.MinSize, opts.AvgSize, opts.MaxSize)
+	}
+	avgBits := bits.Len(uint(opts.AvgSize)) - 1
+	return &Chunker{
+		reader: r,
+		opts:   opts,
+		maskS:  topBits(avgBits + 1),
+		maskL:  topBits(avgBits - 1),
+		buf:    make([]byte, 2*opts.MaxSize),
+	}, nil
+}
+
+// topBits returns a mask of the n most significant bits. The fingerprint
+// shifts left with every byte, so its top bits depend on the most bytes.
+func topBits(n int) uint64 {
+	return ^uint64(0) << uint(64-n)
+}
+
+// Next returns the next chunk, or io.EOF once all content has been
+// returned. The chunk is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+
+	// Keep at least a maximum size chunk buffered
+	if c.end-c.start < c.opts.MaxSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		n, err := io.ReadFull(c.reader, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *Chunker) cut(data []byte) int {
+
+	n := len(data)
+	if n <= c.opts.MinSize {
+		return n
+	}
+	if n > c.opts.MaxSize {
+		n = c.opts.MaxSize
+	}
+	normal := c.opts.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.opts.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
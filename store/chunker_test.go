@@ -0,0 +1,95 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// split returns the chunks of the content
+func split(t *testing.T, content []byte, opts ChunkerOpts) [][]byte {
+	c, err := NewChunker(bytes.NewReader(content), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	opts := DefaultChunkerOpts(64 << 10)
+
+	chunks := split(t, content, opts)
+	if !bytes.Equal(bytes.Join(chunks, nil), content) {
+		t.Fatal("Chunks do not reassemble the content")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > opts.MaxSize {
+			t.Errorf("Chunk %d holds %d bytes, more than %d", i, len(chunk), opts.MaxSize)
+		}
+		if len(chunk) < opts.MinSize && i != len(chunks)-1 {
+			t.Errorf("Chunk %d holds %d bytes, less than %d", i, len(chunk), opts.MinSize)
+		}
+	}
+	avg := len(content) / len(chunks)
+	if avg < opts.AvgSize/2 || avg > opts.AvgSize*2 {
+		t.Errorf("Average chunk size %d, expected around %d", avg, opts.AvgSize)
+	}
+}
+
+func TestChunkerEdit(t *testing.T) {
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(2)).Read(content)
+	opts := DefaultChunkerOpts(64 << 10)
+
+	edited := append(append(append([]byte(nil), content[:1<<20]...), "inserted"...), content[1<<20:]...)
+	original := map[string]bool{}
+	for _, chunk := range split(t, content, opts) {
+		original[string(chunk)] = true
+	}
+	chunks := split(t, edited, opts)
+	var changed int
+	for _, chunk := range chunks {
+		if !original[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed by an insertion", changed, len(chunks))
+	}
+}
+
+func TestChunkerSmallContent(t *testing.T) {
+	opts := DefaultChunkerOpts(64 << 10)
+	if chunks := split(t, nil, opts); len(chunks) != 0 {
+		t.Errorf("Expected no chunks of empty content, got %d", len(chunks))
+	}
+	chunks := split(t, []byte("small"), opts)
+	if len(chunks) != 1 || string(chunks[0]) != "small" {
+		t.Errorf("Expected one chunk of small content, got %q", chunks)
+	}
+}
+
+func TestChunkerInvalidOpts(t *testing.T) {
+	for _, opts := range []ChunkerOpts{
+		{},
+		{MinSize: 16, AvgSize: 8, MaxSize: 32},
+		{MinSize: 8, AvgSize: 16, MaxSize: 16},
+	} {
+		if _, err := NewChunker(bytes.NewReader(nil), opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings objects may be compressed with. The names are those
+// used in HTTP Content-Encoding headers.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// ValidEncoding returns true if objects can be compressed with the encoding
+func ValidEncoding(encoding string) bool {
+	return encoding == EncodingGzip || encoding == EncodingZstd
+}
+
+// Compress returns a reader of the content read from r, compressed with the
+// given encoding. The content is compressed as it is read. Closing the
+// returned reader stops compression early.
+func Compress(r io.Reader, encoding string) (io.ReadCloser, error) {
+
+	var newWriter func(w io.Writer) (io.WriteCloser, error)
+	switch encoding {
+	case EncodingGzip:
+		newWriter = func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		}
+	case EncodingZstd:
+		newWriter = func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown encoding: '%s'", encoding)
+	}
+
+	pr, pw := io.Pipe()
+	cw, err := newWriter(pw)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(cw, r)
+		if closeErr := cw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// Decompress returns a reader of the content of an object compressed with
+// the given encoding. Closing it closes the object.
+func Decompress(obj io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		zr, err := gzip.NewReader(obj)
+		if err != nil {
+			obj.Close()
+			return nil, err
+		}
+		return &decompressor{Reader: zr, obj: obj}, nil
+	case EncodingZstd:
+		zr, err := zstd.NewReader(obj, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			obj.Close()
+			return nil, err
+		}
+		return &decompressor{Reader: zr, obj: obj, release: zr.Close}, nil
+	default:
+		obj.Close()
+		return nil, fmt.Errorf("Unknown encoding: '%s'", encoding)
+	}
+}
+
+// decompressor reads decompressed content from an object
+type decompressor struct {
+	io.Reader
+	obj     io.ReadCloser
+	release func()
+}
+
+func (d *decompressor) Close() error {
+	if d.release != nil {
+		d.release()
+	}
+	return d.obj.Close()
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible content "), 4096)
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			r, err := Compress(bytes.NewReader(content), encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(content) {
+				t.Errorf("Compressed to %d bytes from %d", len(compressed), len(content))
+			}
+
+			obj, err := Decompress(ioutil.NopCloser(bytes.NewReader(compressed)), encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer obj.Close()
+			decompressed, err := ioutil.ReadAll(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, content) {
+				t.Errorf("Decompressed %d bytes, expected the original %d", len(decompressed), len(content))
+			}
+		})
+	}
+}
+
+func TestCompressUnknownEncoding(t *testing.T) {
+	if ValidEncoding("br") {
+		t.Error("Expected br to be invalid")
+	}
+	if _, err := Compress(bytes.NewReader(nil), "br"); err == nil {
+		t.Error("Expected an error compressing with br")
+	}
+	if _, err := Decompress(ioutil.NopCloser(bytes.NewReader(nil)), "br"); err == nil {
+		t.Error("Expected an error decompressing br")
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		obj, err := Decompress(ioutil.NopCloser(bytes.NewReader([]byte("not compressed"))), encoding)
+		if err != nil {
+			continue
+		}
+		if _, err := ioutil.ReadAll(obj); err == nil {
+			t.Errorf("Expected an error reading corrupt %s content", encoding)
+		}
+		obj.Close()
+	}
+}
@@ -0,0 +1,520 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultChunkSize is the amount of plaintext encrypted as one chunk. Range
+// reads fetch and decrypt whole chunks.
+const DefaultChunkSize = 64 * 1024
+
+// envelopePrefix is prepended to the name of an object to name the object
+// holding its wrapped data key. Envelopes are kept apart from the objects
+// they describe, and other objects may not be given names beneath it.
+const envelopePrefix = ".envelopes/"
+
+// tagSize is the size of the GCM authentication tag of each chunk
+const tagSize = 16
+
+// errEnvelopeName is returned when writing an object whose name is beneath
+// the envelope prefix
+var errEnvelopeName = errors.New("Object name reserved for encryption keys")
+
+// errDecrypt is returned when an encrypted object fails authentication
+var errDecrypt = errors.New("Object decryption failed")
+
+// envelope describes how an object is encrypted. It is kept in an object
+// of its own, so that master keys are rotated by rewrapping the data key
+// without rewriting the object.
+type envelope struct {
+	MasterKey string `json:"master_key"`
+	DataKey   []byte `json:"data_key"`
+	ChunkSize int    `json:"chunk_size"`
+	Size      int64  `json:"size"`
+}
+
+// chunks returns the number of chunks holding the plaintext. Empty objects
+// have a single empty chunk.
+func (e *envelope) chunks() int64 {
+	chunkSize := int64(e.ChunkSize)
+	if e.Size == 0 {
+		return 1
+	}
+	return (e.Size + chunkSize - 1) / chunkSize
+}
+
+// plainSize returns the size of the plaintext of an encrypted object
+func plainSize(cipherSize int64, chunkSize int) int64 {
+	sealed := int64(chunkSize) + tagSize
+	chunks := (cipherSize + sealed - 1) / sealed
+	return cipherSize - chunks*tagSize
+}
+
+// cipherSize returns the size of the encrypted object
+func (e *envelope) cipherSize() int64 {
+	return e.Size + e.chunks()*tagSize
+}
+
+// chunkNonce returns the nonce of a chunk. The final chunk is marked so that
+// an object can not be truncated at a chunk boundary undetected.
+func chunkNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	if final {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// EncryptingStore is an ObjectStore decorator that encrypts objects at rest.
+// Each object is encrypted with a random data key using AES-256-GCM in
+// fixed size chunks, so that ranges are read by decrypting only the chunks
+// covering them. The data key is wrapped with a master key and stored in an
+// envelope object beneath a prefix of its own. Objects stored without an
+// envelope, such as those written before encryption was enabled, are read
+// as they are, so the envelope of an object is written before the object
+// and removed after it. Encrypted content is never found without its
+// envelope, even should a write be interrupted.
+//
+// Content can not be transferred directly to or from the underlying store,
+// so presigning is not supported.
+type EncryptingStore struct {
+	store     ObjectStore
+	keys      *Keyring
+	chunkSize int
+}
+
+// NewEncryptingStore returns an EncryptingStore over the given store, using
+// master keys from the keyring
+func NewEncryptingStore(s ObjectStore, keys *Keyring) *EncryptingStore {
+	return &EncryptingStore{store: s, keys: keys, chunkSize: DefaultChunkSize}
+}
+
+// envelope reads the envelope of an object, returning nil if the object is
+// not encrypted
+func (s *EncryptingStore) envelope(ctx context.Context, objectName string) (*envelope, []byte, error) {
+	obj, err := s.store.Get(ctx, envelopeName(objectName), GetOptions{})
+	if err == ErrNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer obj.Close()
+	data, err := ioutil.ReadAll(obj)
+	if err == ErrNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	env := &envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, nil, err
+	}
+	if env.ChunkSize <= 0 {
+		return nil, nil, errDecrypt
+	}
+	dataKey, err := s.keys.unwrap(env.MasterKey, env.DataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if env.Size < 0 {
+		info, err := s.store.Stat(ctx, objectName)
+		if err != nil {
+			return nil, nil, err
+		}
+		env.Size = plainSize(info.Size, env.ChunkSize)
+	}
+	return env, dataKey, nil
+}
+
+// putEnvelope stores the envelope of an object
+func (s *EncryptingStore) putEnvelope(ctx context.Context, objectName string, env *envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.Put(ctx, envelopeName(objectName), bytes.NewReader(data), int64(len(data)),
+		PutOptions{ContentType: "application/json"})
+	return err
+}
+
+// envelopeName returns the name of the envelope of an object
+func envelopeName(objectName string) string {
+	return envelopePrefix + objectName
+}
+
+func (s *EncryptingStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (int64, error) {
+
+	if strings.HasPrefix(objectName, envelopePrefix) {
+		return 0, errEnvelopeName
+	}
+
+	dataKey := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return 0, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return 0, err
+	}
+	env := &envelope{ChunkSize: s.chunkSize, Size: -1}
+	if env.MasterKey, env.DataKey, err = s.keys.wrap(dataKey); err != nil {
+		return 0, err
+	}
+
+	// The envelope is written first, so the size is only recorded in it up
+	// front if given. Otherwise it is found from the size of the encrypted
+	// object until recorded.
+	cipherSize := int64(-1)
+	if size >= 0 {
+		reader = io.LimitReader(reader, size)
+		env.Size = size
+		cipherSize = env.cipherSize()
+	}
+	if err := s.putEnvelope(ctx, objectName, env); err != nil {
+		return 0, err
+	}
+
+	enc := &encryptReader{
+		aead:      aead,
+		source:    bufio.NewReaderSize(reader, s.chunkSize),
+		chunk:     make([]byte, s.chunkSize),
+		chunkSize: s.chunkSize,
+	}
+	if _, err := s.store.Put(ctx, objectName, enc, cipherSize, opts); err != nil {
+		s.Remove(context.Background(), objectName)
+		return enc.n, err
+	}
+	if size >= 0 && enc.n != size {
+		s.Remove(context.Background(), objectName)
+		return enc.n, io.ErrUnexpectedEOF
+	}
+
+	// Record the size now known. Should this fail the object is still read
+	// correctly, finding its size as described above.
+	if env.Size < 0 {
+		env.Size = enc.n
+		s.putEnvelope(ctx, objectName, env)
+	}
+	return enc.n, nil
+}
+
+func (s *EncryptingStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+
+	env, dataKey, err := s.envelope(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		return s.store.Get(ctx, objectName, opts)
+	}
+
+	start, length, _, err := objectRange(opts, env.Size)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		if _, err := s.store.Stat(ctx, objectName); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the chunks covering the range
+	chunkSize := int64(env.ChunkSize)
+	first := start / chunkSize
+	last := (start + length - 1) / chunkSize
+	offset := first * (chunkSize + tagSize)
+	span := (last - first + 1) * (chunkSize + tagSize)
+	if offset+span > env.cipherSize() {
+		span = env.cipherSize() - offset
+	}
+	obj, err := s.store.Get(ctx, objectName, GetOptions{Offset: offset, Length: span})
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		aead:      aead,
+		source:    obj,
+		index:     first,
+		last:      env.chunks() - 1,
+		chunk:     make([]byte, chunkSize+tagSize),
+		skip:      start - first*chunkSize,
+		remaining: length,
+	}, nil
+}
+
+// Remove removes an object and then its envelope
+func (s *EncryptingStore) Remove(ctx context.Context, objectName string) error {
+	if err := s.store.Remove(ctx, objectName); err != nil {
+		return err
+	}
+	return s.store.Remove(ctx, envelopeName(objectName))
+}
+
+// Stat reports the size of the plaintext
+func (s *EncryptingStore) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	info, err := s.store.Stat(ctx, objectName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	env, _, err := s.envelope(ctx, objectName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if env != nil {
+		info.Size = env.Size
+	}
+	return info, nil
+}
+
+// Copy copies the encrypted object within the underlying store, along with
+// its envelope. The envelope is copied first; a copy of an object that is
+// not encrypted removes any envelope of the destination once made.
+func (s *EncryptingStore) Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error {
+	if strings.HasPrefix(dstName, envelopePrefix) {
+		return errEnvelopeName
+	}
+	if srcName == dstName {
+		return s.store.Copy(ctx, srcName, dstName, opts)
+	}
+	err := s.store.Copy(ctx, envelopeName(srcName), envelopeName(dstName), PutOptions{})
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	encrypted := err == nil
+	if err := s.store.Copy(ctx, srcName, dstName, opts); err != nil {
+		return err
+	}
+	if !encrypted {
+		return s.store.Remove(ctx, envelopeName(dstName))
+	}
+	return nil
+}
+
+// List lists objects with the size of their plaintext, leaving out
+// envelopes
+func (s *EncryptingStore) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	var result ListResult
+	after := opts.After
+	for {
+		page, err := s.store.List(ctx, ListOptions{Prefix: opts.Prefix, After: after, Limit: limit})
+		if err != nil {
+			return ListResult{}, err
+		}
+		next := page.Next
+		for _, info := range page.Objects {
+			if strings.HasPrefix(info.Key, envelopePrefix) {
+				// Envelopes sort together, so listing goes on from past them
+				if skip := envelopePrefix + string(utf8.MaxRune); skip > info.Key {
+					next = skip
+					break
+				}
+				continue
+			}
+			if len(result.Objects) == limit {
+				result.Next = result.Objects[limit-1].Key
+				return result, nil
+			}
+			env, _, err := s.envelope(ctx, info.Key)
+			if err != nil {
+				return ListResult{}, err
+			}
+			if env != nil {
+				info.Size = env.Size
+			}
+			result.Objects = append(result.Objects, info)
+		}
+		if next == "" {
+			return result, nil
+		}
+		after = next
+	}
+}
+
+// PresignGet is not supported, since objects must be decrypted
+func (s *EncryptingStore) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return nil, ErrNotSupported
+}
+
+// PresignPut is not supported, since objects must be encrypted
+func (s *EncryptingStore) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return nil, ErrNotSupported
+}
+
+// Rotate rewraps the data key of an object with the current master key,
+// returning false if it was already wrapped with it or the object is not
+// encrypted. The object itself is not rewritten.
+func (s *EncryptingStore) Rotate(ctx context.Context, objectName string) (bool, error) {
+	env, dataKey, err := s.envelope(ctx, objectName)
+	if err != nil || env == nil || env.MasterKey == s.keys.Current() {
+		return false, err
+	}
+	if env.MasterKey, env.DataKey, err = s.keys.wrap(dataKey); err != nil {
+		return false, err
+	}
+	if err := s.putEnvelope(ctx, objectName, env); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RotateAll rewraps the data keys of all objects with the current master
+// key, returning the number rewrapped
+func (s *EncryptingStore) RotateAll(ctx context.Context) (int, error) {
+	rotated := 0
+	after := ""
+	for {
+		page, err := s.store.List(ctx, ListOptions{Prefix: envelopePrefix, After: after})
+		if err != nil {
+			return rotated, err
+		}
+		for _, info := range page.Objects {
+			ok, err := s.Rotate(ctx, strings.TrimPrefix(info.Key, envelopePrefix))
+			if err == ErrNotFound {
+				continue // Left by a write that failed
+			}
+			if err != nil {
+				return rotated, err
+			}
+			if ok {
+				rotated++
+			}
+		}
+		if page.Next == "" {
+			return rotated, nil
+		}
+		after = page.Next
+	}
+}
+
+// encryptReader encrypts the plaintext read from its source into chunks
+type encryptReader struct {
+	aead      cipher.AEAD
+	source    *bufio.Reader
+	chunk     []byte
+	chunkSize int
+	index     int64
+	pending   []byte
+	done      bool
+
+	// n counts the plaintext bytes read
+	n int64
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next encrypts the next chunk. A chunk is final when no plaintext follows
+// it.
+func (r *encryptReader) next() error {
+	n, err := io.ReadFull(r.source, r.chunk[:r.chunkSize])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	r.n += int64(n)
+	final := n < r.chunkSize
+	if !final {
+		if _, err := r.source.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.pending = r.aead.Seal(r.pending[:0], chunkNonce(r.index, final), r.chunk[:n], nil)
+	r.index++
+	r.done = final
+	return nil
+}
+
+// decryptReader decrypts a run of chunks, returning the plaintext of the
+// range requested
+type decryptReader struct {
+	aead      cipher.AEAD
+	source    io.ReadCloser
+	index     int64
+	last      int64
+	chunk     []byte
+	pending   []byte
+	skip      int64
+	remaining int64
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	for len(r.pending) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) next() error {
+	n, err := io.ReadFull(r.source, r.chunk)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && r.index != r.last) {
+		return errDecrypt
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	plain, err := r.aead.Open(r.chunk[:0], chunkNonce(r.index, r.index == r.last), r.chunk[:n], nil)
+	if err != nil {
+		return errDecrypt
+	}
+	r.index++
+	if r.skip > 0 {
+		plain = plain[r.skip:]
+		r.skip = 0
+	}
+	r.pending = plain
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.source.Close()
+}
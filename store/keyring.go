@@ -0,0 +1,139 @@
+package store
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// masterKeySize is the size of master and data keys, selecting AES-256
+const masterKeySize = 32
+
+// errUnwrap is returned when a data key can not be decrypted
+var errUnwrap = errors.New("Failed to unwrap data key")
+
+// MasterKey encrypts the data keys of objects
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// Keyring holds the master keys used to wrap data keys. New data keys are
+// wrapped with the current key; older keys are kept to unwrap data keys
+// until they have been rotated.
+type Keyring struct {
+	keys    map[string][]byte
+	current string
+}
+
+// NewKeyring returns a Keyring holding the given keys. The last key is the
+// current one.
+func NewKeyring(keys []MasterKey) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Keyring error: no master keys")
+	}
+	k := &Keyring{keys: map[string][]byte{}}
+	for _, key := range keys {
+		if !backendNameRegex.MatchString(key.ID) {
+			return nil, fmt.Errorf("Keyring error: invalid key ID '%s'", key.ID)
+		}
+		if len(key.Key) != masterKeySize {
+			return nil, fmt.Errorf("Keyring error: key '%s' is not %d bytes", key.ID, masterKeySize)
+		}
+		if _, found := k.keys[key.ID]; found {
+			return nil, fmt.Errorf("Keyring error: duplicate key ID '%s'", key.ID)
+		}
+		k.keys[key.ID] = key.Key
+		k.current = key.ID
+	}
+	return k, nil
+}
+
+// LoadKeyring reads master keys from a keyfile. Each line holds a key ID
+// and the base64 encoded key, separated by a space; blank lines and lines
+// starting with # are ignored. The last key is the current one, so keys are
+// rotated by appending a new key.
+func LoadKeyring(path string) (*Keyring, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Keyring error: %s", err.Error())
+	}
+	defer f.Close()
+
+	var keys []MasterKey
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Keyring error: invalid keyfile line %d", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Keyring error: invalid key on keyfile line %d", line)
+		}
+		keys = append(keys, MasterKey{ID: fields[0], Key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Keyring error: %s", err.Error())
+	}
+	return NewKeyring(keys)
+}
+
+// Current returns the ID of the key that new data keys are wrapped with
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// wrap encrypts a data key with the current master key
+func (k *Keyring) wrap(dataKey []byte) (string, []byte, error) {
+	aead, err := newGCM(k.keys[k.current])
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	return k.current, aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// unwrap decrypts a data key wrapped with the identified master key
+func (k *Keyring) unwrap(id string, wrapped []byte) ([]byte, error) {
+	key, found := k.keys[id]
+	if !found {
+		return nil, fmt.Errorf("Unknown master key: '%s'", id)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errUnwrap
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errUnwrap
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,338 @@
+package store
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tempPrefix starts the names of files being written
+const tempPrefix = ".upload-"
+
+type localObjectStore struct {
+	Root string
+	Opts LocalOpts
+}
+
+// LocalOpts are provided to configure the local filesystem storage
+type LocalOpts struct {
+	Root string
+}
+
+// NewLocalObjectStore creates and returns an ObjectStore interface that keeps
+// objects as files beneath a root directory on the local filesystem.
+func NewLocalObjectStore(opts LocalOpts) (ObjectStore, error) {
+
+	if opts.Root == "" {
+		return nil, fmt.Errorf("Local store error: root directory not set")
+	}
+	root, err := filepath.Abs(opts.Root)
+	if err != nil {
+		return nil, fmt.Errorf("Local store error: %s", err.Error())
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("Local store error: %s", err.Error())
+	}
+
+	return &localObjectStore{
+		Root: root,
+		Opts: opts,
+	}, nil
+}
+
+// path returns the file path for an object. Objects are fanned out into two
+// levels of subdirectories named by a hash of the first key segment, which
+// keeps all objects belonging to one blob ID in the same directory.
+func (s *localObjectStore) path(objectName string) (string, error) {
+
+	name := filepath.Clean(filepath.FromSlash(objectName))
+	if name == "." || filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+		return "", fmt.Errorf("Invalid object name: '%s'", objectName)
+	}
+
+	segment := objectName
+	if i := strings.Index(objectName, "/"); i >= 0 {
+		segment = objectName[:i]
+	}
+	sum := sha1.Sum([]byte(segment))
+	fan := hex.EncodeToString(sum[:2])
+
+	return filepath.Join(s.Root, fan[:2], fan[2:], name), nil
+}
+
+func (s *localObjectStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path, err := s.path(objectName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, localError(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	start, length, ok, err := objectRange(opts, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !ok {
+		return &fileReader{Reader: f, File: f, Context: ctx}, nil
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileReader{Reader: io.LimitReader(f, length), File: f, Context: ctx}, nil
+}
+
+func (s *localObjectStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (n int64, err error) {
+
+	path, err := s.path(objectName)
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Dir(path)
+
+	// Write to a temporary file in the destination directory so that the
+	// final rename is atomic. Readers never observe a partial object.
+	tmp, err := createTemp(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	reader = &contextReader{Reader: reader, Context: ctx}
+	if size >= 0 {
+		n, err = io.CopyN(tmp, reader, size)
+	} else {
+		n, err = io.Copy(tmp, reader)
+	}
+	if err != nil {
+		return n, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return n, err
+	}
+	if err = tmp.Close(); err != nil {
+		return n, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return n, err
+	}
+	return n, syncDir(dir)
+}
+
+// createTemp creates a temporary file in a directory, creating the
+// directory if needed. A concurrent Remove may prune the directory between
+// its creation and that of the file, in which case both are retried; once
+// the file exists the directory is no longer empty and is kept.
+func createTemp(dir string) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		tmp, err := ioutil.TempFile(dir, tempPrefix)
+		if err == nil || !os.IsNotExist(err) || attempt == 10 {
+			return tmp, err
+		}
+	}
+}
+
+func (s *localObjectStore) Remove(ctx context.Context, objectName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path, err := s.path(objectName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Prune directories left empty by the removal. Failure here is harmless
+	// since the next Put into the directory recreates whatever it needs, and
+	// retries if a directory is pruned while it does.
+	for dir := filepath.Dir(path); dir != s.Root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *localObjectStore) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	path, err := s.path(objectName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, localError(err)
+	}
+	return ObjectInfo{
+		Key:          objectName,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// Copy writes a copy of the file. Files carry no metadata, so copying an
+// object onto itself only checks that it exists.
+func (s *localObjectStore) Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error {
+	if srcName == dstName {
+		_, err := s.Stat(ctx, srcName)
+		return err
+	}
+	src, err := s.Get(ctx, srcName, GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = s.Put(ctx, dstName, src, -1, opts)
+	return err
+}
+
+// Compose writes the content of the source files in turn to a new file
+func (s *localObjectStore) Compose(ctx context.Context, dstName string, srcNames []string, opts PutOptions) error {
+	for _, name := range srcNames {
+		if _, err := s.Stat(ctx, name); err != nil {
+			return err
+		}
+	}
+	srcs := NewSequenceReader(ctx, s, WholeObjects(srcNames))
+	defer srcs.Close()
+	_, err := s.Put(ctx, dstName, srcs, -1, opts)
+	return err
+}
+
+// List walks the whole directory tree, since objects are spread over it by
+// hash, and then picks out the requested page
+func (s *localObjectStore) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	var objects []ObjectInfo
+	err := filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Removed during the walk
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		// Strip the two fan out directories
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 3)
+		if len(parts) < 3 {
+			return nil
+		}
+		key := parts[2]
+		if strings.HasPrefix(key, opts.Prefix) && key > opts.After {
+			objects = append(objects, ObjectInfo{
+				Key:          key,
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return ListResult{}, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	var result ListResult
+	if len(objects) > limit {
+		objects = objects[:limit]
+		result.Next = objects[limit-1].Key
+	}
+	result.Objects = objects
+	return result, nil
+}
+
+// PresignGet is not supported since files are only reachable through the
+// service
+func (s *localObjectStore) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return nil, ErrNotSupported
+}
+
+// PresignPut is not supported since files are only reachable through the
+// service
+func (s *localObjectStore) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return nil, ErrNotSupported
+}
+
+// localError translates errors for missing files to ErrNotFound
+func localError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// syncDir flushes a directory entry to disk so a rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// fileReader reads from a file, or a section of it. Reads fail once the
+// context is done.
+type fileReader struct {
+	Reader  io.Reader
+	File    *os.File
+	Context context.Context
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if err := r.Context.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *fileReader) Close() error {
+	return r.File.Close()
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObjectStore struct {
+	mutex   sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+// memoryObject is an object held in memory along with its information
+type memoryObject struct {
+	Data []byte
+	Info ObjectInfo
+}
+
+// NewMemoryObjectStore creates and returns an ObjectStore interface that keeps
+// objects in memory. It is safe for concurrent use and is intended for tests
+// and ephemeral deployments; all objects are lost when the process exits.
+func NewMemoryObjectStore() ObjectStore {
+	return &memoryObjectStore{objects: map[string]*memoryObject{}}
+}
+
+func (m *memoryObjectStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	obj, found := m.objects[objectName]
+	if !found {
+		return nil, ErrNotFound
+	}
+	start, length, _, err := objectRange(opts, int64(len(obj.Data)))
+	if err != nil {
+		return nil, err
+	}
+	// Stored slices are never modified in place, so readers may share them
+	return ioutil.NopCloser(bytes.NewReader(obj.Data[start : start+length])), nil
+}
+
+func (m *memoryObjectStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (n int64, err error) {
+	if size >= 0 {
+		reader = io.LimitReader(reader, size)
+	}
+	data, err := ioutil.ReadAll(&contextReader{Reader: reader, Context: ctx})
+	if err != nil {
+		return int64(len(data)), err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return int64(len(data)), io.ErrUnexpectedEOF
+	}
+	sum := md5.Sum(data)
+	obj := &memoryObject{Data: data}
+	obj.Info = memoryObjectInfo(objectName, int64(len(data)), hex.EncodeToString(sum[:]), opts)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[objectName] = obj
+	return int64(len(data)), nil
+}
+
+func (m *memoryObjectStore) Remove(ctx context.Context, objectName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.objects, objectName)
+	return nil
+}
+
+func (m *memoryObjectStore) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	obj, found := m.objects[objectName]
+	if !found {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return obj.Info, nil
+}
+
+func (m *memoryObjectStore) Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	src, found := m.objects[srcName]
+	if !found {
+		return ErrNotFound
+	}
+	info := src.Info
+	if !opts.Empty() {
+		info = memoryObjectInfo(dstName, info.Size, info.ETag, opts)
+	}
+	info.Key = dstName
+	info.LastModified = time.Now()
+	m.objects[dstName] = &memoryObject{Data: src.Data, Info: info}
+	return nil
+}
+
+func (m *memoryObjectStore) Compose(ctx context.Context, dstName string, srcNames []string, opts PutOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var data []byte
+	for _, name := range srcNames {
+		src, found := m.objects[name]
+		if !found {
+			return ErrNotFound
+		}
+		data = append(data, src.Data...)
+	}
+	sum := md5.Sum(data)
+	obj := &memoryObject{Data: data}
+	obj.Info = memoryObjectInfo(dstName, int64(len(data)), hex.EncodeToString(sum[:]), opts)
+	m.objects[dstName] = obj
+	return nil
+}
+
+func (m *memoryObjectStore) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ListResult{}, err
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, opts.Prefix) && key > opts.After {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var result ListResult
+	if len(keys) > limit {
+		keys = keys[:limit]
+		result.Next = keys[limit-1]
+	}
+	for _, key := range keys {
+		result.Objects = append(result.Objects, m.objects[key].Info)
+	}
+	return result, nil
+}
+
+// PresignGet is not supported since objects only exist in process memory
+func (m *memoryObjectStore) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return nil, ErrNotSupported
+}
+
+// PresignPut is not supported since objects only exist in process memory
+func (m *memoryObjectStore) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return nil, ErrNotSupported
+}
+
+// memoryObjectInfo returns the information kept for an object stored with
+// the given options
+func memoryObjectInfo(objectName string, size int64, etag string, opts PutOptions) ObjectInfo {
+	info := ObjectInfo{
+		Key:          objectName,
+		Size:         size,
+		ETag:         etag,
+		LastModified: time.Now(),
+		ContentType:  opts.ContentType,
+	}
+	if len(opts.Metadata) > 0 {
+		info.Metadata = map[string]string{}
+		for k, v := range opts.Metadata {
+			info.Metadata[strings.ToLower(k)] = v
+		}
+	}
+	return info
+}
+
+// contextReader fails reads once its context is done, which stops copies
+// that have no other way to observe cancellation
+type contextReader struct {
+	Reader  io.Reader
+	Context context.Context
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.Context.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
@@ -1,13 +1,19 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strings"
 
 	minio "github.com/minio/minio-go"
 )
 
+// userMetadataPrefix is the header prefix of user metadata on S3 objects
+const userMetadataPrefix = "X-Amz-Meta-"
+
 type minioObjectStore struct {
 	Bucket string
 	Client *minio.Client
@@ -45,14 +51,202 @@ func NewMinioObjectStore(opts MinioOpts) (ObjectStore, error) {
 	}, nil
 }
 
-func (m *minioObjectStore) Get(objectName string, opts minio.GetObjectOptions) (io.Reader, error) {
-	return m.Client.GetObject(m.Bucket, objectName, opts)
+// Get returns an object that is fetched lazily on the first Read
+func (m *minioObjectStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	getOpts := minio.GetObjectOptions{}
+	if opts.Ranged() {
+		// An end of zero reads to the end of the object
+		var end int64
+		if opts.Length > 0 {
+			end = opts.Offset + opts.Length - 1
+		}
+		if err := getOpts.SetRange(opts.Offset, end); err != nil {
+			return nil, err
+		}
+	}
+	obj, err := m.Client.GetObjectWithContext(ctx, m.Bucket, objectName, getOpts)
+	if err != nil {
+		return nil, minioError(err)
+	}
+	return &minioReader{Object: obj}, nil
 }
 
-func (m *minioObjectStore) Put(objectName string, reader io.Reader, size int64, opts minio.PutObjectOptions) (n int64, err error) {
-	return m.Client.PutObject(m.Bucket, objectName, reader, size, opts)
+func (m *minioObjectStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (n int64, err error) {
+	return m.Client.PutObjectWithContext(ctx, m.Bucket, objectName, reader, size, putObjectOptions(opts))
 }
 
-func (m *minioObjectStore) Remove(objectName string) error {
+// The client takes no context for calls other than transfers, so these only
+// check the context before starting
+
+func (m *minioObjectStore) Remove(ctx context.Context, objectName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return m.Client.RemoveObject(m.Bucket, objectName)
 }
+
+func (m *minioObjectStore) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := m.Client.StatObject(m.Bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return objectInfo(info), nil
+}
+
+// Copy uses a server side copy. New metadata replaces that of the source;
+// without any the source metadata is copied along with the content.
+func (m *minioObjectStore) Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dst, err := minio.NewDestinationInfo(m.Bucket, dstName, nil, copyMetadata(opts))
+	if err != nil {
+		return err
+	}
+	return minioError(m.Client.CopyObject(dst, minio.NewSourceInfo(m.Bucket, srcName, nil)))
+}
+
+// S3 multipart uploads take at most maxComposeParts parts, each but the
+// last holding at least minComposePartSize bytes
+const (
+	maxComposeParts    = 10000
+	minComposePartSize = 5 << 20
+)
+
+// Compose uses a multipart upload that copies each source as a part on the
+// server. Sources that do not meet the part limits are not supported.
+func (m *minioObjectStore) Compose(ctx context.Context, dstName string, srcNames []string, opts PutOptions) error {
+	if len(srcNames) == 0 || len(srcNames) > maxComposeParts {
+		return ErrNotSupported
+	}
+	srcs := make([]minio.SourceInfo, len(srcNames))
+	for i, name := range srcNames {
+		info, err := m.Stat(ctx, name)
+		if err != nil {
+			return err
+		}
+		if info.Size < minComposePartSize && i < len(srcNames)-1 {
+			return ErrNotSupported
+		}
+		srcs[i] = minio.NewSourceInfo(m.Bucket, name, nil)
+	}
+	dst, err := minio.NewDestinationInfo(m.Bucket, dstName, nil, copyMetadata(opts))
+	if err != nil {
+		return err
+	}
+	return minioError(m.Client.ComposeObject(dst, srcs))
+}
+
+// copyMetadata returns the headers an object is copied with, or nil to keep
+// the metadata of the source
+func copyMetadata(opts PutOptions) map[string]string {
+	if opts.Empty() {
+		return nil
+	}
+	meta := map[string]string{}
+	for k, v := range putObjectOptions(opts).Header() {
+		meta[k] = v[0]
+	}
+	return meta
+}
+
+func (m *minioObjectStore) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ListResult{}, err
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	core := minio.Core{Client: m.Client}
+	page, err := core.ListObjectsV2(m.Bucket, opts.Prefix, "", false, "", limit, opts.After)
+	if err != nil {
+		return ListResult{}, err
+	}
+	var result ListResult
+	for _, info := range page.Contents {
+		result.Objects = append(result.Objects, objectInfo(info))
+	}
+	if page.IsTruncated && len(result.Objects) > 0 {
+		result.Next = result.Objects[len(result.Objects)-1].Key
+	}
+	return result, nil
+}
+
+func (m *minioObjectStore) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	if opts.ContentType != "" {
+		params.Set("response-content-type", opts.ContentType)
+	}
+	if opts.ContentDisposition != "" {
+		params.Set("response-content-disposition", opts.ContentDisposition)
+	}
+	return m.Client.PresignedGetObject(m.Bucket, objectName, opts.Expiry, params)
+}
+
+func (m *minioObjectStore) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Client.PresignedPutObject(m.Bucket, objectName, opts.Expiry)
+}
+
+// putObjectOptions converts PutOptions to their Minio equivalent
+func putObjectOptions(opts PutOptions) minio.PutObjectOptions {
+	return minio.PutObjectOptions{
+		ContentType:        opts.ContentType,
+		ContentDisposition: opts.ContentDisposition,
+		UserMetadata:       opts.Metadata,
+	}
+}
+
+// objectInfo converts Minio object information, picking the user metadata
+// out of the object headers
+func objectInfo(info minio.ObjectInfo) ObjectInfo {
+	result := ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		ContentType:  info.ContentType,
+	}
+	for k, v := range info.Metadata {
+		if strings.HasPrefix(k, userMetadataPrefix) && len(v) > 0 {
+			if result.Metadata == nil {
+				result.Metadata = map[string]string{}
+			}
+			result.Metadata[strings.ToLower(k[len(userMetadataPrefix):])] = v[0]
+		}
+	}
+	return result
+}
+
+// minioError translates errors for missing objects to ErrNotFound
+func minioError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
+
+// minioReader translates the errors of a lazily fetched object
+type minioReader struct {
+	*minio.Object
+}
+
+func (r *minioReader) Read(p []byte) (int, error) {
+	n, err := r.Object.Read(p)
+	if err != nil && err != io.EOF {
+		err = minioError(err)
+	}
+	return n, err
+}
@@ -5,11 +5,12 @@
 package store
 
 import (
+	context "context"
 	io "io"
+	url "net/url"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
-	minio_go "github.com/minio/minio-go"
 )
 
 // MockObjectStore is a mock of ObjectStore interface
@@ -36,39 +37,138 @@ func (m *MockObjectStore) EXPECT() *MockObjectStoreMockRecorder {
 }
 
 // Get mocks base method
-func (m *MockObjectStore) Get(objectName string, opts minio_go.GetObjectOptions) (io.Reader, error) {
-	ret := m.ctrl.Call(m, "Get", objectName, opts)
-	ret0, _ := ret[0].(io.Reader)
+func (m *MockObjectStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	ret := m.ctrl.Call(m, "Get", ctx, objectName, opts)
+	ret0, _ := ret[0].(io.ReadCloser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Get indicates an expected call of Get
-func (mr *MockObjectStoreMockRecorder) Get(objectName, opts interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockObjectStore)(nil).Get), objectName, opts)
+func (mr *MockObjectStoreMockRecorder) Get(ctx, objectName, opts interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockObjectStore)(nil).Get), ctx, objectName, opts)
 }
 
 // Put mocks base method
-func (m *MockObjectStore) Put(objectName string, reader io.Reader, size int64, opts minio_go.PutObjectOptions) (int64, error) {
-	ret := m.ctrl.Call(m, "Put", objectName, reader, size, opts)
+func (m *MockObjectStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (int64, error) {
+	ret := m.ctrl.Call(m, "Put", ctx, objectName, reader, size, opts)
 	ret0, _ := ret[0].(int64)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Put indicates an expected call of Put
-func (mr *MockObjectStoreMockRecorder) Put(objectName, reader, size, opts interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockObjectStore)(nil).Put), objectName, reader, size, opts)
+func (mr *MockObjectStoreMockRecorder) Put(ctx, objectName, reader, size, opts interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockObjectStore)(nil).Put), ctx, objectName, reader, size, opts)
 }
 
 // Remove mocks base method
-func (m *MockObjectStore) Remove(objectName string) error {
-	ret := m.ctrl.Call(m, "Remove", objectName)
+func (m *MockObjectStore) Remove(ctx context.Context, objectName string) error {
+	ret := m.ctrl.Call(m, "Remove", ctx, objectName)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Remove indicates an expected call of Remove
-func (mr *MockObjectStoreMockRecorder) Remove(objectName interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Remove", reflect.TypeOf((*MockObjectStore)(nil).Remove), objectName)
+func (mr *MockObjectStoreMockRecorder) Remove(ctx, objectName interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Remove", reflect.TypeOf((*MockObjectStore)(nil).Remove), ctx, objectName)
+}
+
+// Stat mocks base method
+func (m *MockObjectStore) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	ret := m.ctrl.Call(m, "Stat", ctx, objectName)
+	ret0, _ := ret[0].(ObjectInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stat indicates an expected call of Stat
+func (mr *MockObjectStoreMockRecorder) Stat(ctx, objectName interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stat", reflect.TypeOf((*MockObjectStore)(nil).Stat), ctx, objectName)
+}
+
+// Copy mocks base method
+func (m *MockObjectStore) Copy(ctx context.Context, srcName string, dstName string, opts PutOptions) error {
+	ret := m.ctrl.Call(m, "Copy", ctx, srcName, dstName, opts)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Copy indicates an expected call of Copy
+func (mr *MockObjectStoreMockRecorder) Copy(ctx, srcName, dstName, opts interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Copy", reflect.TypeOf((*MockObjectStore)(nil).Copy), ctx, srcName, dstName, opts)
+}
+
+// List mocks base method
+func (m *MockObjectStore) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	ret := m.ctrl.Call(m, "List", ctx, opts)
+	ret0, _ := ret[0].(ListResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List
+func (mr *MockObjectStoreMockRecorder) List(ctx, opts interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockObjectStore)(nil).List), ctx, opts)
+}
+
+// PresignGet mocks base method
+func (m *MockObjectStore) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	ret := m.ctrl.Call(m, "PresignGet", ctx, objectName, opts)
+	ret0, _ := ret[0].(*url.URL)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PresignGet indicates an expected call of PresignGet
+func (mr *MockObjectStoreMockRecorder) PresignGet(ctx, objectName, opts interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PresignGet", reflect.TypeOf((*MockObjectStore)(nil).PresignGet), ctx, objectName, opts)
+}
+
+// PresignPut mocks base method
+func (m *MockObjectStore) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	ret := m.ctrl.Call(m, "PresignPut", ctx, objectName, opts)
+	ret0, _ := ret[0].(*url.URL)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PresignPut indicates an expected call of PresignPut
+func (mr *MockObjectStoreMockRecorder) PresignPut(ctx, objectName, opts interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PresignPut", reflect.TypeOf((*MockObjectStore)(nil).PresignPut), ctx, objectName, opts)
+}
+
+// MockComposer is a mock of Composer interface
+type MockComposer struct {
+	ctrl     *gomock.Controller
+	recorder *MockComposerMockRecorder
+}
+
+// MockComposerMockRecorder is the mock recorder for MockComposer
+type MockComposerMockRecorder struct {
+	mock *MockComposer
+}
+
+// NewMockComposer creates a new mock instance
+func NewMockComposer(ctrl *gomock.Controller) *MockComposer {
+	mock := &MockComposer{ctrl: ctrl}
+	mock.recorder = &MockComposerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockComposer) EXPECT() *MockComposerMockRecorder {
+	return m.recorder
+}
+
+// Compose mocks base method
+func (m *MockComposer) Compose(ctx context.Context, dstName string, srcNames []string, opts PutOptions) error {
+	ret := m.ctrl.Call(m, "Compose", ctx, dstName, srcNames, opts)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Compose indicates an expected call of Compose
+func (mr *MockComposerMockRecorder) Compose(ctx, dstName, srcNames, opts interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compose", reflect.TypeOf((*MockComposer)(nil).Compose), ctx, dstName, srcNames, opts)
 }
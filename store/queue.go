@@ -0,0 +1,264 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication task operations
+const (
+	// OpPut copies an object to a replica from another replica holding it
+	OpPut = "put"
+
+	// OpRemove removes an object from a replica
+	OpRemove = "remove"
+)
+
+// ReplicationTask is a write still to be made to one replica
+type ReplicationTask struct {
+	ID       string
+	Key      string
+	Replica  string
+	Op       string
+	QueuedAt time.Time
+
+	// Attempts made so far, the time before which the task is not retried
+	// and the error of the last attempt
+	Attempts  int
+	NotBefore time.Time
+	LastError string
+}
+
+// ReplicationQueue durably records replication tasks. There is at most one
+// task for each key and replica; the latest one wins, since it reflects the
+// latest write.
+type ReplicationQueue interface {
+
+	// Push records a task, replacing any task for the same key and replica
+	Push(task ReplicationTask) error
+
+	// Tasks returns all recorded tasks, oldest first
+	Tasks() ([]ReplicationTask, error)
+
+	// Done removes a task, unless it has been replaced since it was read
+	Done(task ReplicationTask) error
+
+	// Retry records a failed attempt at a task, unless it has been replaced
+	// since it was read
+	Retry(task ReplicationTask) error
+}
+
+// newTask returns a task for an operation on a replica
+func newTask(op, key, replica string) ReplicationTask {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return ReplicationTask{
+		ID:       hex.EncodeToString(id),
+		Key:      key,
+		Replica:  replica,
+		Op:       op,
+		QueuedAt: time.Now(),
+	}
+}
+
+// taskName identifies the slot of a task in a queue
+func taskName(task ReplicationTask) string {
+	sum := sha256.Sum256([]byte(task.Replica + "\x00" + task.Key))
+	return hex.EncodeToString(sum[:])
+}
+
+func sortTasks(tasks []ReplicationTask) {
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].QueuedAt.Before(tasks[j].QueuedAt)
+	})
+}
+
+type memoryQueue struct {
+	mutex sync.Mutex
+	tasks map[string]ReplicationTask
+}
+
+// NewMemoryQueue returns a ReplicationQueue that keeps tasks in memory. Tasks
+// are lost when the process exits, so it suits tests only.
+func NewMemoryQueue() ReplicationQueue {
+	return &memoryQueue{tasks: map[string]ReplicationTask{}}
+}
+
+func (q *memoryQueue) Push(task ReplicationTask) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.tasks[taskName(task)] = task
+	return nil
+}
+
+func (q *memoryQueue) Tasks() ([]ReplicationTask, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	tasks := make([]ReplicationTask, 0, len(q.tasks))
+	for _, task := range q.tasks {
+		tasks = append(tasks, task)
+	}
+	sortTasks(tasks)
+	return tasks, nil
+}
+
+func (q *memoryQueue) Done(task ReplicationTask) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	name := taskName(task)
+	if q.tasks[name].ID == task.ID {
+		delete(q.tasks, name)
+	}
+	return nil
+}
+
+func (q *memoryQueue) Retry(task ReplicationTask) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	name := taskName(task)
+	if current, found := q.tasks[name]; found && current.ID == task.ID {
+		q.tasks[name] = task
+	}
+	return nil
+}
+
+type fileQueue struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+// NewFileQueue returns a ReplicationQueue that keeps each task in a file
+// within a directory, so that tasks survive restarts. The directory must not
+// be shared between processes.
+func NewFileQueue(dir string) (ReplicationQueue, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Replication queue error: directory not set")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Replication queue error: %s", err.Error())
+	}
+	return &fileQueue{dir: dir}, nil
+}
+
+func (q *fileQueue) path(task ReplicationTask) string {
+	return filepath.Join(q.dir, taskName(task)+".json")
+}
+
+// write replaces the file of a task. The task is written to a temporary
+// file which is synced and renamed into place, so a crash never leaves a
+// partially written task behind.
+func (q *fileQueue) write(task ReplicationTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(q.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), q.path(task)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (q *fileQueue) read(path string) (ReplicationTask, error) {
+	var task ReplicationTask
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return task, err
+	}
+	err = json.Unmarshal(data, &task)
+	return task, err
+}
+
+func (q *fileQueue) Push(task ReplicationTask) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.write(task)
+}
+
+func (q *fileQueue) Tasks() ([]ReplicationTask, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []ReplicationTask
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		task, err := q.read(filepath.Join(q.dir, info.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	sortTasks(tasks)
+	return tasks, nil
+}
+
+func (q *fileQueue) Done(task ReplicationTask) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	current, err := q.read(q.path(task))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.ID != task.ID {
+		return nil
+	}
+	if err := os.Remove(q.path(task)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (q *fileQueue) Retry(task ReplicationTask) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	current, err := q.read(q.path(task))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.ID != task.ID {
+		return nil
+	}
+	return q.write(task)
+}
@@ -0,0 +1,23 @@
+package store
+
+import (
+	"fmt"
+)
+
+// objectRange resolves the range selected by GetOptions against an object
+// of the given size. ok is false if the options do not select a range.
+func objectRange(opts GetOptions, size int64) (start, length int64, ok bool, err error) {
+
+	if !opts.Ranged() {
+		return 0, size, false, nil
+	}
+	if opts.Offset < 0 || opts.Length < 0 || opts.Offset >= size {
+		return 0, 0, false, fmt.Errorf("Invalid range: offset %d length %d", opts.Offset, opts.Length)
+	}
+
+	length = size - opts.Offset
+	if opts.Length != 0 && opts.Length < length {
+		length = opts.Length
+	}
+	return opts.Offset, length, true, nil
+}
@@ -0,0 +1,758 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultFailureCooldown is how long a replica that failed is passed over
+// for reads while other replicas are available
+const DefaultFailureCooldown = 30 * time.Second
+
+// maxRetryDelay caps the delay between attempts at a replication task
+const maxRetryDelay = time.Hour
+
+// errNoReplicas is returned by a fan out write once every replica has
+// stopped accepting content
+var errNoReplicas = errors.New("No replica accepted the object")
+
+// Replica is a named store holding a copy of every object
+type Replica struct {
+	Name  string
+	Store ObjectStore
+}
+
+// ReplicaStatus describes the health of a replica
+type ReplicaStatus struct {
+	Name    string
+	Healthy bool
+
+	LastSuccessAt time.Time
+	LastErrorAt   time.Time
+	LastError     string
+
+	// Pending is the number of queued writes to the replica
+	Pending int
+}
+
+// ReplicatorOpts are provided to configure replication
+type ReplicatorOpts struct {
+	Replicas []Replica
+
+	// Async writes content to one replica before returning and leaves the
+	// others to the replication queue. Otherwise content is written to all
+	// replicas at once.
+	Async bool
+
+	// Quorum is the number of replicas that must accept a write for it to
+	// succeed when writing synchronously. Zero means all of them. Replicas
+	// that failed are caught up through the replication queue.
+	Quorum int
+
+	// Queue durably records writes still to be made to replicas
+	Queue ReplicationQueue
+
+	// FailureCooldown is how long a replica that failed is passed over for
+	// reads. Defaults to DefaultFailureCooldown.
+	FailureCooldown time.Duration
+
+	// RetryDelay is the delay before a failed replication task is retried.
+	// It doubles with each further attempt, up to an hour.
+	RetryDelay time.Duration
+}
+
+// Replicator is an ObjectStore that keeps a copy of every object in each of
+// several replicas. Reads are served by the first healthy replica holding
+// the object, falling back to the others.
+type Replicator struct {
+	opts     ReplicatorOpts
+	replicas []Replica
+	quorum   int
+
+	mutex  sync.Mutex
+	status map[string]*ReplicaStatus
+}
+
+// NewReplicator returns a Replicator over the given replicas, in order of
+// preference for reads
+func NewReplicator(opts ReplicatorOpts) (*Replicator, error) {
+
+	if len(opts.Replicas) == 0 {
+		return nil, fmt.Errorf("Replication error: no replicas")
+	}
+	if opts.Queue == nil {
+		return nil, fmt.Errorf("Replication error: queue not set")
+	}
+	quorum := opts.Quorum
+	if quorum <= 0 || quorum > len(opts.Replicas) {
+		quorum = len(opts.Replicas)
+	}
+	if opts.Async {
+		quorum = 1
+	}
+	if opts.FailureCooldown <= 0 {
+		opts.FailureCooldown = DefaultFailureCooldown
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = time.Second
+	}
+
+	status := map[string]*ReplicaStatus{}
+	for _, replica := range opts.Replicas {
+		if !backendNameRegex.MatchString(replica.Name) {
+			return nil, fmt.Errorf("Invalid replica name: '%s'", replica.Name)
+		}
+		if _, found := status[replica.Name]; found {
+			return nil, fmt.Errorf("Duplicate replica name: '%s'", replica.Name)
+		}
+		status[replica.Name] = &ReplicaStatus{Name: replica.Name, Healthy: true}
+	}
+
+	return &Replicator{
+		opts:     opts,
+		replicas: opts.Replicas,
+		quorum:   quorum,
+		status:   status,
+	}, nil
+}
+
+// record notes the outcome of an operation on a replica. Missing objects,
+// unsupported operations and cancelled requests say nothing of its health.
+func (r *Replicator) record(replica string, err error) {
+	if err == ErrNotFound || err == ErrNotSupported || err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.status[replica]
+	if err == nil {
+		status.LastSuccessAt = time.Now()
+		status.Healthy = true
+		return
+	}
+	status.LastErrorAt = time.Now()
+	status.LastError = err.Error()
+	status.Healthy = false
+}
+
+// healthy returns true unless the replica failed recently and has not
+// succeeded since
+func (r *Replicator) healthy(replica string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.status[replica]
+	return status.Healthy || time.Since(status.LastErrorAt) > r.opts.FailureCooldown
+}
+
+// readOrder returns the replicas in order of preference for reads: healthy
+// replicas first, then those that failed recently as a last resort
+func (r *Replicator) readOrder() []Replica {
+	var healthy, unhealthy []Replica
+	for _, replica := range r.replicas {
+		if r.healthy(replica.Name) {
+			healthy = append(healthy, replica)
+		} else {
+			unhealthy = append(unhealthy, replica)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (r *Replicator) replica(name string) (Replica, bool) {
+	for _, replica := range r.replicas {
+		if replica.Name == name {
+			return replica, true
+		}
+	}
+	return Replica{}, false
+}
+
+// Status returns the status of each replica
+func (r *Replicator) Status() ([]ReplicaStatus, error) {
+	tasks, err := r.opts.Queue.Tasks()
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var statuses []ReplicaStatus
+	for _, replica := range r.replicas {
+		status := *r.status[replica.Name]
+		status.Healthy = status.Healthy || time.Since(status.LastErrorAt) > r.opts.FailureCooldown
+		for _, task := range tasks {
+			if task.Replica == replica.Name {
+				status.Pending++
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// enqueue records an operation still to be made on the given replicas
+func (r *Replicator) enqueue(op, key string, replicas []Replica) error {
+	for _, replica := range replicas {
+		if err := r.opts.Queue.Push(newTask(op, key, replica.Name)); err != nil {
+			return fmt.Errorf("Replication queue error: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// settle checks that a write was accepted by a quorum of replicas and
+// queues the write for those that failed
+func (r *Replicator) settle(op, key string, failed []Replica, errs []error) error {
+	if len(r.replicas)-len(failed) < r.quorum {
+		for _, err := range errs {
+			if err != ErrNotFound {
+				return err
+			}
+		}
+		return errs[0]
+	}
+	return r.enqueue(op, key, failed)
+}
+
+// Get returns the object from the first replica in read order that holds
+// it. Stores may fetch objects lazily and only report an error on the first
+// read, so a replica is only taken to have served the object once content
+// has been read from it, and reading moves on to the next replica until
+// then.
+func (r *Replicator) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	reader := &replicaReader{
+		ctx:        ctx,
+		replicator: r,
+		objectName: objectName,
+		opts:       opts,
+		replicas:   r.readOrder(),
+		lastErr:    ErrNotFound,
+	}
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// replicaReader reads an object from the replicas holding it, failing over
+// to the next replica while the first read from one fails
+type replicaReader struct {
+	ctx        context.Context
+	replicator *Replicator
+	objectName string
+	opts       GetOptions
+
+	replicas []Replica // Replicas not yet tried
+	current  Replica
+	obj      io.ReadCloser
+	started  bool
+	lastErr  error
+}
+
+// open gets the object from the next replica that returns it
+func (rr *replicaReader) open() error {
+	for len(rr.replicas) > 0 {
+		replica := rr.replicas[0]
+		rr.replicas = rr.replicas[1:]
+		obj, err := replica.Store.Get(rr.ctx, rr.objectName, rr.opts)
+		if err == nil {
+			rr.current, rr.obj = replica, obj
+			return nil
+		}
+		if err := rr.fail(replica, err); err != nil {
+			return err
+		}
+	}
+	return rr.lastErr
+}
+
+// fail records an error getting the object from a replica, returning it if
+// no other replica should be tried
+func (rr *replicaReader) fail(replica Replica, err error) error {
+	rr.replicator.record(replica.Name, err)
+	if rr.ctx.Err() != nil {
+		return err
+	}
+	if err != ErrNotFound {
+		rr.lastErr = err
+	}
+	return nil
+}
+
+func (rr *replicaReader) Read(p []byte) (int, error) {
+	for {
+		if rr.obj == nil {
+			return 0, rr.lastErr
+		}
+		n, err := rr.obj.Read(p)
+		if rr.started {
+			if err != nil && err != io.EOF {
+				rr.replicator.record(rr.current.Name, err)
+			}
+			return n, err
+		}
+		if n > 0 || err == nil || err == io.EOF {
+			if n > 0 || err == io.EOF {
+				rr.started = true
+				rr.replicator.record(rr.current.Name, nil)
+			}
+			return n, err
+		}
+
+		// Nothing has been read, so the next replica can take over
+		rr.obj.Close()
+		rr.obj = nil
+		if failErr := rr.fail(rr.current, err); failErr != nil {
+			rr.lastErr = failErr
+			return 0, failErr
+		}
+		if openErr := rr.open(); openErr != nil {
+			rr.lastErr = openErr
+			return 0, openErr
+		}
+	}
+}
+
+func (rr *replicaReader) Close() error {
+	if rr.obj == nil {
+		return nil
+	}
+	return rr.obj.Close()
+}
+
+func (r *Replicator) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	_, info, err := r.locate(ctx, objectName, nil)
+	return info, err
+}
+
+// locate returns the first replica holding an object, other than the one
+// excluded, in order of preference for reads
+func (r *Replicator) locate(ctx context.Context, objectName string, exclude *Replica) (Replica, ObjectInfo, error) {
+	var lastErr error = ErrNotFound
+	for _, replica := range r.readOrder() {
+		if exclude != nil && replica.Name == exclude.Name {
+			continue
+		}
+		info, err := replica.Store.Stat(ctx, objectName)
+		r.record(replica.Name, err)
+		if err == nil {
+			return replica, info, nil
+		}
+		if ctx.Err() != nil {
+			return Replica{}, ObjectInfo{}, err
+		}
+		if err != ErrNotFound {
+			lastErr = err
+		}
+	}
+	return Replica{}, ObjectInfo{}, lastErr
+}
+
+// Put writes to every replica at once when synchronous, feeding all of
+// them from the one reader. Asynchronous writes go to one replica alone,
+// the first in read order that accepts the object.
+func (r *Replicator) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (int64, error) {
+
+	if r.opts.Async {
+		target, n, err := r.putFirst(ctx, objectName, reader, size, opts)
+		if err != nil {
+			return n, err
+		}
+		var others []Replica
+		for _, replica := range r.replicas {
+			if replica.Name != target.Name {
+				others = append(others, replica)
+			}
+		}
+		return n, r.enqueue(OpPut, objectName, others)
+	}
+
+	n, errs, err := putAll(ctx, r.replicas, objectName, reader, size, opts)
+	var failed []Replica
+	var failures []error
+	for i, target := range r.replicas {
+		r.record(target.Name, errs[i])
+		if errs[i] != nil {
+			failed = append(failed, target)
+			failures = append(failures, errs[i])
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	if len(failed) == len(r.replicas) {
+		return n, failures[0]
+	}
+	return n, r.settle(OpPut, objectName, failed, failures)
+}
+
+// putFirst writes an object to the first replica in read order that
+// accepts it. A replica that fails is passed over for the next while none
+// of the content has been read, or while the content can be read again by
+// seeking back to where it started. Errors reading the content itself are
+// returned as they are.
+func (r *Replicator) putFirst(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (Replica, int64, error) {
+
+	source := &sourceReader{Reader: reader}
+	seeker, _ := reader.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	var lastErr error = errNoReplicas
+	for _, replica := range r.readOrder() {
+		if source.n > 0 {
+			if seeker == nil {
+				break
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				break
+			}
+			source.n = 0
+		}
+		n, err := replica.Store.Put(ctx, objectName, source, size, opts)
+		if source.err != nil {
+			return Replica{}, n, source.err
+		}
+		r.record(replica.Name, err)
+		if err == nil {
+			return replica, n, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return Replica{}, 0, lastErr
+}
+
+// sourceReader counts the content read for a write and keeps the error
+// reading it, if any, apart from errors of the store written to
+type sourceReader struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+func (sr *sourceReader) Read(p []byte) (int, error) {
+	n, err := sr.Reader.Read(p)
+	sr.n += int64(n)
+	if err != nil && err != io.EOF {
+		sr.err = err
+	}
+	return n, err
+}
+
+// putAll streams content to several stores at once through pipes. A store
+// that fails stops being fed without holding up the others. The error
+// returned is that of reading the content, if any; errors of the stores are
+// returned in order.
+func putAll(ctx context.Context, targets []Replica, objectName string, reader io.Reader, size int64, opts PutOptions) (int64, []error, error) {
+
+	writers := make([]*io.PipeWriter, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, target Replica, pr *io.PipeReader) {
+			defer wg.Done()
+			_, errs[i] = target.Store.Put(ctx, objectName, pr, size, opts)
+			// Unblock the writer if the store stopped reading early
+			pr.CloseWithError(errNoReplicas)
+		}(i, target, pr)
+	}
+
+	fan := &fanoutWriter{writers: append([]*io.PipeWriter(nil), writers...)}
+	n, err := io.Copy(fan, reader)
+	if err == errNoReplicas {
+		err = nil
+	}
+	for _, w := range writers {
+		if err != nil {
+			w.CloseWithError(err)
+		} else {
+			w.Close()
+		}
+	}
+	wg.Wait()
+	return n, errs, err
+}
+
+// fanoutWriter writes to several pipes, dropping any whose reader has gone
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	live := 0
+	for i, w := range f.writers {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.writers[i] = nil
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errNoReplicas
+	}
+	return len(p), nil
+}
+
+func (r *Replicator) Remove(ctx context.Context, objectName string) error {
+	var failed []Replica
+	var failures []error
+	for _, replica := range r.replicas {
+		err := replica.Store.Remove(ctx, objectName)
+		r.record(replica.Name, err)
+		if err != nil {
+			failed = append(failed, replica)
+			failures = append(failures, err)
+		}
+	}
+	return r.settle(OpRemove, objectName, failed, failures)
+}
+
+// Copy copies within each replica. Replicas that have yet to receive the
+// source, or fail to copy it, are caught up through the replication queue.
+func (r *Replicator) Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error {
+	var failed []Replica
+	var failures []error
+	for _, replica := range r.replicas {
+		err := replica.Store.Copy(ctx, srcName, dstName, opts)
+		r.record(replica.Name, err)
+		if err != nil {
+			failed = append(failed, replica)
+			failures = append(failures, err)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return r.settle(OpPut, dstName, failed, failures)
+}
+
+// List lists the objects of the first healthy replica
+func (r *Replicator) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	var lastErr error
+	for _, replica := range r.readOrder() {
+		result, err := replica.Store.List(ctx, opts)
+		r.record(replica.Name, err)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return ListResult{}, err
+		}
+		lastErr = err
+	}
+	return ListResult{}, lastErr
+}
+
+// PresignGet presigns a download from the first replica holding the object
+// that supports it
+func (r *Replicator) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	var lastErr error = ErrNotFound
+	for _, replica := range r.readOrder() {
+		_, err := replica.Store.Stat(ctx, objectName)
+		r.record(replica.Name, err)
+		if err == nil {
+			var u *url.URL
+			if u, err = replica.Store.PresignGet(ctx, objectName, opts); err != ErrNotSupported {
+				return u, err
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != ErrNotFound {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// PresignPut is not supported, since content uploaded directly to one
+// replica would bypass replication
+func (r *Replicator) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	return nil, ErrNotSupported
+}
+
+// Replicate attempts the queued replication tasks that are due, returning
+// the number completed. Tasks that fail are retried later with a growing
+// delay.
+func (r *Replicator) Replicate(ctx context.Context) (int, error) {
+
+	tasks, err := r.opts.Queue.Tasks()
+	if err != nil {
+		return 0, err
+	}
+	done := 0
+	for _, task := range tasks {
+		if ctx.Err() != nil {
+			return done, ctx.Err()
+		}
+		if time.Now().Before(task.NotBefore) {
+			continue
+		}
+		err := r.apply(ctx, task)
+		if err == nil {
+			if err := r.opts.Queue.Done(task); err != nil {
+				return done, err
+			}
+			done++
+			continue
+		}
+		task.Attempts++
+		task.LastError = err.Error()
+		task.NotBefore = time.Now().Add(r.retryDelay(task.Attempts))
+		if err := r.opts.Queue.Retry(task); err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (r *Replicator) retryDelay(attempts int) time.Duration {
+	delay := r.opts.RetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// apply carries out a replication task. Tasks for replicas no longer
+// configured, and copies of objects no replica holds any more, are dropped.
+func (r *Replicator) apply(ctx context.Context, task ReplicationTask) error {
+
+	target, found := r.replica(task.Replica)
+	if !found {
+		return nil
+	}
+
+	switch task.Op {
+	case OpRemove:
+		err := target.Store.Remove(ctx, task.Key)
+		r.record(target.Name, err)
+		return err
+	case OpPut:
+		source, info, err := r.locate(ctx, task.Key, &target)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return r.transfer(ctx, source, target, info)
+	default:
+		return nil
+	}
+}
+
+// transfer copies an object between replicas, keeping its metadata
+func (r *Replicator) transfer(ctx context.Context, source, target Replica, info ObjectInfo) error {
+	obj, err := source.Store.Get(ctx, info.Key, GetOptions{})
+	r.record(source.Name, err)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	opts := PutOptions{ContentType: info.ContentType, Metadata: info.Metadata}
+	_, err = target.Store.Put(ctx, info.Key, obj, info.Size, opts)
+	r.record(target.Name, err)
+	return err
+}
+
+// RepairOptions describe the content expected of an object being repaired
+type RepairOptions struct {
+	// Size of the object, or -1 if not known
+	Size int64
+
+	// SHA256 is the hex digest of the content, if known. Checking it reads
+	// the object from every replica.
+	SHA256 string
+}
+
+// Repair checks every replica of an object and copies it again to those
+// where it is missing or does not match what is expected, returning the
+// names of the replicas repaired
+func (r *Replicator) Repair(ctx context.Context, objectName string, opts RepairOptions) ([]string, error) {
+
+	var intact *Replica
+	var intactInfo ObjectInfo
+	var broken []Replica
+
+	for i, replica := range r.replicas {
+		info, err := replica.Store.Stat(ctx, objectName)
+		r.record(replica.Name, err)
+		if err == ErrNotFound {
+			broken = append(broken, replica)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to check replica '%s': %s", replica.Name, err.Error())
+		}
+		ok := opts.Size < 0 || info.Size == opts.Size
+		if ok && opts.SHA256 != "" {
+			sum, err := r.digest(ctx, replica, objectName)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to check replica '%s': %s", replica.Name, err.Error())
+			}
+			ok = sum == opts.SHA256
+		}
+		if !ok {
+			broken = append(broken, replica)
+			continue
+		}
+		if intact == nil {
+			intact = &r.replicas[i]
+			intactInfo = info
+		}
+	}
+
+	if len(broken) == 0 {
+		return nil, nil
+	}
+	if intact == nil {
+		return nil, fmt.Errorf("No intact replica of '%s'", objectName)
+	}
+	var repaired []string
+	for _, replica := range broken {
+		if err := r.transfer(ctx, *intact, replica, intactInfo); err != nil {
+			return repaired, fmt.Errorf("Failed to repair replica '%s': %s", replica.Name, err.Error())
+		}
+		repaired = append(repaired, replica.Name)
+	}
+	return repaired, nil
+}
+
+// digest returns the hex SHA-256 digest of an object held by a replica
+func (r *Replicator) digest(ctx context.Context, replica Replica, objectName string) (string, error) {
+	obj, err := replica.Store.Get(ctx, objectName, GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, obj); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
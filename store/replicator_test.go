@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// lazyStore is an ObjectStore that, like Minio, returns objects without
+// fetching them and reports errors on the first read instead
+type lazyStore struct {
+	ObjectStore
+	err error
+}
+
+func (s *lazyStore) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	return &lazyObject{err: s.err}, nil
+}
+
+type lazyObject struct {
+	err error
+}
+
+func (o *lazyObject) Read(p []byte) (int, error) {
+	return 0, o.err
+}
+
+func (o *lazyObject) Close() error {
+	return nil
+}
+
+func newTestReplicator(t *testing.T, replicas ...Replica) *Replicator {
+	r, err := NewReplicator(ReplicatorOpts{Replicas: replicas, Queue: NewMemoryQueue()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReplicatorGetFailover(t *testing.T) {
+	ctx := context.Background()
+	healthy := NewMemoryObjectStore()
+	if _, err := healthy.Put(ctx, "a", strings.NewReader("content"), -1, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	failing := &lazyStore{ObjectStore: NewMemoryObjectStore(), err: errors.New("Connection refused")}
+	r := newTestReplicator(t, Replica{Name: "failing", Store: failing}, Replica{Name: "healthy", Store: healthy})
+
+	obj, err := r.Get(ctx, "a", GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Errorf("Read %q, expected the content of the healthy replica", data)
+	}
+
+	statuses, err := r.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.Healthy != (status.Name == "healthy") {
+			t.Errorf("Replica %s has health %v", status.Name, status.Healthy)
+		}
+	}
+	if order := r.readOrder(); order[0].Name != "healthy" {
+		t.Errorf("Expected the healthy replica to be read first, got %s", order[0].Name)
+	}
+}
+
+func TestReplicatorGetMissing(t *testing.T) {
+	missing := &lazyStore{ObjectStore: NewMemoryObjectStore(), err: ErrNotFound}
+	r := newTestReplicator(t, Replica{Name: "a", Store: missing}, Replica{Name: "b", Store: NewMemoryObjectStore()})
+
+	obj, err := r.Get(context.Background(), "a", GetOptions{})
+	if err == nil {
+		_, err = ioutil.ReadAll(obj)
+		obj.Close()
+	}
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if !r.healthy("a") {
+		t.Error("Expected a missing object to leave the replica healthy")
+	}
+}
+
+// brokenStore is an ObjectStore whose writes fail after reading part of the
+// content
+type brokenStore struct {
+	ObjectStore
+}
+
+func (s *brokenStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (int64, error) {
+	n, _ := reader.Read(make([]byte, 2))
+	return int64(n), errors.New("Connection reset")
+}
+
+func TestReplicatorAsyncPutFailover(t *testing.T) {
+	ctx := context.Background()
+	healthy := NewMemoryObjectStore()
+	r, err := NewReplicator(ReplicatorOpts{
+		Replicas: []Replica{{Name: "broken", Store: &brokenStore{NewMemoryObjectStore()}}, {Name: "healthy", Store: healthy}},
+		Async:    true,
+		Queue:    NewMemoryQueue(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Content that can be read again is written to the next replica
+	if _, err := r.Put(ctx, "a", strings.NewReader("content"), -1, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := healthy.Get(ctx, "a", GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Errorf("Replica holds %q, expected the whole content", data)
+	}
+	tasks, err := r.opts.Queue.Tasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Replica != "broken" {
+		t.Errorf("Expected the failed replica to be caught up, got %+v", tasks)
+	}
+	if r.healthy("broken") || !r.healthy("healthy") {
+		t.Error("Expected the failed replica to be marked unhealthy")
+	}
+
+	// The healthy replica is now tried first
+	if _, err := r.Put(ctx, "b", ioutil.NopCloser(strings.NewReader("content")), -1, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Content already partly read can not be written elsewhere
+	r.record("healthy", errors.New("Connection refused"))
+	r.record("broken", nil)
+	if _, err := r.Put(ctx, "c", ioutil.NopCloser(strings.NewReader("content")), -1, PutOptions{}); err == nil {
+		t.Error("Expected a write of content that can not be read again to fail")
+	}
+}
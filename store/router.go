@@ -0,0 +1,253 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// backendSeparator separates the backend name from the object key in keys
+// given to a Router
+const backendSeparator = ":"
+
+var backendNameRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Mount routes blobs at and beneath a path prefix to a named backend
+type Mount struct {
+	Prefix  string
+	Backend string
+}
+
+// Router is an ObjectStore that spreads objects over several backends. It
+// chooses a backend for new objects by the path of their blob, following
+// mount rules, and locates existing objects by keys qualified with the name
+// of their backend, so that objects are found wherever they were stored
+// even after the rules change. Unqualified keys refer to the default
+// backend.
+type Router struct {
+	backends map[string]ObjectStore
+	fallback ObjectStore
+	mounts   []Mount
+}
+
+// PathRouter is implemented by stores that choose a backend by blob path
+type PathRouter interface {
+	// Route returns the name of the backend for blobs at the path, or an
+	// empty string for the default backend
+	Route(path string) string
+}
+
+// NewRouter returns a Router over the named backends, which uses the
+// fallback store for blobs not covered by any mount
+func NewRouter(fallback ObjectStore, backends map[string]ObjectStore, mounts []Mount) (*Router, error) {
+
+	for name := range backends {
+		if !backendNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("Invalid backend name: '%s'", name)
+		}
+	}
+
+	var sorted []Mount
+	for _, m := range mounts {
+		prefix := strings.TrimSuffix(strings.TrimSuffix(m.Prefix, "**"), "/")
+		if !strings.HasPrefix(m.Prefix, "/") {
+			return nil, fmt.Errorf("Invalid mount prefix: '%s'", m.Prefix)
+		}
+		if _, found := backends[m.Backend]; !found {
+			return nil, fmt.Errorf("Unknown backend for mount '%s': '%s'", m.Prefix, m.Backend)
+		}
+		sorted = append(sorted, Mount{Prefix: prefix, Backend: m.Backend})
+	}
+
+	// The longest matching prefix wins
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+
+	return &Router{
+		backends: backends,
+		fallback: fallback,
+		mounts:   sorted,
+	}, nil
+}
+
+// Route returns the name of the backend for blobs at the path, or an empty
+// string for the default backend. A mount prefix covers the path itself and
+// every path beneath it.
+func (r *Router) Route(path string) string {
+	for _, m := range r.mounts {
+		if m.Prefix == "" || path == m.Prefix || strings.HasPrefix(path, m.Prefix+"/") {
+			return m.Backend
+		}
+	}
+	return ""
+}
+
+// HasBackend returns true if the Router has a backend with the given name
+func (r *Router) HasBackend(name string) bool {
+	_, found := r.backends[name]
+	return found
+}
+
+// BackendKey qualifies an object key with the name of the backend holding
+// it. Keys for the default backend are left as they are.
+func BackendKey(backend, key string) string {
+	if backend == "" {
+		return key
+	}
+	return backend + backendSeparator + key
+}
+
+// locate returns the backend and unqualified key for a key. Anything before
+// the separator that could not be a backend name, such as a key holding a
+// colon in its extension, belongs to an unqualified key.
+func (r *Router) locate(key string) (ObjectStore, string, string, error) {
+	i := strings.Index(key, backendSeparator)
+	if i < 0 || !backendNameRegex.MatchString(key[:i]) {
+		return r.fallback, "", key, nil
+	}
+	name := key[:i]
+	backend, found := r.backends[name]
+	if !found {
+		return nil, "", "", fmt.Errorf("Unknown backend: '%s'", name)
+	}
+	return backend, name, key[i+1:], nil
+}
+
+func (r *Router) Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error) {
+	backend, _, key, err := r.locate(objectName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Get(ctx, key, opts)
+}
+
+func (r *Router) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts PutOptions) (int64, error) {
+	backend, _, key, err := r.locate(objectName)
+	if err != nil {
+		return 0, err
+	}
+	return backend.Put(ctx, key, reader, size, opts)
+}
+
+func (r *Router) Remove(ctx context.Context, objectName string) error {
+	backend, _, key, err := r.locate(objectName)
+	if err != nil {
+		return err
+	}
+	return backend.Remove(ctx, key)
+}
+
+func (r *Router) Stat(ctx context.Context, objectName string) (ObjectInfo, error) {
+	backend, _, key, err := r.locate(objectName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := backend.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.Key = objectName
+	return info, nil
+}
+
+// Copy copies within a backend where possible. Copies between backends are
+// streamed through this process, keeping the source metadata unless other
+// options are given.
+func (r *Router) Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error {
+	src, srcBackend, srcKey, err := r.locate(srcName)
+	if err != nil {
+		return err
+	}
+	dst, dstBackend, dstKey, err := r.locate(dstName)
+	if err != nil {
+		return err
+	}
+	if srcBackend == dstBackend {
+		return src.Copy(ctx, srcKey, dstKey, opts)
+	}
+
+	info, err := src.Stat(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if opts.Empty() {
+		opts = PutOptions{ContentType: info.ContentType, Metadata: info.Metadata}
+	}
+	obj, err := src.Get(ctx, srcKey, GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	_, err = dst.Put(ctx, dstKey, obj, info.Size, opts)
+	return err
+}
+
+// Compose assembles an object within its backend, if the backend can and
+// holds every source
+func (r *Router) Compose(ctx context.Context, dstName string, srcNames []string, opts PutOptions) error {
+	dst, dstBackend, dstKey, err := r.locate(dstName)
+	if err != nil {
+		return err
+	}
+	composer, ok := dst.(Composer)
+	if !ok {
+		return ErrNotSupported
+	}
+	keys := make([]string, len(srcNames))
+	for i, name := range srcNames {
+		_, backend, key, err := r.locate(name)
+		if err != nil {
+			return err
+		}
+		if backend != dstBackend {
+			return ErrNotSupported
+		}
+		keys[i] = key
+	}
+	return composer.Compose(ctx, dstKey, keys, opts)
+}
+
+// List lists the objects of one backend, chosen by qualifying the prefix
+// with its name. The keys listed are qualified in the same way.
+func (r *Router) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	backend, name, prefix, err := r.locate(opts.Prefix)
+	if err != nil {
+		return ListResult{}, err
+	}
+	after := opts.After
+	if name != "" {
+		after = strings.TrimPrefix(after, name+backendSeparator)
+	}
+	result, err := backend.List(ctx, ListOptions{Prefix: prefix, After: after, Limit: opts.Limit})
+	if err != nil {
+		return ListResult{}, err
+	}
+	for i := range result.Objects {
+		result.Objects[i].Key = BackendKey(name, result.Objects[i].Key)
+	}
+	if result.Next != "" {
+		result.Next = BackendKey(name, result.Next)
+	}
+	return result, nil
+}
+
+func (r *Router) PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	backend, _, key, err := r.locate(objectName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.PresignGet(ctx, key, opts)
+}
+
+func (r *Router) PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error) {
+	backend, _, key, err := r.locate(objectName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.PresignPut(ctx, key, opts)
+}
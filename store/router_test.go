@@ -0,0 +1,179 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func newTestRouter(t *testing.T, mounts ...Mount) (*Router, map[string]ObjectStore) {
+	backends := map[string]ObjectStore{
+		"":     NewMemoryObjectStore(),
+		"cold": NewMemoryObjectStore(),
+		"fast": NewMemoryObjectStore(),
+	}
+	r, err := NewRouter(backends[""], map[string]ObjectStore{
+		"cold": backends["cold"],
+		"fast": backends["fast"],
+	}, mounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, backends
+}
+
+func TestRouterRoute(t *testing.T) {
+	r, _ := newTestRouter(t,
+		Mount{Prefix: "/archive/**", Backend: "cold"},
+		Mount{Prefix: "/archive/hot", Backend: "fast"},
+		Mount{Prefix: "/scratch/", Backend: "fast"},
+	)
+	tests := []struct {
+		path    string
+		backend string
+	}{
+		{"/a.txt", ""},
+		{"/archive", "cold"},
+		{"/archive/a.txt", "cold"},
+		{"/archive/hot", "fast"},
+		{"/archive/hot/a.txt", "fast"},
+		{"/archive/hotter/a.txt", "cold"},
+		{"/archived/a.txt", ""},
+		{"/scratch/a.txt", "fast"},
+	}
+	for _, test := range tests {
+		if got := r.Route(test.path); got != test.backend {
+			t.Errorf("Route(%q) = %q, want %q", test.path, got, test.backend)
+		}
+	}
+
+	r, _ = newTestRouter(t, Mount{Prefix: "/**", Backend: "cold"})
+	if got := r.Route("/a.txt"); got != "cold" {
+		t.Errorf("Expected a root mount to cover every path, got %q", got)
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	fallback := NewMemoryObjectStore()
+	backends := map[string]ObjectStore{"cold": NewMemoryObjectStore()}
+	tests := []struct {
+		backends map[string]ObjectStore
+		mounts   []Mount
+	}{
+		{map[string]ObjectStore{"Cold": fallback}, nil},
+		{map[string]ObjectStore{"a:b": fallback}, nil},
+		{backends, []Mount{{Prefix: "archive/**", Backend: "cold"}}},
+		{backends, []Mount{{Prefix: "/archive/**", Backend: "warm"}}},
+	}
+	for _, test := range tests {
+		if _, err := NewRouter(fallback, test.backends, test.mounts); err == nil {
+			t.Errorf("Expected backends %v with mounts %v to be invalid", test.backends, test.mounts)
+		}
+	}
+}
+
+func TestRouterLocate(t *testing.T) {
+	ctx := context.Background()
+	r, backends := newTestRouter(t)
+
+	tests := []struct {
+		key     string
+		backend string
+		object  string
+	}{
+		{"a/b.txt", "", "a/b.txt"},
+		{BackendKey("", "a/b.txt"), "", "a/b.txt"},
+		{BackendKey("cold", "a/b.txt"), "cold", "a/b.txt"},
+		{"a.x:y", "", "a.x:y"},
+		{"a/b:c", "", "a/b:c"},
+	}
+	for _, test := range tests {
+		if _, err := r.Put(ctx, test.key, strings.NewReader(test.key), -1, PutOptions{}); err != nil {
+			t.Fatalf("Put %q: %v", test.key, err)
+		}
+		if _, err := backends[test.backend].Stat(ctx, test.object); err != nil {
+			t.Errorf("Expected %q in backend %q as %q: %v", test.key, test.backend, test.object, err)
+		}
+		info, err := r.Stat(ctx, test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != test.key {
+			t.Errorf("Stat of %q reports key %q", test.key, info.Key)
+		}
+	}
+
+	if _, err := r.Stat(ctx, BackendKey("warm", "a/b.txt")); err == nil || err == ErrNotFound {
+		t.Errorf("Expected an unknown backend to be an error, got %v", err)
+	}
+	if !r.HasBackend("cold") || r.HasBackend("warm") {
+		t.Error("Unexpected backends")
+	}
+
+	result, err := r.List(ctx, ListOptions{Prefix: BackendKey("cold", "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Key != BackendKey("cold", "a/b.txt") {
+		t.Errorf("Unexpected listing of the cold backend: %+v", result.Objects)
+	}
+}
+
+func TestRouterCopy(t *testing.T) {
+	ctx := context.Background()
+	r, backends := newTestRouter(t)
+
+	opts := PutOptions{ContentType: "text/plain", Metadata: map[string]string{"id": "1"}}
+	if _, err := r.Put(ctx, "a", strings.NewReader("content"), -1, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Between backends the content is streamed, keeping its metadata
+	dst := BackendKey("cold", "b")
+	if err := r.Copy(ctx, "a", dst, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := backends["cold"].Stat(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "text/plain" || info.Metadata["id"] != "1" {
+		t.Errorf("Copy between backends lost metadata: %+v", info)
+	}
+	obj, err := r.Get(ctx, dst, GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("Unexpected copied content %q", content)
+	}
+
+	// Within a backend, including between two of its keys
+	if err := r.Copy(ctx, dst, BackendKey("cold", "c"), PutOptions{ContentType: "text/csv"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = backends["cold"].Stat(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "text/csv" {
+		t.Errorf("Expected the copy to take the options given, got %+v", info)
+	}
+
+	// Objects are composed only within one backend
+	err = r.Compose(ctx, BackendKey("cold", "d"), []string{"a", dst}, PutOptions{})
+	if err != ErrNotSupported {
+		t.Errorf("Expected composing across backends to be unsupported, got %v", err)
+	}
+	if err := r.Compose(ctx, BackendKey("cold", "d"), []string{dst, BackendKey("cold", "c")}, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = backends["cold"].Stat(ctx, "d"); err != nil || info.Size != 14 {
+		t.Errorf("Unexpected composed object %+v: %v", info, err)
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"io"
+)
+
+// Section is the part of an object read by a sequence reader
+type Section struct {
+	Name string
+	GetOptions
+}
+
+// WholeObjects returns sections reading the whole of each named object
+func WholeObjects(names []string) []Section {
+	sections := make([]Section, len(names))
+	for i, name := range names {
+		sections[i].Name = name
+	}
+	return sections
+}
+
+// NewSequenceReader returns a reader of sections of objects in turn as one
+// stream. Each object is only opened once it is reached.
+func NewSequenceReader(ctx context.Context, s ObjectStore, sections []Section) io.ReadCloser {
+	return &sequenceReader{ctx: ctx, store: s, sections: sections}
+}
+
+type sequenceReader struct {
+	ctx      context.Context
+	store    ObjectStore
+	sections []Section
+	current  io.ReadCloser
+}
+
+func (r *sequenceReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.sections) == 0 {
+				return 0, io.EOF
+			}
+			section := r.sections[0]
+			obj, err := r.store.Get(r.ctx, section.Name, section.GetOptions)
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.sections = obj, r.sections[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close closes the object being read, if any
+func (r *sequenceReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
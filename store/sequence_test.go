@@ -0,0 +1,42 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSequenceReader(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryObjectStore()
+	for name, content := range map[string]string{"a": "hello ", "b": "", "c": "world"} {
+		if _, err := s.Put(ctx, name, strings.NewReader(content), -1, PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewSequenceReader(ctx, s, WholeObjects([]string{"a", "b", "c"}))
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("Read %q, %v", data, err)
+	}
+
+	sections := []Section{
+		{Name: "a", GetOptions: GetOptions{Offset: 1, Length: 3}},
+		{Name: "c", GetOptions: GetOptions{Offset: 3}},
+	}
+	r = NewSequenceReader(ctx, s, sections)
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "ellld" {
+		t.Errorf("Read %q, %v", data, err)
+	}
+
+	r = NewSequenceReader(ctx, s, WholeObjects([]string{"a", "missing"}))
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound reading a missing object, got %v", err)
+	}
+}
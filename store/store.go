@@ -3,21 +3,137 @@ package store
 //go:generate mockgen -source=store.go -package store -destination mock.go
 
 import (
+	"context"
+	"errors"
 	"io"
-
-	minio "github.com/minio/minio-go"
+	"net/url"
+	"time"
 )
 
-// ObjectStore is an interface used to put, get, and remove objects
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("Object not found")
+
+// ErrNotSupported is returned by stores that do not support an operation,
+// such as presigning URLs
+var ErrNotSupported = errors.New("Operation not supported by object store")
+
+// DefaultListLimit is the number of objects listed when no limit is given
+const DefaultListLimit = 1000
+
+// ObjectStore is an interface used to put, get, list and remove objects.
+// Every call takes a context; cancelling it aborts the call along with any
+// transfer in progress.
 type ObjectStore interface {
 
-	// Get an object from storage
-	Get(objectName string, opts minio.GetObjectOptions) (io.Reader, error)
+	// Get an object, or a range of it, from storage. The returned reader
+	// must be closed. Stores that fetch lazily may report a missing object
+	// from the first Read rather than from Get.
+	Get(ctx context.Context, objectName string, opts GetOptions) (io.ReadCloser, error)
+
+	// Put an object into storage. The size is -1 if it is not known in
+	// advance.
+	Put(ctx context.Context, objectName string, reader io.Reader, size int64,
+		opts PutOptions) (n int64, err error)
+
+	// Remove an object from storage. Removing an object that does not exist
+	// is not an error.
+	Remove(ctx context.Context, objectName string) error
+
+	// Stat returns information about an object without reading it
+	Stat(ctx context.Context, objectName string) (ObjectInfo, error)
+
+	// Copy an object within the store, without its content passing through
+	// the caller. The copy is stored with the given options, or with the
+	// metadata of the source if the options are empty. Copying an object
+	// onto itself replaces its metadata.
+	Copy(ctx context.Context, srcName, dstName string, opts PutOptions) error
+
+	// List objects in key order, one page at a time
+	List(ctx context.Context, opts ListOptions) (ListResult, error)
+
+	// PresignGet returns a URL from which the object may be downloaded
+	// directly until the expiry elapses
+	PresignGet(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error)
+
+	// PresignPut returns a URL to which the object may be uploaded directly
+	// until the expiry elapses
+	PresignPut(ctx context.Context, objectName string, opts PresignOptions) (*url.URL, error)
+}
+
+// Composer is implemented by object stores that can assemble an object from
+// the content of others within the store, such as by an S3 multipart upload
+// copying each source as a part. Sources the store can not assemble, for
+// instance because they are too small to be parts, are reported with
+// ErrNotSupported.
+type Composer interface {
+	Compose(ctx context.Context, dstName string, srcNames []string, opts PutOptions) error
+}
+
+// GetOptions are provided to Get
+type GetOptions struct {
+	// Offset of the first byte to read and the Length of the range to read.
+	// A zero Length reads to the end of the object.
+	Offset int64
+	Length int64
+}
+
+// Ranged returns true if the options select part of an object
+func (o GetOptions) Ranged() bool {
+	return o.Offset != 0 || o.Length != 0
+}
+
+// PutOptions describe how an object is stored
+type PutOptions struct {
+	ContentType        string
+	ContentDisposition string
+
+	// Metadata stored alongside the object
+	Metadata map[string]string
+}
+
+// Empty returns true if no options are set
+func (o PutOptions) Empty() bool {
+	return o.ContentType == "" && o.ContentDisposition == "" && len(o.Metadata) == 0
+}
+
+// ListOptions are provided to List
+type ListOptions struct {
+	// Prefix limits the listing to keys starting with it
+	Prefix string
 
-	// Put an object into storage
-	Put(objectName string, reader io.Reader, size int64,
-		opts minio.PutObjectOptions) (n int64, err error)
+	// After resumes a listing following the given key, which is usually the
+	// Next key of the previous page
+	After string
+
+	// Limit on the number of objects returned, or DefaultListLimit if zero
+	Limit int
+}
+
+// ListResult is one page of a listing
+type ListResult struct {
+	Objects []ObjectInfo
+
+	// Next is set to the key to list after when more objects remain
+	Next string
+}
+
+// PresignOptions are provided to PresignGet and PresignPut
+type PresignOptions struct {
+	Expiry time.Duration
+
+	// Response headers to send with a download instead of those stored with
+	// the object
+	ContentType        string
+	ContentDisposition string
+}
 
-	// Remove an object from storage
-	Remove(objectName string) error
+// ObjectInfo describes a stored object. Stores fill in what they keep;
+// only Key and Size are always set.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	ContentType  string
+	Metadata     map[string]string
 }
@@ -0,0 +1,230 @@
+package store_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/myzie/blobs/store"
+	"github.com/myzie/blobs/store/storetest"
+)
+
+func TestMemoryObjectStore(t *testing.T) {
+	for _, f := range storetest.Run(func() (store.ObjectStore, error) {
+		return store.NewMemoryObjectStore(), nil
+	}) {
+		t.Error(f)
+	}
+}
+
+func TestLocalObjectStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobs-local-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range storetest.Run(func() (store.ObjectStore, error) {
+		dir, err := ioutil.TempDir(root, "")
+		if err != nil {
+			return nil, err
+		}
+		return store.NewLocalObjectStore(store.LocalOpts{Root: dir})
+	}) {
+		t.Error(f)
+	}
+}
+
+func TestReplicator(t *testing.T) {
+	for _, f := range storetest.Run(func() (store.ObjectStore, error) {
+		return store.NewReplicator(store.ReplicatorOpts{
+			Replicas: []store.Replica{
+				{Name: "a", Store: store.NewMemoryObjectStore()},
+				{Name: "b", Store: store.NewMemoryObjectStore()},
+			},
+			Queue: store.NewMemoryQueue(),
+		})
+	}) {
+		t.Error(f)
+	}
+}
+
+func newMasterKey(t *testing.T, id string) store.MasterKey {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return store.MasterKey{ID: id, Key: key}
+}
+
+// newEncryptingStore returns an EncryptingStore over the store with the
+// given master keys, or a new one if none are given
+func newEncryptingStore(t *testing.T, s store.ObjectStore, keys ...store.MasterKey) *store.EncryptingStore {
+	if len(keys) == 0 {
+		keys = []store.MasterKey{newMasterKey(t, "test")}
+	}
+	keyring, err := store.NewKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.NewEncryptingStore(s, keyring)
+}
+
+func TestEncryptingStore(t *testing.T) {
+	for _, f := range storetest.Run(func() (store.ObjectStore, error) {
+		return newEncryptingStore(t, store.NewMemoryObjectStore()), nil
+	}) {
+		t.Error(f)
+	}
+}
+
+func readObject(s store.ObjectStore, name string) (string, error) {
+	obj, err := s.Get(context.Background(), name, store.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	data, err := ioutil.ReadAll(obj)
+	return string(data), err
+}
+
+func TestEncryptingStoreEnvelopeNames(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingStore{ObjectStore: store.NewMemoryObjectStore()}
+	oldKey := newMasterKey(t, "old")
+	s := newEncryptingStore(t, inner, oldKey)
+	for _, name := range []string{"a.x", "a.x#key"} {
+		if _, err := s.Put(ctx, name, strings.NewReader("content"), -1, store.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Put(ctx, ".envelopes/a.x", strings.NewReader("{}"), -1, store.PutOptions{}); err == nil {
+		t.Error("Expected writing an object beneath the envelope prefix to fail")
+	}
+	if err := s.Copy(ctx, "a.x", ".envelopes/b.x", store.PutOptions{}); err == nil {
+		t.Error("Expected copying to an object beneath the envelope prefix to fail")
+	}
+
+	result, err := s.List(ctx, store.ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Key != "a.x" || result.Objects[0].Size != 7 {
+		t.Errorf("Unexpected first page %+v", result)
+	}
+	result, err = s.List(ctx, store.ListOptions{After: result.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Key != "a.x#key" || result.Next != "" {
+		t.Errorf("Unexpected second page %+v", result)
+	}
+
+	// Envelopes left behind by writes that never completed, here without
+	// the size recorded, do not hold up rotation
+	inner.fail = func(name string) bool { return name == ".envelopes/gone" && inner.exists(name) }
+	if _, err := s.Put(ctx, "gone", strings.NewReader("content"), -1, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	inner.fail = nil
+	if err := inner.ObjectStore.Remove(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newEncryptingStore(t, inner, oldKey, newMasterKey(t, "new"))
+	rotated, err := s.RotateAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 2 {
+		t.Errorf("Rotated %d keys, expected 2", rotated)
+	}
+	for _, name := range []string{"a.x", "a.x#key"} {
+		if data, err := readObject(s, name); err != nil || data != "content" {
+			t.Errorf("Read %q, %v", data, err)
+		}
+	}
+}
+
+// recordingStore is an ObjectStore recording the writes made to it. Writes
+// fail while fail returns true for the name written.
+type recordingStore struct {
+	store.ObjectStore
+	fail   func(name string) bool
+	writes []string
+}
+
+func (s *recordingStore) Put(ctx context.Context, objectName string, reader io.Reader, size int64, opts store.PutOptions) (int64, error) {
+	s.writes = append(s.writes, "put "+objectName)
+	if s.fail != nil && s.fail(objectName) {
+		return 0, errors.New("Connection reset")
+	}
+	return s.ObjectStore.Put(ctx, objectName, reader, size, opts)
+}
+
+func (s *recordingStore) Copy(ctx context.Context, srcName, dstName string, opts store.PutOptions) error {
+	s.writes = append(s.writes, "copy "+dstName)
+	if s.fail != nil && s.fail(dstName) {
+		return errors.New("Connection reset")
+	}
+	return s.ObjectStore.Copy(ctx, srcName, dstName, opts)
+}
+
+func (s *recordingStore) exists(name string) bool {
+	_, err := s.ObjectStore.Stat(context.Background(), name)
+	return err == nil
+}
+
+func (s *recordingStore) Remove(ctx context.Context, objectName string) error {
+	s.writes = append(s.writes, "remove "+objectName)
+	return s.ObjectStore.Remove(ctx, objectName)
+}
+
+func TestEncryptingStoreWriteOrder(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingStore{ObjectStore: store.NewMemoryObjectStore()}
+	s := newEncryptingStore(t, inner)
+
+	// The envelope is written before the object and removed after it, so
+	// that encrypted content is never found without its envelope
+	if _, err := s.Put(ctx, "a", strings.NewReader("content"), 7, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Copy(ctx, "a", "b", store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	want := "put .envelopes/a,put a,copy .envelopes/b,copy b,remove a,remove .envelopes/a"
+	if got := strings.Join(inner.writes, ","); got != want {
+		t.Errorf("Writes made in the order %s, want %s", got, want)
+	}
+
+	// Content of unknown size is read correctly even if its size could not
+	// be recorded once known
+	inner.fail = func(name string) bool { return name == ".envelopes/c" && inner.exists(name) }
+	content := strings.Repeat("x", 100000)
+	if _, err := s.Put(ctx, "c", ioutil.NopCloser(strings.NewReader(content)), -1, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readObject(s, "c"); err != nil || data != content {
+		t.Errorf("Read %d bytes, %v", len(data), err)
+	}
+
+	// A failed write leaves neither content nor envelope behind
+	inner.fail = func(name string) bool { return name == "d" }
+	if _, err := s.Put(ctx, "d", strings.NewReader("content"), -1, store.PutOptions{}); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	for _, name := range []string{"d", ".envelopes/d"} {
+		if _, err := inner.Stat(ctx, name); err != store.ErrNotFound {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+}
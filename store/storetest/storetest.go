@@ -0,0 +1,557 @@
+// Package storetest checks that a store.ObjectStore behaves as the rest of
+// the service expects. Every in-tree store is checked by cmd/blobscheck, and
+// new stores can be checked the same way, or from their own tests with:
+//
+//	for _, f := range storetest.Run(newStore) {
+//		t.Error(f)
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/myzie/blobs/store"
+)
+
+// Factory returns an ObjectStore for a check. The same store may be returned
+// for every check, since each only touches keys beneath a prefix of its own.
+type Factory func() (store.ObjectStore, error)
+
+// Case is a single conformance check. Run is given the store along with the
+// key prefix the check must keep to.
+type Case struct {
+	Name string
+	Run  func(s store.ObjectStore, prefix string) error
+}
+
+// Failure reports a check that did not pass
+type Failure struct {
+	Case string
+	Err  error
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("%s: %s", f.Case, f.Err)
+}
+
+// Cases lists every check in the suite
+var Cases = []Case{
+	{"NotFound", testNotFound},
+	{"PutGet", testPutGet},
+	{"Overwrite", testOverwrite},
+	{"SizeMismatch", testSizeMismatch},
+	{"Range", testRange},
+	{"Stat", testStat},
+	{"Copy", testCopy},
+	{"List", testList},
+	{"Cancel", testCancel},
+	{"Concurrent", testConcurrent},
+	{"Large", testLarge},
+	{"Presign", testPresign},
+}
+
+// LargeSize is the size of the object written by the Large check
+const LargeSize = 24 << 20
+
+// Run runs every check against stores from the factory and returns the
+// failures, if any. Objects written by passing checks are removed.
+func Run(newStore Factory) []*Failure {
+	var failures []*Failure
+	for _, c := range Cases {
+		if err := runCase(newStore, c); err != nil {
+			failures = append(failures, &Failure{Case: c.Name, Err: err})
+		}
+	}
+	return failures
+}
+
+func runCase(newStore Factory, c Case) error {
+	s, err := newStore()
+	if err != nil {
+		return fmt.Errorf("Failed to create store: %s", err)
+	}
+	prefix := "storetest-" + randomHex(8) + "/"
+	if err := c.Run(s, prefix); err != nil {
+		return err
+	}
+	return removeAll(s, prefix)
+}
+
+func testNotFound(s store.ObjectStore, prefix string) error {
+	ctx := context.Background()
+	key := prefix + "missing"
+
+	if _, err := s.Stat(ctx, key); err != store.ErrNotFound {
+		return fmt.Errorf("Stat returned %v, expected ErrNotFound", err)
+	}
+	if _, err := readObject(s, key, store.GetOptions{}); err != store.ErrNotFound {
+		return fmt.Errorf("Get returned %v, expected ErrNotFound", err)
+	}
+	if err := s.Copy(ctx, key, prefix+"copy", store.PutOptions{}); err != store.ErrNotFound {
+		return fmt.Errorf("Copy returned %v, expected ErrNotFound", err)
+	}
+	if err := s.Remove(ctx, key); err != nil {
+		return fmt.Errorf("Remove returned %v, expected no error", err)
+	}
+	return nil
+}
+
+func testPutGet(s store.ObjectStore, prefix string) error {
+	for _, size := range []int64{0, 1, 1000, 100 << 10} {
+		data := randomBytes(size)
+
+		// Both with the size known in advance and without
+		for _, known := range []bool{true, false} {
+			key := fmt.Sprintf("%sobject-%d-%t", prefix, size, known)
+			if err := putObject(s, key, data, known, store.PutOptions{}); err != nil {
+				return err
+			}
+			if err := checkObject(s, key, data); err != nil {
+				return err
+			}
+			if err := s.Remove(context.Background(), key); err != nil {
+				return fmt.Errorf("Remove failed: %s", err)
+			}
+			if _, err := s.Stat(context.Background(), key); err != store.ErrNotFound {
+				return fmt.Errorf("Stat after Remove returned %v, expected ErrNotFound", err)
+			}
+		}
+	}
+	return nil
+}
+
+func testOverwrite(s store.ObjectStore, prefix string) error {
+	key := prefix + "object"
+	if err := putObject(s, key, []byte("first version"), true, store.PutOptions{}); err != nil {
+		return err
+	}
+	second := []byte("second")
+	if err := putObject(s, key, second, true, store.PutOptions{}); err != nil {
+		return err
+	}
+	return checkObject(s, key, second)
+}
+
+func testSizeMismatch(s store.ObjectStore, prefix string) error {
+	key := prefix + "short"
+	_, err := s.Put(context.Background(), key, bytes.NewReader([]byte("short")), 10, store.PutOptions{})
+	if err == nil {
+		return fmt.Errorf("Put of fewer bytes than its size succeeded")
+	}
+	if _, err := s.Stat(context.Background(), key); err != store.ErrNotFound {
+		return fmt.Errorf("Stat after failed Put returned %v, expected ErrNotFound", err)
+	}
+	return nil
+}
+
+func testRange(s store.ObjectStore, prefix string) error {
+	key := prefix + "object"
+	data := []byte("0123456789abcdefghij")
+	if err := putObject(s, key, data, true, store.PutOptions{}); err != nil {
+		return err
+	}
+
+	ranges := []struct {
+		Opts     store.GetOptions
+		Expected string
+	}{
+		{store.GetOptions{Offset: 0, Length: 1}, "0"},
+		{store.GetOptions{Offset: 5, Length: 5}, "56789"},
+		{store.GetOptions{Offset: 10}, "abcdefghij"},
+		{store.GetOptions{Offset: 0, Length: 20}, string(data)},
+		{store.GetOptions{Offset: 15, Length: 100}, "fghij"},
+		{store.GetOptions{Length: 3}, "012"},
+	}
+	for _, r := range ranges {
+		got, err := readObject(s, key, r.Opts)
+		if err != nil {
+			return fmt.Errorf("Get of %+v failed: %s", r.Opts, err)
+		}
+		if string(got) != r.Expected {
+			return fmt.Errorf("Get of %+v returned '%s', expected '%s'", r.Opts, got, r.Expected)
+		}
+	}
+
+	if _, err := readObject(s, key, store.GetOptions{Offset: 20}); err == nil {
+		return fmt.Errorf("Get with an offset past the end succeeded")
+	}
+	return nil
+}
+
+func testStat(s store.ObjectStore, prefix string) error {
+	key := prefix + "object.txt"
+	data := []byte("stat me")
+	opts := store.PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"revision": "r1"},
+	}
+	if err := putObject(s, key, data, true, opts); err != nil {
+		return err
+	}
+	info, err := s.Stat(context.Background(), key)
+	if err != nil {
+		return fmt.Errorf("Stat failed: %s", err)
+	}
+	if info.Key != key {
+		return fmt.Errorf("Stat returned key '%s', expected '%s'", info.Key, key)
+	}
+	if info.Size != int64(len(data)) {
+		return fmt.Errorf("Stat returned size %d, expected %d", info.Size, len(data))
+	}
+	// Stores need not keep metadata, but must return it intact if they do
+	if info.ContentType != "" && info.ContentType != opts.ContentType {
+		return fmt.Errorf("Stat returned content type '%s', expected '%s'", info.ContentType, opts.ContentType)
+	}
+	if info.Metadata != nil && info.Metadata["revision"] != "r1" {
+		return fmt.Errorf("Stat returned metadata %v, expected revision r1", info.Metadata)
+	}
+	return nil
+}
+
+func testCopy(s store.ObjectStore, prefix string) error {
+	ctx := context.Background()
+	src := prefix + "source"
+	dst := prefix + "copy"
+	data := randomBytes(10 << 10)
+	if err := putObject(s, src, data, true, store.PutOptions{ContentType: "text/plain"}); err != nil {
+		return err
+	}
+
+	if err := s.Copy(ctx, src, dst, store.PutOptions{}); err != nil {
+		return fmt.Errorf("Copy failed: %s", err)
+	}
+	if err := checkObject(s, dst, data); err != nil {
+		return err
+	}
+
+	// The source is independent of the copy
+	if err := s.Remove(ctx, dst); err != nil {
+		return fmt.Errorf("Remove failed: %s", err)
+	}
+	if err := checkObject(s, src, data); err != nil {
+		return err
+	}
+
+	// Copying onto itself replaces metadata but keeps the content
+	opts := store.PutOptions{ContentType: "application/octet-stream"}
+	if err := s.Copy(ctx, src, src, opts); err != nil {
+		return fmt.Errorf("Copy onto itself failed: %s", err)
+	}
+	if err := checkObject(s, src, data); err != nil {
+		return err
+	}
+	info, err := s.Stat(ctx, src)
+	if err != nil {
+		return fmt.Errorf("Stat failed: %s", err)
+	}
+	if info.ContentType != "" && info.ContentType != opts.ContentType {
+		return fmt.Errorf("Copy onto itself left content type '%s', expected '%s'", info.ContentType, opts.ContentType)
+	}
+	return nil
+}
+
+func testList(s store.ObjectStore, prefix string) error {
+	ctx := context.Background()
+
+	// Written out of order, with a neighbouring prefix that must be excluded
+	names := []string{"d", "a", "c/2", "e", "b", "c/1", "f"}
+	for i, name := range names {
+		data := bytes.Repeat([]byte("x"), i)
+		if err := putObject(s, prefix+"list/"+name, data, true, store.PutOptions{}); err != nil {
+			return err
+		}
+	}
+	if err := putObject(s, prefix+"listing", []byte("y"), true, store.PutOptions{}); err != nil {
+		return err
+	}
+	expected := []string{"a", "b", "c/1", "c/2", "d", "e", "f"}
+
+	// All at once
+	result, err := s.List(ctx, store.ListOptions{Prefix: prefix + "list/"})
+	if err != nil {
+		return fmt.Errorf("List failed: %s", err)
+	}
+	if result.Next != "" {
+		return fmt.Errorf("List of every object returned next key '%s'", result.Next)
+	}
+	if err := checkListing(result.Objects, prefix+"list/", expected, names); err != nil {
+		return err
+	}
+
+	// One page at a time, with the last page exactly full
+	for _, limit := range []int{1, 2, 3, 7} {
+		var objects []store.ObjectInfo
+		opts := store.ListOptions{Prefix: prefix + "list/", Limit: limit}
+		for pages := 0; ; pages++ {
+			if pages > len(expected) {
+				return fmt.Errorf("List with limit %d did not finish", limit)
+			}
+			result, err := s.List(ctx, opts)
+			if err != nil {
+				return fmt.Errorf("List failed: %s", err)
+			}
+			if len(result.Objects) > limit {
+				return fmt.Errorf("List with limit %d returned %d objects", limit, len(result.Objects))
+			}
+			objects = append(objects, result.Objects...)
+			if result.Next == "" {
+				break
+			}
+			opts.After = result.Next
+		}
+		if err := checkListing(objects, prefix+"list/", expected, names); err != nil {
+			return fmt.Errorf("With limit %d: %s", limit, err)
+		}
+	}
+
+	// Resuming after a key that does not exist
+	result, err = s.List(ctx, store.ListOptions{Prefix: prefix + "list/", After: prefix + "list/c"})
+	if err != nil {
+		return fmt.Errorf("List failed: %s", err)
+	}
+	if err := checkListing(result.Objects, prefix+"list/", expected[2:], names); err != nil {
+		return fmt.Errorf("After a missing key: %s", err)
+	}
+	return nil
+}
+
+// checkListing compares listed objects with the expected names, in order.
+// Each object has as many bytes as the position of its name in written.
+func checkListing(objects []store.ObjectInfo, prefix string, expected, written []string) error {
+	var got []string
+	for _, obj := range objects {
+		got = append(got, strings.TrimPrefix(obj.Key, prefix))
+	}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		return fmt.Errorf("List returned %v, expected %v", got, expected)
+	}
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		for i, w := range written {
+			if w == name && obj.Size != int64(i) {
+				return fmt.Errorf("List returned size %d for '%s', expected %d", obj.Size, name, i)
+			}
+		}
+	}
+	return nil
+}
+
+func testCancel(s store.ObjectStore, prefix string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	key := prefix + "cancelled"
+	if _, err := s.Put(ctx, key, bytes.NewReader([]byte("data")), 4, store.PutOptions{}); err == nil {
+		return fmt.Errorf("Put with a cancelled context succeeded")
+	}
+	if _, err := s.Stat(context.Background(), key); err != store.ErrNotFound {
+		return fmt.Errorf("Stat after cancelled Put returned %v, expected ErrNotFound", err)
+	}
+
+	// Reads are cancelled too, by Get or by the first Read
+	if err := putObject(s, key, []byte("data"), true, store.PutOptions{}); err != nil {
+		return err
+	}
+	obj, err := s.Get(ctx, key, store.GetOptions{})
+	if err == nil {
+		_, err = ioutil.ReadAll(obj)
+		obj.Close()
+	}
+	if err == nil {
+		return fmt.Errorf("Get with a cancelled context succeeded")
+	}
+	return nil
+}
+
+func testConcurrent(s store.ObjectStore, prefix string) error {
+	const writers = 8
+
+	contents := make([][]byte, writers)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte('a' + i)}, 64<<10)
+	}
+
+	// Writers each put an object of their own and overwrite a shared one
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- putObject(s, fmt.Sprintf("%sown-%d", prefix, i), contents[i], true, store.PutOptions{})
+			errs <- putObject(s, prefix+"shared", contents[i], false, store.PutOptions{})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < writers; i++ {
+		if err := checkObject(s, fmt.Sprintf("%sown-%d", prefix, i), contents[i]); err != nil {
+			return err
+		}
+	}
+
+	// The shared object holds exactly one of the writes, never a mixture
+	got, err := readObject(s, prefix+"shared", store.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	for _, data := range contents {
+		if bytes.Equal(got, data) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Concurrent writes left a mixture of content")
+}
+
+func testLarge(s store.ObjectStore, prefix string) error {
+	key := prefix + "large"
+
+	digest := sha256.New()
+	source := io.TeeReader(io.LimitReader(rand.Reader, LargeSize), digest)
+	n, err := s.Put(context.Background(), key, source, -1, store.PutOptions{})
+	if err != nil {
+		return fmt.Errorf("Put failed: %s", err)
+	}
+	if n != LargeSize {
+		return fmt.Errorf("Put returned %d bytes written, expected %d", n, LargeSize)
+	}
+	expected := hex.EncodeToString(digest.Sum(nil))
+
+	info, err := s.Stat(context.Background(), key)
+	if err != nil {
+		return fmt.Errorf("Stat failed: %s", err)
+	}
+	if info.Size != LargeSize {
+		return fmt.Errorf("Stat returned size %d, expected %d", info.Size, LargeSize)
+	}
+
+	obj, err := s.Get(context.Background(), key, store.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Get failed: %s", err)
+	}
+	defer obj.Close()
+	digest.Reset()
+	read, err := io.Copy(digest, obj)
+	if err != nil {
+		return fmt.Errorf("Read failed: %s", err)
+	}
+	if read != LargeSize || hex.EncodeToString(digest.Sum(nil)) != expected {
+		return fmt.Errorf("Get returned %d bytes with a different digest", read)
+	}
+	return nil
+}
+
+func testPresign(s store.ObjectStore, prefix string) error {
+	ctx := context.Background()
+	key := prefix + "object"
+	if err := putObject(s, key, []byte("data"), true, store.PutOptions{}); err != nil {
+		return err
+	}
+	opts := store.PresignOptions{Expiry: time.Minute}
+
+	u, err := s.PresignGet(ctx, key, opts)
+	if err != store.ErrNotSupported && (err != nil || u == nil) {
+		return fmt.Errorf("PresignGet returned %v, %v", u, err)
+	}
+	u, err = s.PresignPut(ctx, key, opts)
+	if err != store.ErrNotSupported && (err != nil || u == nil) {
+		return fmt.Errorf("PresignPut returned %v, %v", u, err)
+	}
+	return nil
+}
+
+// putObject stores data, with or without giving its size in advance, and
+// checks the number of bytes written
+func putObject(s store.ObjectStore, key string, data []byte, known bool, opts store.PutOptions) error {
+	size := int64(-1)
+	if known {
+		size = int64(len(data))
+	}
+	// Hide the type of the reader so stores can not size it themselves
+	reader := struct{ io.Reader }{bytes.NewReader(data)}
+	n, err := s.Put(context.Background(), key, reader, size, opts)
+	if err != nil {
+		return fmt.Errorf("Put of '%s' failed: %s", key, err)
+	}
+	if n != int64(len(data)) {
+		return fmt.Errorf("Put of '%s' returned %d bytes written, expected %d", key, n, len(data))
+	}
+	return nil
+}
+
+// readObject returns the content of an object, reporting errors from Get
+// and Read alike
+func readObject(s store.ObjectStore, key string, opts store.GetOptions) ([]byte, error) {
+	obj, err := s.Get(context.Background(), key, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return ioutil.ReadAll(obj)
+}
+
+// checkObject checks the content and size of an object
+func checkObject(s store.ObjectStore, key string, data []byte) error {
+	got, err := readObject(s, key, store.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Get of '%s' failed: %s", key, err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("Get of '%s' returned %d bytes differing from the %d written", key, len(got), len(data))
+	}
+	info, err := s.Stat(context.Background(), key)
+	if err != nil {
+		return fmt.Errorf("Stat of '%s' failed: %s", key, err)
+	}
+	if info.Size != int64(len(data)) {
+		return fmt.Errorf("Stat of '%s' returned size %d, expected %d", key, info.Size, len(data))
+	}
+	return nil
+}
+
+// removeAll removes every object beneath a prefix
+func removeAll(s store.ObjectStore, prefix string) error {
+	ctx := context.Background()
+	for {
+		result, err := s.List(ctx, store.ListOptions{Prefix: prefix})
+		if err != nil {
+			return fmt.Errorf("Cleanup failed: %s", err)
+		}
+		for _, obj := range result.Objects {
+			if err := s.Remove(ctx, obj.Key); err != nil {
+				return fmt.Errorf("Cleanup failed: %s", err)
+			}
+		}
+		if result.Next == "" {
+			return nil
+		}
+	}
+}
+
+func randomBytes(n int64) []byte {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func randomHex(n int) string {
+	return hex.EncodeToString(randomBytes(int64(n)))
+}
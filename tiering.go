@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/bytes"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// accessResolution is how stale the recorded last access of a blob may
+// become before a read records it again
+const accessResolution = time.Hour
+
+// restoreRetryAfter is the number of seconds clients are asked to wait
+// before reading a blob being restored again
+const restoreRetryAfter = 60
+
+// tierCondition reports whether a blob satisfies a policy condition
+type tierCondition func(blob *db.Blob, now time.Time) bool
+
+// tierPolicy moves blobs satisfying all of its conditions to a tier, which
+// is a named object store backend
+type tierPolicy struct {
+	Tier       string
+	Conditions []tierCondition
+}
+
+func (p *tierPolicy) matches(blob *db.Blob, now time.Time) bool {
+	for _, cond := range p.Conditions {
+		if !cond(blob, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// tiering decides which storage tier blobs belong in
+type tiering struct {
+	// Policies in order of precedence. Blobs matching none stay in the
+	// backend their path is routed to.
+	Policies []tierPolicy
+
+	// Slow tiers can not be read directly. Their content is restored to a
+	// faster tier when requested.
+	Slow map[string]bool
+
+	// RestoreHold is how long blobs that were read are kept out of slow
+	// tiers
+	RestoreHold time.Duration
+
+	// restores holds the IDs of blobs being restored
+	restores sync.Map
+}
+
+// newTiering returns the tiering configured by the tier-policies and
+// slow-tiers flags. Tiers are backends of the routing object store.
+func newTiering(objStore store.ObjectStore, policies, slow string, restoreHold time.Duration) (*tiering, error) {
+
+	router, ok := objStore.(*store.Router)
+	if !ok {
+		return nil, fmt.Errorf("Tiers must be configured as object store backends")
+	}
+
+	t := &tiering{Slow: map[string]bool{}, RestoreHold: restoreHold}
+	var err error
+	if t.Policies, err = parseTierPolicies(policies); err != nil {
+		return nil, err
+	}
+	for _, policy := range t.Policies {
+		if !router.HasBackend(policy.Tier) {
+			return nil, fmt.Errorf("Unknown tier: '%s'", policy.Tier)
+		}
+		log.Infof("Tier policy: %s", policy.Tier)
+	}
+	for _, name := range splitList(slow) {
+		if !router.HasBackend(name) {
+			return nil, fmt.Errorf("Unknown tier: '%s'", name)
+		}
+		t.Slow[name] = true
+	}
+	return t, nil
+}
+
+// parseTierPolicies parses comma separated policies of the form
+// tier:condition&condition. Conditions are age>duration (since the blob was
+// last updated), accessed>duration (since it was last read), size>bytes,
+// size<bytes and property.name=value. Durations may be given in days, as
+// in 90d.
+func parseTierPolicies(spec string) ([]tierPolicy, error) {
+	var policies []tierPolicy
+	for _, item := range splitList(spec) {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid tier policy: '%s'", item)
+		}
+		policy := tierPolicy{Tier: parts[0]}
+		for _, text := range strings.Split(parts[1], "&") {
+			cond, err := parseTierCondition(text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid tier policy '%s': %s", item, err.Error())
+			}
+			policy.Conditions = append(policy.Conditions, cond)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func parseTierCondition(text string) (tierCondition, error) {
+
+	if strings.HasPrefix(text, "property.") {
+		parts := strings.SplitN(strings.TrimPrefix(text, "property."), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid condition: '%s'", text)
+		}
+		name, value := parts[0], parts[1]
+		return func(blob *db.Blob, now time.Time) bool {
+			return blobProperty(blob, name) == value
+		}, nil
+	}
+
+	i := strings.IndexAny(text, "<>")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid condition: '%s'", text)
+	}
+	name, op, value := text[:i], text[i], text[i+1:]
+
+	switch name {
+	case "age", "accessed":
+		if op != '>' {
+			return nil, fmt.Errorf("Invalid condition: '%s'", text)
+		}
+		age, err := parseAge(value)
+		if err != nil {
+			return nil, err
+		}
+		if name == "age" {
+			return func(blob *db.Blob, now time.Time) bool {
+				return now.Sub(blob.UpdatedAt) > age
+			}, nil
+		}
+		return func(blob *db.Blob, now time.Time) bool {
+			return now.Sub(lastAccess(blob)) > age
+		}, nil
+	case "size":
+		size, err := bytes.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid size: '%s'", value)
+		}
+		if op == '>' {
+			return func(blob *db.Blob, now time.Time) bool { return blob.Size > size }, nil
+		}
+		return func(blob *db.Blob, now time.Time) bool { return blob.Size < size }, nil
+	default:
+		return nil, fmt.Errorf("Unknown condition: '%s'", name)
+	}
+}
+
+// parseAge parses a duration, allowing a number of days such as 90d
+func parseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("Invalid duration: '%s'", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration: '%s'", value)
+	}
+	return age, nil
+}
+
+// lastAccess returns when the content of a blob was last read, taking
+// blobs never read to have been read when last updated
+func lastAccess(blob *db.Blob) time.Time {
+	if blob.LastAccessedAt.After(blob.UpdatedAt) {
+		return blob.LastAccessedAt
+	}
+	return blob.UpdatedAt
+}
+
+// blobProperty returns a top level property of a blob as text, or an empty
+// string if it is not set
+func blobProperty(blob *db.Blob, name string) string {
+	var props map[string]interface{}
+	if err := json.Unmarshal(blob.Properties.RawMessage, &props); err != nil {
+		return ""
+	}
+	value, found := props[name]
+	if !found || value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	text, _ := json.Marshal(value)
+	return string(text)
+}
+
+// tierFor returns the tier the blob belongs in, given the backend its path
+// is routed to. Blobs being restored or read recently are kept out of slow
+// tiers.
+func (t *tiering) tierFor(blob *db.Blob, route string, now time.Time) string {
+	fast := blob.Restoring || now.Sub(blob.LastAccessedAt) < t.RestoreHold
+	for _, policy := range t.Policies {
+		if fast && t.Slow[policy.Tier] {
+			continue
+		}
+		if policy.matches(blob, now) {
+			return policy.Tier
+		}
+	}
+	if fast && t.Slow[route] {
+		return ""
+	}
+	return route
+}
+
+// runTiering periodically moves blobs to the tiers their policies call for
+func (svc *blobsService) runTiering(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := svc.applyTiers(); err != nil {
+			log.WithError(err).Error("Tiering failed")
+		}
+	}
+}
+
+// applyTiers moves every committed blob that is not in the tier it belongs
+// in. Blobs with an upload in progress are left for the next pass.
+func (svc *blobsService) applyTiers() error {
+
+	const batchSize = 100
+
+	for offset := 0; ; offset += batchSize {
+		blobs, err := svc.Database.List(db.Query{
+			Offset:  offset,
+			Limit:   batchSize,
+			OrderBy: "id",
+		})
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			// Chunks are shared between blobs, so chunked blobs stay in the
+			// backend their chunks were stored in
+			if !blob.Committed() || blob.PendingRevision != "" || blob.Chunked {
+				continue
+			}
+			tier := svc.Tiering.tierFor(blob, svc.route(blob.Path), time.Now())
+			if tier == blob.Backend {
+				continue
+			}
+			if err := svc.migrate(blob, tier); err != nil {
+				log.WithError(err).WithField("id", blob.ID).Error("Failed to move blob between tiers")
+			}
+		}
+		if len(blobs) < batchSize {
+			return nil
+		}
+	}
+}
+
+// migrate moves the content of a blob to another tier. The object keeps its
+// key. The blob is switched over once the object has been copied, provided
+// its content has not changed or moved meanwhile, and the previous object
+// is then released unless copies of the blob still refer to it. The move
+// leaves the version and so the ETag of the blob alone.
+func (svc *blobsService) migrate(blob *db.Blob, tier string) error {
+
+	ctx := context.Background()
+	key := blob.Key()
+	previous := blob.Backend
+
+	if err := svc.Store.Copy(ctx, objectKey(blob), store.BackendKey(tier, key), store.PutOptions{}); err != nil {
+		return err
+	}
+
+	if err := svc.Database.Relocate(blob, tier, key); err != nil {
+		svc.releaseObject(tier, key, blob.Chunked)
+		return err
+	}
+	svc.releaseObject(previous, key, blob.Chunked)
+
+	log.WithFields(log.Fields{
+		"id":   blob.ID,
+		"path": blob.Path,
+		"from": previous,
+		"to":   tier,
+	}).Info("Blob moved between tiers")
+	return nil
+}
+
+// recordAccess notes that the content of a blob was read
+func (svc *blobsService) recordAccess(blob *db.Blob) {
+	if svc.Tiering == nil || time.Since(blob.LastAccessedAt) < accessResolution {
+		return
+	}
+	blob.LastAccessedAt = time.Now()
+	if err := svc.Database.Touch(blob, []string{"last_accessed_at"}); err != nil {
+		log.WithError(err).WithField("id", blob.ID).Warn("Failed to record blob access")
+	}
+}
+
+// restoring returns true if the content of a blob is held by a slow tier,
+// in which case it starts moving the content to a faster one
+func (svc *blobsService) restoring(blob *db.Blob) bool {
+
+	if svc.Tiering == nil || blob.Chunked || !svc.Tiering.Slow[blob.Backend] {
+		return false
+	}
+
+	if !blob.Restoring {
+		blob.Restoring = true
+		if err := svc.Database.Touch(blob, []string{"restoring"}); err != nil {
+			log.WithError(err).WithField("id", blob.ID).Warn("Failed to record blob restore")
+		}
+	}
+
+	if _, busy := svc.Tiering.restores.LoadOrStore(blob.ID, true); !busy {
+		restored := *blob
+		go func() {
+			defer svc.Tiering.restores.Delete(restored.ID)
+			tier := svc.Tiering.tierFor(&restored, svc.route(restored.Path), time.Now())
+			if err := svc.migrate(&restored, tier); err != nil {
+				log.WithError(err).WithField("id", restored.ID).Error("Failed to restore blob")
+			}
+		}()
+		log.WithFields(log.Fields{"id": blob.ID, "tier": blob.Backend}).Info("Restoring blob")
+	}
+	return true
+}
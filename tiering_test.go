@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/labstack/echo"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value string
+		age   time.Duration
+		ok    bool
+	}{
+		{"90d", 90 * 24 * time.Hour, true},
+		{"0d", 0, true},
+		{"36h", 36 * time.Hour, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"-1d", 0, false},
+		{"d", 0, false},
+		{"1w", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		age, err := parseAge(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("parseAge(%q) returned error %v", test.value, err)
+			continue
+		}
+		if age != test.age {
+			t.Errorf("parseAge(%q) = %s, want %s", test.value, age, test.age)
+		}
+	}
+}
+
+func TestParseTierPolicies(t *testing.T) {
+	invalid := []string{
+		"cold",
+		"cold:",
+		":age>1d",
+		"cold:age<1d",
+		"cold:age>1w",
+		"cold:accessed=1d",
+		"cold:size>lots",
+		"cold:color>1",
+		"cold:property.=red",
+		"cold:property.color",
+		"cold:age>1d&",
+	}
+	for _, spec := range invalid {
+		if _, err := parseTierPolicies(spec); err == nil {
+			t.Errorf("Expected tier policy '%s' to be invalid", spec)
+		}
+	}
+
+	policies, err := parseTierPolicies("cold:age>30d&size>1KB, archive:property.color=red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[0].Tier != "cold" || policies[1].Tier != "archive" {
+		t.Fatalf("Unexpected policies %+v", policies)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		updated time.Duration
+		size    int64
+		props   string
+		tier    string
+	}{
+		{31 * 24 * time.Hour, 2048, `{}`, "cold"},
+		{29 * 24 * time.Hour, 2048, `{}`, ""},
+		{31 * 24 * time.Hour, 512, `{}`, ""},
+		{time.Hour, 0, `{"color":"red"}`, "archive"},
+		{time.Hour, 0, `{"color":"blue"}`, ""},
+		{time.Hour, 0, `{"color":["red"]}`, ""},
+	}
+	for _, test := range tests {
+		blob := &db.Blob{
+			UpdatedAt:  now.Add(-test.updated),
+			Size:       test.size,
+			Properties: postgres.Jsonb{RawMessage: json.RawMessage(test.props)},
+		}
+		tier := ""
+		for _, policy := range policies {
+			if policy.matches(blob, now) {
+				tier = policy.Tier
+				break
+			}
+		}
+		if tier != test.tier {
+			t.Errorf("Blob updated %s ago of size %d with %s matched '%s', want '%s'",
+				test.updated, test.size, test.props, tier, test.tier)
+		}
+	}
+}
+
+func TestTierFor(t *testing.T) {
+	policies, err := parseTierPolicies("archive:accessed>90d,cold:age>30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers := &tiering{
+		Policies:    policies,
+		Slow:        map[string]bool{"archive": true, "vault": true},
+		RestoreHold: 24 * time.Hour,
+	}
+
+	day := 24 * time.Hour
+	now := time.Now()
+	tests := []struct {
+		updated   time.Duration
+		accessed  time.Duration
+		restoring bool
+		route     string
+		tier      string
+	}{
+		{time.Hour, time.Hour, false, "", ""},
+		{time.Hour, time.Hour, false, "ssd", "ssd"},
+		{40 * day, 40 * day, false, "", "cold"},
+		{100 * day, 0, false, "", "archive"},
+		{100 * day, 95 * day, false, "", "archive"},
+		{100 * day, 10 * day, false, "", "cold"},
+		{100 * day, 0, true, "", "cold"},
+		{100 * day, time.Hour, false, "", "cold"},
+		{time.Hour, time.Hour, false, "vault", ""},
+		{time.Hour, 10 * day, false, "vault", "vault"},
+	}
+	for _, test := range tests {
+		blob := &db.Blob{UpdatedAt: now.Add(-test.updated), Restoring: test.restoring}
+		if test.accessed > 0 {
+			blob.LastAccessedAt = now.Add(-test.accessed)
+		}
+		if tier := tiers.tierFor(blob, test.route, now); tier != test.tier {
+			t.Errorf("Blob updated %s and read %s ago (restoring %v, route '%s') belongs in '%s', want '%s'",
+				test.updated, test.accessed, test.restoring, test.route, tier, test.tier)
+		}
+	}
+}
+
+func TestTierMigrate(t *testing.T) {
+	ctx := context.Background()
+	router, err := store.NewRouter(store.NewMemoryObjectStore(), map[string]store.ObjectStore{
+		"archive": store.NewMemoryObjectStore(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &blobsService{
+		Database: db.NewMemoryDB(),
+		Store:    router,
+		Tiering:  &tiering{Slow: map[string]bool{"archive": true}},
+	}
+
+	blob := &db.Blob{
+		ID:        uid(),
+		Path:      "/a.txt",
+		Size:      7,
+		State:     db.StateCommitted,
+		Revision:  uid(),
+		CreatedBy: "tester",
+	}
+	if err := svc.Database.Save(blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.Put(ctx, objectKey(blob), strings.NewReader("content"), -1, store.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	tag := etag(blob)
+	stale := *blob
+
+	if err := svc.migrate(blob, "archive"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := svc.Database.Get(blob.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Backend != "archive" || etag(moved) != tag {
+		t.Errorf("Moved blob to '%s' with ETag %s, expected 'archive' and %s", moved.Backend, etag(moved), tag)
+	}
+	if _, err := router.Stat(ctx, objectKey(moved)); err != nil {
+		t.Errorf("Object missing from the new tier: %v", err)
+	}
+	if _, err := router.Stat(ctx, moved.Key()); err != store.ErrNotFound {
+		t.Errorf("Expected the previous object to be removed, got %v", err)
+	}
+
+	// A stale view of the blob can not move it again
+	if err := svc.migrate(&stale, "archive"); err == nil {
+		t.Error("Expected moving content that already moved to fail")
+	}
+
+	// HEAD agrees with GET about content in a slow tier
+	svc.Tiering.restores.Store(moved.ID, true) // Hold off the restore
+	for _, method := range []string{"GET", "HEAD"} {
+		req := httptest.NewRequest(method, "/blobs/a.txt", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("*")
+		c.SetParamValues("a.txt")
+		handler := svc.Get
+		if method == "HEAD" {
+			handler = svc.Head
+		}
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != ServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s of a blob in a slow tier returned %d", method, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/labstack/echo"
+	"github.com/myzie/base"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resumable uploads implement the tus 1.0 protocol with the creation and
+// termination extensions. See https://tus.io/protocols/resumable-upload.html
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	// tusContentType is required on PATCH requests carrying upload content
+	tusContentType = "application/offset+octet-stream"
+
+	// tusClaimTimeout is how long a request completing an upload holds it,
+	// after which the completion may be retried should the request have
+	// failed without releasing it
+	tusClaimTimeout = 30 * time.Minute
+)
+
+// tusResumable checks the protocol version of requests and marks responses
+// with the version in use
+func tusResumable(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Response().Header()
+		header.Set("Tus-Resumable", tusVersion)
+		if c.Request().Header.Get("Tus-Resumable") != tusVersion {
+			header.Set("Tus-Version", tusVersion)
+			return c.JSON(PreconditionFailed, errorView{"Unsupported tus version"})
+		}
+		return next(c)
+	}
+}
+
+// UploadOptions describes the resumable upload support of the server
+func (svc *blobsService) UploadOptions(c echo.Context) error {
+	header := c.Response().Header()
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Tus-Version", tusVersion)
+	header.Set("Tus-Extension", tusExtensions)
+	header.Set("Tus-Max-Size", strconv.FormatInt(svc.SizeLimit, 10))
+	return c.NoContent(NoContent)
+}
+
+// CreateUpload starts a resumable upload. The blob path and other upload
+// attributes are given in the Upload-Metadata header.
+func (svc *blobsService) CreateUpload(c echo.Context) error {
+
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(*base.JWTClaims)
+	userID := claims.Subject
+
+	header := c.Request().Header
+	if header.Get("Upload-Length") == "" {
+		if header.Get("Upload-Defer-Length") != "" {
+			return c.JSON(BadRequest, errorView{"Deferred upload length is not supported"})
+		}
+		return c.JSON(BadRequest, errorView{"Upload-Length missing"})
+	}
+	length, err := strconv.ParseInt(header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.JSON(BadRequest, errorView{"Invalid Upload-Length"})
+	}
+	if length > svc.SizeLimit {
+		return c.JSON(RequestTooLarge, errorView{"File too large"})
+	}
+
+	attrs, err := parseTusMetadata(header.Get("Upload-Metadata"))
+	if err != nil {
+		return c.JSON(BadRequest, errorView{err.Error()})
+	}
+	attrs.Normalize()
+	if err := attrs.Validate(svc.SizeLimit); err != nil {
+		return c.JSON(BadRequest, errorView{err.Error()})
+	}
+	if attrs.Hash != "" {
+		if _, err := parseChecksum(attrs.Hash); err != nil {
+			return c.JSON(BadRequest, errorView{err.Error()})
+		}
+	}
+	propJSON, err := attrs.MarshalProperties()
+	if err != nil {
+		return c.JSON(BadRequest, errorView{"JSON error"})
+	}
+
+	session := &db.Upload{
+		ID:          uid(),
+		CreatedBy:   userID,
+		Path:        attrs.Path,
+		Length:      length,
+		ContentType: attrs.ContentType,
+		Hash:        attrs.Hash,
+		Properties:  string(propJSON),
+	}
+	if err := svc.Database.SaveUpload(session); err != nil {
+		return databaseError(c, err, "Failed to create upload")
+	}
+
+	log.WithFields(log.Fields{
+		"id":         session.ID,
+		"created_by": session.CreatedBy,
+		"path":       session.Path,
+		"length":     session.Length,
+	}).Info("Resumable upload created")
+
+	c.Response().Header().Set("Location", "/uploads/"+session.ID)
+
+	// An empty upload is complete as soon as it is created
+	if session.Complete() {
+		blob, err := svc.completeUpload(c.Request().Context(), session)
+		if err != nil {
+			return serviceError(c, err, "Upload failed")
+		}
+		c.Response().Header().Set("ETag", etag(blob))
+	}
+	return c.NoContent(Created)
+}
+
+// UploadStatus reports how much of a resumable upload has been received
+func (svc *blobsService) UploadStatus(c echo.Context) error {
+
+	session, err := svc.userUpload(c)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return c.NoContent(NotFound)
+		}
+		log.WithError(err).Error("Get upload failed")
+		return c.NoContent(InternalServerError)
+	}
+
+	header := c.Response().Header()
+	header.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	header.Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	header.Set("Cache-Control", "no-store")
+	return c.NoContent(OK)
+}
+
+// AppendUpload receives the next chunk of a resumable upload. Once all
+// content has been received the blob is created or updated with it.
+func (svc *blobsService) AppendUpload(c echo.Context) error {
+
+	if c.Request().Header.Get("Content-Type") != tusContentType {
+		return c.JSON(UnsupportedMediaType, errorView{"Content-Type must be " + tusContentType})
+	}
+
+	session, err := svc.userUpload(c)
+	if err == db.ErrNotFound {
+		return c.JSON(NotFound, errorView{"Upload not found"})
+	}
+	if err != nil {
+		return databaseError(c, err, "Failed to look up upload")
+	}
+
+	offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return c.JSON(BadRequest, errorView{"Invalid Upload-Offset"})
+	}
+	if offset != session.Offset {
+		return c.JSON(Conflict, errorView{"Upload offset mismatch"})
+	}
+
+	if !session.Complete() {
+		if err := svc.appendPart(c.Request().Context(), session, c.Request().Body); err != nil {
+			if err == db.ErrModified {
+				return c.JSON(Conflict, errorView{"Upload offset mismatch"})
+			}
+			return serviceError(c, err, "Failed to update upload")
+		}
+	}
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+
+	// Completion is retried by a PATCH with an empty body should it fail
+	if session.Complete() {
+		blob, err := svc.completeUpload(c.Request().Context(), session)
+		if err != nil {
+			return serviceError(c, err, "Upload failed")
+		}
+		c.Response().Header().Set("ETag", etag(blob))
+	}
+	return c.NoContent(NoContent)
+}
+
+// TerminateUpload discards a resumable upload and the content received
+func (svc *blobsService) TerminateUpload(c echo.Context) error {
+
+	session, err := svc.userUpload(c)
+	if err == db.ErrNotFound {
+		return c.JSON(NotFound, errorView{"Upload not found"})
+	}
+	if err != nil {
+		return databaseError(c, err, "Failed to look up upload")
+	}
+	if completing(session) {
+		return c.JSON(Conflict, errorView{"Upload being completed"})
+	}
+	if err := svc.discardUpload(session); err != nil {
+		return databaseError(c, err, "Failed to delete upload")
+	}
+
+	log.WithField("id", session.ID).Info("Resumable upload terminated")
+
+	return c.NoContent(NoContent)
+}
+
+// userUpload returns the upload addressed by a request. Uploads belonging
+// to other users are reported as not found.
+func (svc *blobsService) userUpload(c echo.Context) (*db.Upload, error) {
+
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(*base.JWTClaims)
+
+	session, err := svc.Database.GetUpload(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	if session.CreatedBy != claims.Subject {
+		return nil, db.ErrNotFound
+	}
+	return session, nil
+}
+
+// appendPart stores a chunk of content as a new part of an upload. Part
+// objects have unique keys, so a chunk that loses a race with another for
+// the same offset never damages the part that won. The content is hashed
+// as it arrives, and the state of the hashes recorded with the part.
+func (svc *blobsService) appendPart(ctx context.Context, session *db.Upload, body io.Reader) error {
+
+	part := uid()
+	key := session.PartKey(part)
+	counter := &countingReader{Reader: body, Limit: session.Length - session.Offset}
+
+	digest, err := uploadDigester(session)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader = counter
+	if digest != nil {
+		reader = io.TeeReader(counter, digest)
+	}
+
+	opts := store.PutOptions{ContentType: "application/octet-stream"}
+	if _, err := svc.Store.Put(ctx, key, reader, -1, opts); err != nil {
+		svc.removeObjects([]string{key})
+		if counter.Exceeded() {
+			return echo.NewHTTPError(RequestTooLarge, "Chunk exceeds upload length")
+		}
+		log.WithError(err).WithField("id", session.ID).Error("Error saving upload part")
+		return echo.NewHTTPError(InternalServerError, "Error saving file")
+	}
+	if counter.N == 0 {
+		svc.removeObjects([]string{key})
+		return nil
+	}
+
+	session.AddPart(part, counter.N)
+	fields := []string{"offset", "parts"}
+	if digest != nil {
+		if session.Digest, err = digest.State(); err != nil {
+			svc.removeObjects([]string{key})
+			return err
+		}
+		fields = append(fields, "digest")
+	}
+	if err := svc.Database.UpdateUpload(session, fields); err != nil {
+		svc.removeObjects([]string{key})
+		return err
+	}
+	return nil
+}
+
+// completing returns true if a request is completing an upload
+func completing(session *db.Upload) bool {
+	return time.Since(session.CompletingAt) < tusClaimTimeout
+}
+
+// uploadDigester returns a digester continuing from the hashes of the
+// content an upload has received, or nil if they were not kept
+func uploadDigester(session *db.Upload) (*digester, error) {
+	if session.Digest == "" && session.Offset > 0 {
+		return nil, nil
+	}
+	var sum *checksum
+	if session.Hash != "" {
+		var err error
+		if sum, err = parseChecksum(session.Hash); err != nil {
+			return nil, echo.NewHTTPError(BadRequest, err.Error())
+		}
+	}
+	return restoreDigester(sum, session.Digest)
+}
+
+// completeUpload assembles the parts of a complete upload into the content
+// of its blob, which is created or updated as by a POST, and then discards
+// the upload. The upload is claimed first, so that of concurrent requests
+// completing it only one goes ahead; the claim is released if completion
+// fails, so that it may be retried.
+func (svc *blobsService) completeUpload(ctx context.Context, session *db.Upload) (*db.Blob, error) {
+
+	if completing(session) {
+		return nil, echo.NewHTTPError(Conflict, "Upload being completed")
+	}
+	session.CompletingAt = time.Now()
+	if err := svc.Database.UpdateUpload(session, []string{"completing_at"}); err != nil {
+		if err == db.ErrModified {
+			return nil, echo.NewHTTPError(Conflict, "Upload being completed")
+		}
+		return nil, err
+	}
+
+	blob, err := svc.assembleUpload(ctx, session)
+	if err != nil {
+		session.CompletingAt = time.Time{}
+		if relErr := svc.Database.UpdateUpload(session, []string{"completing_at"}); relErr != nil {
+			log.WithError(relErr).WithField("id", session.ID).Error("Failed to release upload")
+		}
+		return nil, err
+	}
+
+	if err := svc.discardUpload(session); err != nil {
+		log.WithError(err).WithField("id", session.ID).Error("Failed to delete completed upload")
+	}
+
+	log.WithFields(log.Fields{
+		"id":      session.ID,
+		"blob_id": blob.ID,
+		"parts":   len(session.PartKeys()),
+	}).Info("Resumable upload complete")
+
+	return blob, nil
+}
+
+// assembleUpload stores the content of a complete upload as its blob. Where
+// the store can, the parts are assembled within it, such as by a multipart
+// upload, and the hashes taken as they arrived are used, so the content
+// does not pass through the service again. Otherwise, or if the content is
+// to be compressed or chunked, the parts are streamed into the blob.
+func (svc *blobsService) assembleUpload(ctx context.Context, session *db.Upload) (*db.Blob, error) {
+
+	digest, err := uploadDigester(session)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := session.PartKeys()
+	parts := store.NewSequenceReader(ctx, svc.Store, store.WholeObjects(keys))
+	defer parts.Close()
+
+	up := &upload{
+		UserID:      session.CreatedBy,
+		Path:        session.Path,
+		Size:        session.Length,
+		Properties:  postgres.Jsonb{RawMessage: json.RawMessage(session.Properties)},
+		Reader:      parts,
+		ContentType: session.ContentType,
+	}
+	if session.Hash != "" {
+		if up.Checksum, err = parseChecksum(session.Hash); err != nil {
+			return nil, echo.NewHTTPError(BadRequest, err.Error())
+		}
+	}
+
+	composer, ok := svc.Store.(store.Composer)
+	if !ok || digest == nil || len(keys) == 0 {
+		return svc.upload(ctx, up)
+	}
+
+	contentType, err := sniffUpload(up)
+	if err != nil {
+		log.WithError(err).WithField("id", session.ID).Error("Failed to read upload part")
+		return nil, echo.NewHTTPError(InternalServerError, "Failed to read upload")
+	}
+	if svc.compressionFor(contentType) != "" || svc.chunks(up.Size) {
+		return svc.upload(ctx, up)
+	}
+	if !digest.Verify() {
+		log.WithFields(log.Fields{
+			"id":     session.ID,
+			"sha256": digest.SHA256(),
+		}).Warn("Upload hash mismatch")
+		return nil, echo.NewHTTPError(BadRequest, "Hash mismatch")
+	}
+
+	blob, err := svc.beginUpload(up)
+	if err != nil {
+		return nil, err
+	}
+	opts := objectOptions(blob, blob.PendingRevision, contentType)
+	err = composer.Compose(ctx, pendingObjectKey(blob), keys, opts)
+	if err == store.ErrNotSupported {
+		return svc.storeUpload(ctx, up, blob, contentType)
+	}
+	if err != nil {
+		svc.abandon(blob)
+		log.WithError(err).WithField("id", blob.ID).Error("Error assembling upload parts")
+		return nil, echo.NewHTTPError(InternalServerError, "Error saving file")
+	}
+	return svc.commitUpload(up, blob, session.Length, digest.SHA256(), contentType)
+}
+
+// discardUpload deletes an upload along with its parts
+func (svc *blobsService) discardUpload(session *db.Upload) error {
+	if err := svc.Database.DeleteUpload(session); err != nil {
+		return err
+	}
+	svc.removeObjects(session.PartKeys())
+	return nil
+}
+
+// removeObjects removes objects, logging rather than returning failures.
+// Removal goes ahead even if the request that led to it was cancelled.
+func (svc *blobsService) removeObjects(keys []string) {
+	for _, key := range keys {
+		if err := svc.Store.Remove(context.Background(), key); err != nil {
+			log.WithError(err).WithField("key", key).Error("Failed to remove object")
+		}
+	}
+}
+
+// cleanupUploads discards resumable uploads that have not received content
+// for longer than maxAge
+func (svc *blobsService) cleanupUploads(maxAge time.Duration) error {
+
+	const batchSize = 100
+
+	cutoff := time.Now().Add(-maxAge)
+	offset := 0
+
+	for {
+		sessions, err := svc.Database.ListUploads(db.Query{
+			Offset:        offset,
+			Limit:         batchSize,
+			UpdatedBefore: cutoff,
+		})
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			log.WithField("id", session.ID).Warn("Discarding expired upload")
+			if err := svc.discardUpload(session); err != nil {
+				// Modified in the meantime; it keeps its place in the results
+				log.WithError(err).WithField("id", session.ID).Error("Failed to discard upload")
+				offset++
+			}
+		}
+		if len(sessions) < batchSize {
+			return nil
+		}
+	}
+}
+
+// parseTusMetadata parses an Upload-Metadata header into upload attributes.
+// The header holds comma separated pairs of a key and a base64 encoded
+// value. The blob path is taken from the "path" key, falling back to
+// "filename" as sent by common tus clients; likewise "content_type" falls
+// back to "filetype". Properties are given as a JSON object.
+func parseTusMetadata(header string) (*BlobUploadAttributes, error) {
+
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, errors.New("Invalid Upload-Metadata")
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Upload-Metadata value for '%s'", fields[0])
+			}
+			value = string(decoded)
+		}
+		meta[fields[0]] = value
+	}
+
+	attrs := &BlobUploadAttributes{
+		Path:        meta["path"],
+		Hash:        meta["hash"],
+		ContentType: meta["content_type"],
+	}
+	if attrs.Path == "" {
+		attrs.Path = meta["filename"]
+	}
+	if attrs.Path == "" {
+		return nil, errors.New("Upload path missing")
+	}
+	if attrs.ContentType == "" && validContentType(meta["filetype"]) {
+		attrs.ContentType = meta["filetype"]
+	}
+	if props := meta["properties"]; props != "" {
+		if err := json.Unmarshal([]byte(props), &attrs.Properties); err != nil {
+			return nil, errors.New("Invalid properties")
+		}
+	}
+	return attrs, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/myzie/base"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+)
+
+func tusMetadata(pairs ...string) string {
+	var fields []string
+	for i := 0; i < len(pairs); i += 2 {
+		value := base64.StdEncoding.EncodeToString([]byte(pairs[i+1]))
+		fields = append(fields, pairs[i]+" "+value)
+	}
+	return strings.Join(fields, ",")
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		header      string
+		path        string
+		contentType string
+		hash        string
+		ok          bool
+	}{
+		{tusMetadata("path", "/a.txt"), "/a.txt", "", "", true},
+		{tusMetadata("filename", "/b.txt", "filetype", "text/plain"), "/b.txt", "text/plain", "", true},
+		{tusMetadata("path", "/a.txt", "filename", "/b.txt"), "/a.txt", "", "", true},
+		{tusMetadata("path", "/a.txt", "content_type", "text/csv", "filetype", "text/plain"), "/a.txt", "text/csv", "", true},
+		{tusMetadata("path", "/a.txt", "filetype", "not a type"), "/a.txt", "", "", true},
+		{tusMetadata("path", "/a.txt", "hash", "sha256:00"), "/a.txt", "", "sha256:00", true},
+		{tusMetadata("path", "/a.txt") + ", empty", "/a.txt", "", "", true},
+		{"", "", "", "", false},
+		{tusMetadata("content_type", "text/plain"), "", "", "", false},
+		{"path !!!", "", "", "", false},
+		{"path a b", "", "", "", false},
+		{tusMetadata("path", "/a.txt", "properties", "[1]"), "", "", "", false},
+	}
+	for _, test := range tests {
+		attrs, err := parseTusMetadata(test.header)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Expected Upload-Metadata %q to be invalid", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Upload-Metadata %q: %v", test.header, err)
+			continue
+		}
+		if attrs.Path != test.path || attrs.ContentType != test.contentType || attrs.Hash != test.hash {
+			t.Errorf("Upload-Metadata %q parsed as %+v", test.header, *attrs)
+		}
+	}
+
+	attrs, err := parseTusMetadata(tusMetadata("path", "/a.txt", "properties", `{"color":"red"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Properties["color"] != "red" {
+		t.Errorf("Unexpected properties %v", attrs.Properties)
+	}
+}
+
+// tusRequest runs a tus request through a handler as user "tester"
+func tusRequest(handler echo.HandlerFunc, method, id string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/uploads/"+id, body)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	claims := &base.JWTClaims{}
+	claims.Subject = "tester"
+	c.Set("user", &jwt.Token{Claims: claims})
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	if err := tusResumable(handler)(c); err != nil {
+		c.Error(err)
+	}
+	return rec
+}
+
+func newTusService() *blobsService {
+	return &blobsService{
+		Database:  db.NewMemoryDB(),
+		Store:     store.NewMemoryObjectStore(),
+		SizeLimit: 1 << 20,
+	}
+}
+
+func createTusUpload(t *testing.T, svc *blobsService, path string, length int) string {
+	rec := tusRequest(svc.CreateUpload, "POST", "", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": tusMetadata("path", path),
+	})
+	if rec.Code != Created {
+		t.Fatalf("Create upload returned %d: %s", rec.Code, rec.Body.String())
+	}
+	return strings.TrimPrefix(rec.Header().Get("Location"), "/uploads/")
+}
+
+func appendTusUpload(svc *blobsService, id string, offset int, content string) *httptest.ResponseRecorder {
+	return tusRequest(svc.AppendUpload, "PATCH", id, strings.NewReader(content), map[string]string{
+		"Content-Type":  tusContentType,
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+func TestTusProtocol(t *testing.T) {
+	svc := newTusService()
+
+	rec := tusRequest(svc.CreateUpload, "POST", "", nil, map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": tusMetadata("path", "/a.txt"),
+		"Tus-Resumable":   "0.2.2",
+	})
+	if rec.Code != PreconditionFailed || rec.Header().Get("Tus-Version") != tusVersion {
+		t.Errorf("Expected an unsupported version to fail with %d, got %d", PreconditionFailed, rec.Code)
+	}
+	for _, length := range []string{"", "-1", "x", strconv.Itoa(2 << 20)} {
+		rec := tusRequest(svc.CreateUpload, "POST", "", nil, map[string]string{
+			"Upload-Length":   length,
+			"Upload-Metadata": tusMetadata("path", "/a.txt"),
+		})
+		if rec.Code != BadRequest && rec.Code != RequestTooLarge {
+			t.Errorf("Expected Upload-Length %q to be rejected, got %d", length, rec.Code)
+		}
+	}
+
+	id := createTusUpload(t, svc, "/a.txt", 10)
+
+	rec = tusRequest(svc.AppendUpload, "PATCH", id, strings.NewReader("hello"), map[string]string{
+		"Content-Type":  "text/plain",
+		"Upload-Offset": "0",
+	})
+	if rec.Code != UnsupportedMediaType {
+		t.Errorf("Expected a PATCH that is not %s to fail with %d, got %d", tusContentType, UnsupportedMediaType, rec.Code)
+	}
+
+	rec = appendTusUpload(svc, id, 0, "hello")
+	if rec.Code != NoContent || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("First PATCH returned %d with offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec = appendTusUpload(svc, id, 0, "hello"); rec.Code != Conflict {
+		t.Errorf("Expected a PATCH at a stale offset to fail with %d, got %d", Conflict, rec.Code)
+	}
+	if rec = appendTusUpload(svc, id, 5, "world, again"); rec.Code != RequestTooLarge {
+		t.Errorf("Expected a PATCH beyond the upload length to fail with %d, got %d", RequestTooLarge, rec.Code)
+	}
+
+	rec = tusRequest(svc.UploadStatus, "HEAD", id, nil, nil)
+	if rec.Code != OK || rec.Header().Get("Upload-Offset") != "5" || rec.Header().Get("Upload-Length") != "10" {
+		t.Errorf("HEAD returned %d with headers %v", rec.Code, rec.Header())
+	}
+
+	rec = appendTusUpload(svc, id, 5, "world")
+	if rec.Code != NoContent || rec.Header().Get("ETag") == "" {
+		t.Fatalf("Final PATCH returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec = tusRequest(svc.UploadStatus, "HEAD", id, nil, nil); rec.Code != NotFound {
+		t.Errorf("Expected the completed upload to be gone, got %d", rec.Code)
+	}
+
+	blob, err := svc.Database.Get("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Size != 10 || blob.CreatedBy != "tester" {
+		t.Errorf("Unexpected blob %+v", *blob)
+	}
+
+	// An empty upload completes when created
+	rec = tusRequest(svc.CreateUpload, "POST", "", nil, map[string]string{
+		"Upload-Length":   "0",
+		"Upload-Metadata": tusMetadata("path", "/empty.txt"),
+	})
+	if rec.Code != Created || rec.Header().Get("ETag") == "" {
+		t.Errorf("Empty upload returned %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Terminated uploads are gone
+	id = createTusUpload(t, svc, "/b.txt", 10)
+	if rec = tusRequest(svc.TerminateUpload, "DELETE", id, nil, nil); rec.Code != NoContent {
+		t.Errorf("DELETE returned %d", rec.Code)
+	}
+	if rec = appendTusUpload(svc, id, 0, "hello"); rec.Code != NotFound {
+		t.Errorf("Expected a terminated upload to be gone, got %d", rec.Code)
+	}
+}
+
+func TestTusCompletionClaim(t *testing.T) {
+	svc := newTusService()
+	id := createTusUpload(t, svc, "/a.txt", 5)
+
+	// Two requests completing the same upload; only the first to claim it
+	// goes ahead
+	first, err := svc.Database.GetUpload(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.Database.GetUpload(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.CompletingAt = time.Now()
+	if err := svc.Database.UpdateUpload(first, []string{"completing_at"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.completeUpload(context.Background(), second); !isConflict(err) {
+		t.Errorf("Expected a second completion to conflict, got %v", err)
+	}
+
+	// The claimed upload may not be completed again or terminated
+	if rec := appendTusUpload(svc, id, 0, "hello"); rec.Code != Conflict {
+		t.Errorf("Expected completing a claimed upload to fail with %d, got %d", Conflict, rec.Code)
+	}
+	if rec := tusRequest(svc.TerminateUpload, "DELETE", id, nil, nil); rec.Code != Conflict {
+		t.Errorf("Expected terminating a claimed upload to fail with %d, got %d", Conflict, rec.Code)
+	}
+
+	// Once the claim times out the completion may be retried
+	if first, err = svc.Database.GetUpload(id); err != nil {
+		t.Fatal(err)
+	}
+	first.CompletingAt = time.Now().Add(-tusClaimTimeout)
+	if err := svc.Database.UpdateUpload(first, []string{"completing_at"}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := appendTusUpload(svc, id, 5, ""); rec.Code != NoContent || rec.Header().Get("ETag") == "" {
+		t.Errorf("Retried completion returned %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func isConflict(err error) bool {
+	he, ok := err.(*echo.HTTPError)
+	return ok && he.Code == Conflict
+}
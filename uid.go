@@ -16,3 +16,12 @@ func init() {
 func uid() string {
 	return ulid.MustNew(ulid.Now(), entropy).String()
 }
+
+// uidTime returns the time at which a uid was generated
+func uidTime(id string) (time.Time, error) {
+	parsed, err := ulid.Parse(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ulid.Time(parsed.Time()), nil
+}
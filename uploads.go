@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/labstack/echo"
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// upload describes content being written to the blob at a path
+type upload struct {
+	UserID     string
+	Path       string
+	Size       int64 // -1 if not known in advance
+	Properties postgres.Jsonb
+	Reader     io.Reader
+
+	// ContentType declared by the client, if any. It is confirmed by
+	// sniffing the content before it is stored.
+	ContentType string
+
+	// Checksum supplied by the client, if any, to verify the content against
+	Checksum *checksum
+
+	// Preconditions on the blob being replaced
+	Preconditions preconditions
+
+	// Encoding is the compression the content was stored with, if any, and
+	// StoredSize the size of the compressed object. They are set once the
+	// content is stored.
+	Encoding   string
+	StoredSize int64
+
+	// Chunked is set once the content is stored as chunks, in which case
+	// the object holds their manifest
+	Chunked bool
+}
+
+// upload stores content for the blob at the upload path, creating the blob
+// if it does not exist. The object is written to a staging key and the blob
+// metadata is only switched to it once the write has been verified, so a
+// failed upload never disturbs the previously committed content.
+func (svc *blobsService) upload(ctx context.Context, up *upload) (*db.Blob, error) {
+
+	if up.Size > svc.SizeLimit {
+		return nil, echo.NewHTTPError(RequestTooLarge, "File too large")
+	}
+
+	contentType, err := sniffUpload(up)
+	if err != nil {
+		return nil, echo.NewHTTPError(BadRequest, "Failed to read upload")
+	}
+
+	blob, err := svc.beginUpload(up)
+	if err != nil {
+		return nil, err
+	}
+	return svc.storeUpload(ctx, up, blob, contentType)
+}
+
+// storeUpload streams the content of an upload to the pending key of its
+// blob, which has been begun, and commits it once verified. The content is
+// abandoned if it can not be stored.
+func (svc *blobsService) storeUpload(ctx context.Context, up *upload, blob *db.Blob, contentType string) (*db.Blob, error) {
+
+	var err error
+	revision := blob.PendingRevision
+
+	opts := objectOptions(blob, revision, contentType)
+
+	// Measure and hash the content as it streams into the store
+	digest := newDigester(up.Checksum)
+	counter := &countingReader{Reader: up.Reader, Limit: svc.SizeLimit}
+	reader := io.TeeReader(counter, digest)
+
+	// Large content is stored as deduplicated chunks, listed by a manifest
+	// stored in place of the content. Otherwise compressible content is
+	// compressed as it streams into the store.
+	var manifest *chunkManifest
+	size := up.Size
+	if svc.chunks(up.Size) {
+		manifest, err = svc.storeChunks(ctx, blob.PendingBackend, reader)
+		if err == nil {
+			up.Chunked = true
+			opts.ContentType = manifestContentType
+			reader, size = manifest.encode()
+		}
+	} else {
+		up.Encoding = svc.compressionFor(contentType)
+	}
+	if up.Encoding != "" {
+		compressed, err := store.Compress(reader, up.Encoding)
+		if err != nil {
+			svc.abandon(blob)
+			return nil, err
+		}
+		defer compressed.Close()
+		reader, size = compressed, -1
+	}
+
+	if err == nil {
+		up.StoredSize, err = svc.Store.Put(ctx, pendingObjectKey(blob), reader, size, opts)
+	}
+	if err == nil && up.Size >= 0 && counter.N != up.Size {
+		err = fmt.Errorf("Uploaded file size incorrect: expected %d, got %d", up.Size, counter.N)
+	}
+	if err != nil {
+		svc.releaseChunks(manifest)
+		svc.abandon(blob)
+		if counter.Exceeded() {
+			return nil, echo.NewHTTPError(RequestTooLarge, "File too large")
+		}
+		log.WithError(err).WithField("id", blob.ID).Error("Error saving file to bucket")
+		return nil, echo.NewHTTPError(InternalServerError, "Error saving file")
+	}
+	if !digest.Verify() {
+		log.WithFields(log.Fields{
+			"id":     blob.ID,
+			"sha256": digest.SHA256(),
+		}).Warn("Upload hash mismatch")
+		svc.releaseChunks(manifest)
+		svc.abandon(blob)
+		return nil, echo.NewHTTPError(BadRequest, "Hash mismatch")
+	}
+
+	committed, err := svc.commitUpload(up, blob, counter.N, digest.SHA256(), contentType)
+	if err != nil {
+		svc.releaseChunks(manifest)
+	}
+	return committed, err
+}
+
+// beginUpload records a new pending revision on the blob at the upload path,
+// creating the blob if it does not exist. Content for the revision is to be
+// stored at the pending key of the returned blob.
+func (svc *blobsService) beginUpload(up *upload) (*db.Blob, error) {
+
+	revision := uid()
+
+	// Record the upload as pending on a new or existing blob
+	blob, err := svc.Database.Get(up.Path)
+	if err != nil {
+		if err != db.ErrNotFound {
+			return nil, err
+		}
+		if !up.Preconditions.allowWrite(nil) {
+			return nil, echo.NewHTTPError(PreconditionFailed, "Precondition failed")
+		}
+
+		blob = &db.Blob{
+			ID:              uid(),
+			CreatedBy:       up.UserID,
+			UpdatedBy:       up.UserID,
+			Path:            up.Path,
+			Properties:      up.Properties,
+			State:           db.StatePending,
+			PendingRevision: revision,
+			PendingBackend:  svc.route(up.Path),
+		}
+
+		log.WithFields(log.Fields{
+			"id":         blob.ID,
+			"created_by": blob.CreatedBy,
+			"path":       blob.Path,
+			"size":       up.Size,
+		}).Info("Creating blob")
+
+		if err := svc.Database.Save(blob); err != nil {
+			return nil, err
+		}
+	} else {
+		if !up.Preconditions.allowWrite(blob) {
+			return nil, echo.NewHTTPError(PreconditionFailed, "Precondition failed")
+		}
+		// Versioning ensures the blob is unchanged since it was checked
+		blob.PendingRevision = revision
+		blob.PendingBackend = svc.route(up.Path)
+		if err := svc.Database.Update(blob, []string{"pending_revision", "pending_backend"}); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"id":   blob.ID,
+		"key":  pendingObjectKey(blob),
+		"size": up.Size,
+	}).Info("Upload starting")
+
+	return blob, nil
+}
+
+// commitUpload switches a blob over to the content stored for its pending
+// revision, which has been verified to hold size bytes with the given
+// SHA-256 digest, if known, and content type
+func (svc *blobsService) commitUpload(up *upload, blob *db.Blob, size int64, sha256, contentType string) (*db.Blob, error) {
+
+	revision := blob.PendingRevision
+
+	// The new object is in place. Make sure no other upload or the stale
+	// upload cleanup has taken over the blob before switching it over.
+	current, err := svc.Database.Get(up.Path)
+	if err != nil || current.ID != blob.ID || current.PendingRevision != revision {
+		if rmErr := svc.Store.Remove(context.Background(), pendingObjectKey(blob)); rmErr != nil {
+			log.WithError(rmErr).WithField("key", pendingObjectKey(blob)).Error("Failed to remove staged object")
+		}
+		if err != nil && err != db.ErrNotFound {
+			return nil, err
+		}
+		return nil, echo.NewHTTPError(Conflict, "Upload superseded")
+	}
+	blob = current
+
+	var previousBackend, previousKey string
+	var previousChunked bool
+	if blob.Committed() {
+		previousBackend, previousKey, previousChunked = blob.Backend, blob.Key(), blob.Chunked
+	}
+	blob.State = db.StateCommitted
+	blob.ObjectKey = blob.PendingKey()
+	blob.Backend = blob.PendingBackend
+	blob.Revision = revision
+	blob.PendingRevision = ""
+	blob.PendingBackend = ""
+	blob.Restoring = false
+	blob.Size = size
+	blob.SHA256 = sha256
+	blob.ContentType = contentType
+	blob.Encoding = up.Encoding
+	blob.StoredSize = size
+	if up.Encoding != "" || up.Chunked {
+		blob.StoredSize = up.StoredSize
+	}
+	blob.Chunked = up.Chunked
+	blob.Properties = up.Properties
+	blob.UpdatedBy = up.UserID
+
+	fields := []string{"state", "object_key", "backend", "revision", "pending_revision", "pending_backend", "restoring", "size", "sha256", "content_type", "encoding", "stored_size", "chunked", "properties", "updated_by"}
+	if err := svc.Database.Update(blob, fields); err != nil {
+		if rmErr := svc.Store.Remove(context.Background(), objectKey(blob)); rmErr != nil {
+			log.WithError(rmErr).WithField("key", objectKey(blob)).Error("Failed to remove staged object")
+		}
+		return nil, err
+	}
+
+	if previousKey != "" && store.BackendKey(previousBackend, previousKey) != objectKey(blob) {
+		svc.releaseObject(previousBackend, previousKey, previousChunked)
+	}
+
+	log.WithFields(log.Fields{
+		"id":         blob.ID,
+		"key":        objectKey(blob),
+		"updated_by": blob.UpdatedBy,
+		"size":       blob.Size,
+		"stored":     blob.StoredSize,
+		"encoding":   blob.Encoding,
+		"chunked":    blob.Chunked,
+		"sha256":     blob.SHA256,
+		"type":       blob.ContentType,
+	}).Info("Upload complete")
+
+	return blob, nil
+}
+
+// objectOptions returns the options an object is stored with. Its metadata
+// describes the blob revision it holds.
+func objectOptions(blob *db.Blob, revision, contentType string) store.PutOptions {
+	return store.PutOptions{
+		ContentType: contentType,
+		Metadata: map[string]string{
+			"id":       blob.ID,
+			"revision": revision,
+		},
+	}
+}
+
+// abandon discards the pending upload of a blob. A blob that was never
+// committed is marked as failed. The staged object is only removed once the
+// blob no longer refers to it, so that an upload which committed in the
+// meantime is never damaged; if the update fails the stale upload cleanup
+// will retry later, and the error is returned. Uploads are often abandoned
+// because their request was cancelled, so the removal does not depend on it.
+func (svc *blobsService) abandon(blob *db.Blob) error {
+
+	key := pendingObjectKey(blob)
+	if key == "" {
+		return nil
+	}
+
+	blob.PendingRevision = ""
+	blob.PendingBackend = ""
+	fields := []string{"pending_revision", "pending_backend"}
+	if !blob.Committed() {
+		blob.State = db.StateFailed
+		fields = append(fields, "state")
+	}
+	if err := svc.Database.Update(blob, fields); err != nil {
+		log.WithError(err).WithField("id", blob.ID).Error("Failed to abandon upload")
+		return err
+	}
+	if err := svc.Store.Remove(context.Background(), key); err != nil {
+		log.WithError(err).WithField("key", key).Error("Failed to remove staged object")
+	}
+	return nil
+}
+
+// cleanupPending abandons uploads that have been pending for longer than
+// maxAge. These are left behind when the process exits mid upload.
+func (svc *blobsService) cleanupPending(maxAge time.Duration) error {
+
+	const batchSize = 100
+
+	cutoff := time.Now().Add(-maxAge)
+	offset := 0
+
+	for {
+		blobs, err := svc.Database.List(db.Query{
+			Offset:  offset,
+			Limit:   batchSize,
+			OrderBy: "id",
+			Pending: true,
+		})
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			started, err := uidTime(blob.PendingRevision)
+			if err == nil && started.After(cutoff) {
+				// Still in progress; it keeps its place in the results
+				offset++
+				continue
+			}
+			log.WithFields(log.Fields{
+				"id":  blob.ID,
+				"key": pendingObjectKey(blob),
+			}).Warn("Abandoning stale upload")
+			if err := svc.abandon(blob); err != nil {
+				// Still pending; it keeps its place in the results
+				offset++
+			}
+		}
+		if len(blobs) < batchSize {
+			return nil
+		}
+	}
+}
+
+// runCleanup periodically abandons stale pending uploads, discards expired
+// resumable uploads and collects unreferenced chunks
+func (svc *blobsService) runCleanup(interval, maxAge time.Duration) {
+	for range time.Tick(interval) {
+		if err := svc.cleanupPending(maxAge); err != nil {
+			log.WithError(err).Error("Pending upload cleanup failed")
+		}
+		if err := svc.cleanupUploads(svc.UploadExpiry); err != nil {
+			log.WithError(err).Error("Resumable upload cleanup failed")
+		}
+		if err := svc.collectChunks(svc.ChunkGrace); err != nil {
+			log.WithError(err).Error("Chunk collection failed")
+		}
+	}
+}
+
+// errTooLarge is returned when an upload exceeds the size limit
+var errTooLarge = errors.New("Upload exceeds size limit")
+
+// countingReader counts the bytes read through it and fails with errTooLarge
+// once more than Limit bytes have been read
+type countingReader struct {
+	Reader io.Reader
+	Limit  int64
+	N      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.N += int64(n)
+	if r.N > r.Limit {
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+// Exceeded returns true if more than Limit bytes were read
+func (r *countingReader) Exceeded() bool {
+	return r.N > r.Limit
+}
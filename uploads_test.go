@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/myzie/blobs/db"
+	"github.com/myzie/blobs/store"
+)
+
+// failingDB is a Database whose updates fail
+type failingDB struct {
+	db.Database
+}
+
+func (d failingDB) Update(blob *db.Blob, fields []string) error {
+	return errors.New("Update failed")
+}
+
+func TestCleanupPendingFailures(t *testing.T) {
+	database := db.NewMemoryDB()
+	for i := 0; i < 250; i++ {
+		blob := &db.Blob{
+			ID:              uid(),
+			Path:            fmt.Sprintf("/pending/%d.txt", i),
+			State:           db.StatePending,
+			PendingRevision: uid(),
+		}
+		if err := database.Save(blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svc := &blobsService{Database: failingDB{database}, Store: store.NewMemoryObjectStore()}
+
+	done := make(chan error, 1)
+	go func() { done <- svc.cleanupPending(-time.Hour) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Cleanup did not finish when uploads could not be abandoned")
+	}
+
+	svc.Database = database
+	if err := svc.cleanupPending(-time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := database.List(db.Query{Pending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("%d uploads left pending", len(pending))
+	}
+}
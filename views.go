@@ -11,26 +11,61 @@ type errorView struct {
 	Error string `json:"error"`
 }
 
+type validationErrorView struct {
+	Error   string   `json:"error"`
+	Details []string `json:"details"`
+}
+
 type blobView struct {
-	ID         string          `json:"id"`
-	CreatedAt  time.Time       `json:"created_at"`
-	UpdatedAt  time.Time       `json:"updated_at"`
-	CreatedBy  string          `json:"created_by"`
-	UpdatedBy  string          `json:"updated_by"`
-	Path       string          `json:"path"`
-	Size       int64           `json:"size"`
-	Properties json.RawMessage `json:"properties"`
+	ID          string          `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	CreatedBy   string          `json:"created_by"`
+	UpdatedBy   string          `json:"updated_by"`
+	Path        string          `json:"path"`
+	Size        int64           `json:"size"`
+	SHA256      string          `json:"sha256,omitempty"`
+	ContentType string          `json:"content_type"`
+	Properties  json.RawMessage `json:"properties"`
+	State       string          `json:"state"`
+	Version     int64           `json:"version"`
+	Tier        string          `json:"tier,omitempty"`
+	Restoring   bool            `json:"restoring,omitempty"`
+	Encoding    string          `json:"encoding,omitempty"`
+	StoredSize  int64           `json:"stored_size,omitempty"`
+	Chunked     bool            `json:"chunked,omitempty"`
 }
 
 func newBlobView(blob *db.Blob) *blobView {
+	state := blob.State
+	if state == "" {
+		state = db.StateCommitted
+	}
 	return &blobView{
-		ID:         blob.ID,
-		CreatedAt:  blob.CreatedAt,
-		CreatedBy:  blob.CreatedBy,
-		UpdatedAt:  blob.UpdatedAt,
-		UpdatedBy:  blob.UpdatedBy,
-		Path:       blob.Path,
-		Size:       blob.Size,
-		Properties: blob.Properties.RawMessage,
+		ID:          blob.ID,
+		CreatedAt:   blob.CreatedAt,
+		CreatedBy:   blob.CreatedBy,
+		UpdatedAt:   blob.UpdatedAt,
+		UpdatedBy:   blob.UpdatedBy,
+		Path:        blob.Path,
+		Size:        blob.Size,
+		SHA256:      blob.SHA256,
+		ContentType: blobContentType(blob),
+		Properties:  blob.Properties.RawMessage,
+		State:       state,
+		Version:     blob.Version,
+		Tier:        blob.Backend,
+		Restoring:   blob.Restoring,
+		Encoding:    blob.Encoding,
+		StoredSize:  blob.StoredSize,
+		Chunked:     blob.Chunked,
 	}
 }
+
+type presignView struct {
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Revision  string    `json:"revision,omitempty"`
+	Proxied   bool      `json:"proxied"`
+}